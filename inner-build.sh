@@ -1,14 +1,18 @@
 #!/bin/bash
 set -e -u
 
-if [ "$(go version 2>/dev/null)" != "go version go1.8.3 linux/amd64" ]
+if [ "$(go version 2>/dev/null)" != "go version go1.13.15 linux/amd64" ]
 then
-	echo "go version mismatch! expected 1.8.3" 1>&2
+	echo "go version mismatch! expected 1.13.15" 1>&2
 	go version 1>&2
 	exit 1
 fi
 
 export GOPATH="$(pwd)"
 
-go build src/farad/main/farad.go
+# add -tags pkcs11 to support keys on PKCS#11 tokens, which requires cgo and the p11-kit headers
+# (go test -tags pkcs11 util/pkcs11util also tests against a SoftHSM2 token, if SoftHSM2 is installed)
+go build -o farad farad/main
+go build -o faradctl faradctl/main
+go build -o faraday-ca faraday-ca/main
 # go build src/faradayd/main/faradayd.go
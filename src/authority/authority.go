@@ -0,0 +1,300 @@
+// Package authority is a small certificate authority for faraday nodes. It keeps its state in a single directory:
+//
+//	ca.pem         the certificate of the authority
+//	ca-key.pem     the private key of the authority, which may be encrypted
+//	index.json     every certificate that has been issued, and whether it has been revoked
+//	issued/        a copy of each issued certificate, named by its serial number
+//
+// It is meant for small deployments and test labs, which would otherwise need external key management infrastructure
+// to stand up a cluster.
+package authority
+
+import (
+	"common"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"util/wraputil"
+)
+
+// how far certificates are backdated, so that nodes with slightly slow clocks accept them immediately
+const BACKDATE = time.Minute * 5
+
+// the range of serial numbers, which are random so that they can't be predicted
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// An Authority issues node certificates, and tracks them so that they can be revoked. It is safe to use from multiple
+// goroutines, and from multiple processes sharing the same directory.
+type Authority struct {
+	Cert *x509.Certificate
+	// If set, a WireGuard key requested in this extension is copied into issued certificates, which pins the key that
+	// the node may use, as described by common.PinnedKey.
+	PinnedKeyOID asn1.ObjectIdentifier
+	key          crypto.Signer
+	dir          string
+	// serializes access to the index within this process; flock does the same between processes
+	lock sync.Mutex
+}
+
+// GenerateKey creates a private key with one of the algorithms "ecdsa" (P-256), "ed25519", or "rsa" (2048 bits).
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+	}
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, fmt.Errorf("while generating serial number: %s", err.Error())
+	}
+	return serial, nil
+}
+
+// keyIdentifier computes a subject key identifier by the first method of RFC 5280, section 4.2.1.2.
+func keyIdentifier(public crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(info.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	return writeAtomically(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+// writeAtomically replaces a file in one step, so that a crash never leaves it half-written.
+func writeAtomically(path string, data []byte, mode os.FileMode) error {
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp, mode); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Init creates a new authority in dir, which must not already contain one. The key of the authority is generated with
+// the specified algorithm, as accepted by GenerateKey, and is written unencrypted, readable only by its owner.
+func Init(dir string, name string, algorithm string, validity time.Duration) (*Authority, error) {
+	if _, err := os.Stat(filepath.Join(dir, "ca.pem")); err == nil {
+		return nil, fmt.Errorf("an authority already exists in %s", dir)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "issued"), 0700); err != nil {
+		return nil, fmt.Errorf("while creating authority directory: %s", err.Error())
+	}
+	key, err := GenerateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	keyid, err := keyIdentifier(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("while computing key identifier: %s", err.Error())
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-BACKDATE),
+		NotAfter:     now.Add(validity),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// node certificates are issued directly; sub-CAs should come from real key management infrastructure
+		MaxPathLenZero: true,
+		SubjectKeyId:   keyid,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("while creating authority certificate: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyder, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// the key is written first, so that a crash can't leave a certificate without its key
+	if err := writePEM(filepath.Join(dir, "ca-key.pem"), "PRIVATE KEY", keyder, 0600); err != nil {
+		return nil, fmt.Errorf("while writing authority key: %s", err.Error())
+	}
+	if err := writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", der, 0644); err != nil {
+		return nil, fmt.Errorf("while writing authority certificate: %s", err.Error())
+	}
+	authority := &Authority{Cert: cert, key: key, dir: dir}
+	if err := authority.update(func(index *Index) error { return nil }); err != nil {
+		return nil, err
+	}
+	return authority, nil
+}
+
+// Open loads the authority in dir. If its key is encrypted, passphrase must be provided; otherwise, it must be nil.
+func Open(dir string, passphrase []byte) (*Authority, error) {
+	certdata, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("while loading authority: %s", err.Error())
+	}
+	keydata, err := ioutil.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("while loading authority: %s", err.Error())
+	}
+	keypair, err := wraputil.LoadEncryptedTLSKeypairFromPEM(certdata, keydata, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("while loading authority: %s", err.Error())
+	}
+	if !keypair.Leaf.IsCA {
+		return nil, errors.New("authority certificate is not a CA certificate")
+	}
+	return &Authority{Cert: keypair.Leaf, key: keypair.PrivateKey.(crypto.Signer), dir: dir}, nil
+}
+
+// Bundle is the authority certificate in PEM form, for distribution to farad and nodes as their trusted CA.
+func (authority *Authority) Bundle() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Cert.Raw})
+}
+
+// SignCSR issues a node certificate for a certificate signing request, valid for the specified duration. The principal
+// of the node is the CommonName of the request, which must be present. So that it can be found by either the "cn" or
+// "dns" principal extractors, it is placed in the CommonName and also as the first DNS name, followed by any other DNS
+// names requested. The certificate may be used for both client and server authentication. Other than a pinned key, as
+// described by PinnedKeyOID, any extensions that were requested are ignored.
+func (authority *Authority) SignCSR(csr *x509.CertificateRequest, validity time.Duration) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("while checking certificate request: %s", err.Error())
+	}
+	principal := csr.Subject.CommonName
+	if principal == "" {
+		return nil, errors.New("certificate request has no common name")
+	}
+	dns := []string{principal}
+	for _, name := range csr.DNSNames {
+		if name != principal {
+			dns = append(dns, name)
+		}
+	}
+	keyid, err := keyIdentifier(csr.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("while computing key identifier: %s", err.Error())
+	}
+	var extensions []pkix.Extension
+	if authority.PinnedKeyOID != nil {
+		pinned, err := common.PinnedKey(csr.Extensions, authority.PinnedKeyOID)
+		if err != nil {
+			return nil, err
+		}
+		if pinned != "" {
+			value, err := asn1.Marshal(pinned)
+			if err != nil {
+				return nil, err
+			}
+			extensions = append(extensions, pkix.Extension{Id: authority.PinnedKeyOID, Value: value})
+		}
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		// needed for RSA key exchange in older versions of TLS
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(authority.Cert.NotAfter) {
+		notAfter = authority.Cert.NotAfter
+	}
+
+	var cert *x509.Certificate
+	err = authority.update(func(index *Index) error {
+		serial, err := randomSerial()
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: principal},
+			DNSNames:     dns,
+			NotBefore:    now.Add(-BACKDATE),
+			NotAfter:     notAfter,
+
+			KeyUsage:              keyUsage,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  false,
+			SubjectKeyId:          keyid,
+			ExtraExtensions:       extensions,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, authority.Cert, csr.PublicKey, authority.key)
+		if err != nil {
+			return fmt.Errorf("while signing certificate: %s", err.Error())
+		}
+		cert, err = x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(authority.issuedPath(serial), "CERTIFICATE", der, 0644); err != nil {
+			return fmt.Errorf("while recording issued certificate: %s", err.Error())
+		}
+		index.Issued = append(index.Issued, IssuedCert{
+			Serial:    serial.Text(16),
+			Principal: principal,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (authority *Authority) issuedPath(serial *big.Int) string {
+	return filepath.Join(authority.dir, "issued", serial.Text(16)+".pem")
+}
+
+// Chain is a node certificate followed by the authority certificate, in PEM form, as farad and faradayd load their own
+// certificates.
+func (authority *Authority) Chain(cert *x509.Certificate) []byte {
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), authority.Bundle()...)
+}
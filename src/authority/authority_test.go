@@ -0,0 +1,239 @@
+package authority
+
+import (
+	"common"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+	"util/wraputil"
+)
+
+func tempAuthority(t *testing.T, algorithm string) (*Authority, func()) {
+	dir, err := ioutil.TempDir("", "authority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := Init(dir, "test-ca", algorithm, time.Hour*24)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return authority, func() { os.RemoveAll(dir) }
+}
+
+func requestFor(t *testing.T, key crypto.Signer, commonname string, dns []string) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonname},
+		DNSNames: dns,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestInitAndOpen(t *testing.T) {
+	for _, algorithm := range []string{"ecdsa", "ed25519", "rsa"} {
+		authority, cleanup := tempAuthority(t, algorithm)
+		defer cleanup()
+		if !authority.Cert.IsCA || authority.Cert.Subject.CommonName != "test-ca" {
+			t.Error("wrong authority certificate")
+		}
+		info, err := os.Stat(filepath.Join(authority.dir, "ca-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("authority key should not be readable by others: %v", info.Mode())
+		}
+		reopened, err := Open(authority.dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reopened.Cert.Equal(authority.Cert) {
+			t.Error("reopened the wrong authority")
+		}
+	}
+}
+
+func TestInit_AlreadyExists(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	_, err := Init(authority.dir, "test-ca", "ecdsa", time.Hour)
+	testutil.CheckError(t, err, "an authority already exists")
+}
+
+func TestInit_UnknownAlgorithm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = Init(dir, "test-ca", "dsa", time.Hour)
+	testutil.CheckError(t, err, "unknown key algorithm \"dsa\"")
+}
+
+func TestOpen_Missing(t *testing.T) {
+	_, err := Open("/nonexistent/authority", nil)
+	testutil.CheckError(t, err, "while loading authority")
+}
+
+func TestSignCSR(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	for _, algorithm := range testkeyutil.KeyAlgorithms {
+		key := testkeyutil.GenerateKeyForTests(t, algorithm)
+		cert, err := authority.SignCSR(requestFor(t, key, "node-a", []string{"node-a.example.com", "node-a"}), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Subject.CommonName != "node-a" || len(cert.DNSNames) != 2 || cert.DNSNames[0] != "node-a" || cert.DNSNames[1] != "node-a.example.com" {
+			t.Errorf("wrong names in certificate: %q %v", cert.Subject.CommonName, cert.DNSNames)
+		}
+		if cert.IsCA {
+			t.Error("node certificates should not be CAs")
+		}
+		if err := wraputil.CheckKeyMatchesCert(key, cert); err != nil {
+			t.Error(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(authority.Cert)
+		for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth} {
+			_, err := cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{usage}})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestSignCSR_Recorded(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	cert, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := authority.Issued()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 1 || issued[0].Serial != cert.SerialNumber.Text(16) || issued[0].Principal != "node-a" || issued[0].RevokedAt != nil {
+		t.Errorf("wrong index entries: %+v", issued)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(authority.dir, "issued", cert.SerialNumber.Text(16)+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := wraputil.LoadX509CertFromPEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Equal(cert) {
+		t.Error("wrong certificate saved")
+	}
+}
+
+func TestSignCSR_LimitedByAuthority(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	cert, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil), time.Hour*24*365)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.NotAfter.After(authority.Cert.NotAfter) {
+		t.Error("certificate should not outlive its authority")
+	}
+}
+
+func TestSignCSR_NoCommonName(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	_, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "", []string{"node-a"}), time.Hour)
+	testutil.CheckError(t, err, "certificate request has no common name")
+}
+
+func TestSignCSR_BadSignature(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	csr := requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil)
+	// claim somebody else's key
+	csr.PublicKey = testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA).Public()
+	_, err := authority.SignCSR(csr, time.Hour)
+	testutil.CheckError(t, err, "while checking certificate request")
+}
+
+func TestChain(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ed25519")
+	defer cleanup()
+	cert, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := wraputil.LoadX509ChainFromPEM(authority.Chain(cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || !chain[0].Equal(cert) || !chain[1].Equal(authority.Cert) {
+		t.Error("wrong chain")
+	}
+}
+
+func TestSignCSR_PinnedKey(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	request := func(value string) *x509.CertificateRequest {
+		der, err := asn1.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+		csrder, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:         pkix.Name{CommonName: "node-a"},
+			ExtraExtensions: []pkix.Extension{{Id: oid, Value: der}},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(csrder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+	wgkey := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+
+	// ignored unless the authority is configured to copy it
+	cert, err := authority.SignCSR(request(wgkey), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, err := common.PinnedKey(cert.Extensions, oid); err != nil || pinned != "" {
+		t.Errorf("should not have pinned a key: %q %v", pinned, err)
+	}
+
+	authority.PinnedKeyOID = oid
+	cert, err = authority.SignCSR(request(wgkey), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, err := common.PinnedKey(cert.Extensions, oid); err != nil || pinned != wgkey {
+		t.Errorf("should have pinned the key: %q %v", pinned, err)
+	}
+	_, err = authority.SignCSR(request("not-a-key"), time.Hour)
+	testutil.CheckError(t, err, "holds an invalid WireGuard key")
+}
@@ -0,0 +1,169 @@
+package authority
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// An IssuedCert records a certificate issued by an Authority.
+type IssuedCert struct {
+	// in hexadecimal, as it appears in the issued directory
+	Serial    string
+	Principal string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// nil unless the certificate has been revoked
+	RevokedAt *time.Time `json:",omitempty"`
+}
+
+// An Index is the record, stored in index.json, of every certificate that an Authority has issued.
+type Index struct {
+	Issued []IssuedCert
+}
+
+// lockIndex keeps other goroutines and processes from changing the index until the returned function is called.
+func (authority *Authority) lockIndex(how int) (func(), error) {
+	authority.lock.Lock()
+	lockfile, err := os.OpenFile(filepath.Join(authority.dir, "index.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		authority.lock.Unlock()
+		return nil, fmt.Errorf("while locking index: %s", err.Error())
+	}
+	if err := syscall.Flock(int(lockfile.Fd()), how); err != nil {
+		lockfile.Close()
+		authority.lock.Unlock()
+		return nil, fmt.Errorf("while locking index: %s", err.Error())
+	}
+	return func() {
+		// closing the file releases the flock
+		lockfile.Close()
+		authority.lock.Unlock()
+	}, nil
+}
+
+// update loads the index, lets the caller change it, and then saves it again, without any other process or goroutine
+// changing it in between. If the caller returns an error, the index is left as it was.
+func (authority *Authority) update(change func(index *Index) error) error {
+	unlock, err := authority.lockIndex(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := authority.readIndex()
+	if err != nil {
+		return err
+	}
+	if err := change(index); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeAtomically(filepath.Join(authority.dir, "index.json"), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("while saving index: %s", err.Error())
+	}
+	return nil
+}
+
+func (authority *Authority) readIndex() (*Index, error) {
+	index := &Index{}
+	data, err := ioutil.ReadFile(filepath.Join(authority.dir, "index.json"))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("while loading index: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("while parsing index: %s", err.Error())
+	}
+	return index, nil
+}
+
+// view loads the index for the caller to read, without any other process or goroutine changing it in the meantime.
+func (authority *Authority) view(read func(index *Index) error) error {
+	unlock, err := authority.lockIndex(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	index, err := authority.readIndex()
+	if err != nil {
+		return err
+	}
+	return read(index)
+}
+
+// Issued lists every certificate that has been issued, in the order they were issued.
+func (authority *Authority) Issued() ([]IssuedCert, error) {
+	var issued []IssuedCert
+	err := authority.view(func(index *Index) error {
+		issued = index.Issued
+		return nil
+	})
+	return issued, err
+}
+
+// Revoke marks an issued certificate, identified by its serial number in hexadecimal, as revoked. It will be listed in
+// every CRL generated from then on, until it expires.
+func (authority *Authority) Revoke(serial string) error {
+	serialNumber, ok := new(big.Int).SetString(serial, 16)
+	if !ok {
+		return fmt.Errorf("invalid serial number %q", serial)
+	}
+	serial = serialNumber.Text(16)
+	return authority.update(func(index *Index) error {
+		for i, issued := range index.Issued {
+			if issued.Serial != serial {
+				continue
+			}
+			if issued.RevokedAt != nil {
+				return fmt.Errorf("certificate %s was already revoked", serial)
+			}
+			now := time.Now().UTC()
+			index.Issued[i].RevokedAt = &now
+			return nil
+		}
+		return fmt.Errorf("no certificate with serial number %s was issued", serial)
+	})
+}
+
+// CRL generates a certificate revocation list, in PEM form, listing every revoked certificate that has not yet expired.
+// The CRL should be regenerated well before the validity duration runs out.
+func (authority *Authority) CRL(validity time.Duration) ([]byte, error) {
+	var der []byte
+	err := authority.view(func(index *Index) error {
+		now := time.Now()
+		revoked := []pkix.RevokedCertificate{}
+		for _, issued := range index.Issued {
+			if issued.RevokedAt == nil || now.After(issued.NotAfter) {
+				continue
+			}
+			serial, ok := new(big.Int).SetString(issued.Serial, 16)
+			if !ok {
+				return fmt.Errorf("invalid serial number %q in index", issued.Serial)
+			}
+			revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: *issued.RevokedAt})
+		}
+		var err error
+		der, err = authority.Cert.CreateCRL(rand.Reader, authority.key, revoked, now, now.Add(validity))
+		if err != nil {
+			return fmt.Errorf("while generating CRL: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
@@ -0,0 +1,123 @@
+package authority
+
+import (
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+	"util/wraputil"
+)
+
+func TestRevokeAndCRL(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	revoked, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-b", nil), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Revoke(revoked.SerialNumber.Text(16)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := authority.CRL(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := wraputil.LoadSinglePEMBlock(data, []string{"X509 CRL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseDERCRL(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Cert.CheckCRLSignature(crl); err != nil {
+		t.Error(err)
+	}
+	entries := crl.TBSCertList.RevokedCertificates
+	if len(entries) != 1 {
+		t.Fatalf("wrong number of revoked certificates: %d", len(entries))
+	}
+	if entries[0].SerialNumber.Cmp(kept.SerialNumber) == 0 {
+		t.Error("should not have revoked the other certificate")
+	} else if entries[0].SerialNumber.Cmp(revoked.SerialNumber) != 0 {
+		t.Error("wrong certificate revoked")
+	}
+}
+
+func TestRevoke_Twice(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	cert, err := authority.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node-a", nil), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Revoke(cert.SerialNumber.Text(16)); err != nil {
+		t.Fatal(err)
+	}
+	err = authority.Revoke(cert.SerialNumber.Text(16))
+	testutil.CheckError(t, err, "was already revoked")
+}
+
+func TestRevoke_Unknown(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	testutil.CheckError(t, authority.Revoke("abc123"), "no certificate with serial number abc123 was issued")
+	testutil.CheckError(t, authority.Revoke("xyz"), "invalid serial number")
+}
+
+func TestCRL_Empty(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ed25519")
+	defer cleanup()
+	data, err := authority.CRL(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := wraputil.LoadSinglePEMBlock(data, []string{"X509 CRL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseDERCRL(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.TBSCertList.RevokedCertificates) != 0 {
+		t.Error("nothing should have been revoked")
+	}
+}
+
+func TestIndex_Concurrent(t *testing.T) {
+	authority, cleanup := tempAuthority(t, "ecdsa")
+	defer cleanup()
+	// a second handle on the same directory, as if it were another process
+	other, err := Open(authority.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		for _, handle := range []*Authority{authority, other} {
+			wg.Add(1)
+			go func(handle *Authority) {
+				defer wg.Done()
+				if _, err := handle.SignCSR(requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "node", nil), time.Hour); err != nil {
+					t.Error(err)
+				}
+			}(handle)
+		}
+	}
+	wg.Wait()
+	issued, err := authority.Issued()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 20 {
+		t.Errorf("lost index entries: only %d recorded", len(issued))
+	}
+}
@@ -1,14 +1,31 @@
 package common
 
+import "time"
+
 const FARADAY_PROTOCOL_VERSION = 1
 
 // updates the current state for us and queries the current state for everyone
 type FaradRequest struct {
-	Version        int
-	Key            string
+	Version int
+	Key     string
+	// the key that the node will rotate to, announced in every request until it switches to it, so that peers can
+	// accept the new key before the node starts using it (empty if the node isn't rotating its key)
+	NextKey        string
 	Cursor         uint64
 	IncludeMember  string
 	ServerInstance string
+	// the epoch of the preshared keys that the node has for every peer, as given by the last response that listed all
+	// of them, so that farad only lists them all again once they rotate (0 if none)
+	PresharedKeyEpoch uint64
+	// the size of the last key transparency tree head that the node verified, so that farad can prove that the log has
+	// only been appended to since (0 if none)
+	TreeSize uint64
+	// how long farad should keep the node without hearing from it, or 0 for farad's default; farad may grant a
+	// different lease, depending on the node
+	Lease time.Duration
+	// set by a node that is shutting down, so that farad removes it at once and tells its peers to drop it; Key must be
+	// its current key, and the response holds no members
+	Leave bool
 }
 
 // the response will include everything that has been changed since the specified cursor (or ever, if the cursor is 0),
@@ -16,6 +33,68 @@ type FaradRequest struct {
 // if a member no longer exists, it will not be included in the result.
 type FaradResponse struct {
 	CurrentCluster map[string]string // map of principals -> public keys
+	// keys that members will rotate to, which peers should accept alongside their current keys
+	NextKeys map[string]string // map of principals -> public keys
+	// keys that members have just rotated away from, which peers should keep accepting until they are no longer listed
+	PreviousKeys   map[string]string // map of principals -> public keys
 	Cursor         uint64
 	ServerInstance string
+	// the lease granted to the node, which it must ping within to remain in the cluster
+	Lease time.Duration
+	// principals that have left the cluster since the cursor of the request, which peers should drop; only listed when
+	// CurrentCluster only holds the changes since then
+	Departed []string
+	// only included if farad hands out preshared keys: the keys that the node shares with each peer during
+	// PresharedKeyEpoch, and during the epoch after it, which are for every peer if the request had an older epoch, and
+	// otherwise only for the peers in CurrentCluster
+	PresharedKeyEpoch uint64
+	PresharedKeys     map[string]string // map of principals -> preshared keys
+	NextPresharedKeys map[string]string // map of principals -> preshared keys
+	// the same view of the cluster, signed by farad, so that it can be passed on to other nodes; nil if farad has no
+	// snapshot key
+	Signed *SignedSnapshot
+	// the rest is only included if farad keeps a key transparency log
+	TreeHead *SignedTreeHead
+	// proves that TreeHead extends the tree of the size given by TreeSize in the request, if that is not larger
+	Consistency [][]byte
+	Inclusions  map[string]*KeyInclusion // map of principals -> proofs that their keys in CurrentCluster were logged
+}
+
+// sent to farad's enrollment endpoint by a node that needs a certificate. A node that doesn't have one yet must include
+// a join token; a node renewing its certificate may instead authenticate with its current one.
+type EnrollRequest struct {
+	Version int
+	Token   string
+	CSR     string // PEM-encoded certificate signing request, with the principal of the node as its common name
+}
+
+type EnrollResponse struct {
+	Chain string // PEM-encoded certificate for the node, followed by the authority that issued it
+}
+
+const (
+	ADMIN_COMMAND_STATUS  = "status"
+	ADMIN_COMMAND_MEMBERS = "members"
+	ADMIN_COMMAND_TOKEN   = "token"
+	ADMIN_COMMAND_RELOAD  = "reload" // reloads CRLs and evicts revoked members, without waiting for the next sweep
+)
+
+// sent by local tools over a daemon's admin socket, rather than over the network. TokenPatterns and TokenLifetime are
+// only used for ADMIN_COMMAND_TOKEN.
+type AdminRequest struct {
+	Command       string
+	TokenPatterns []string // patterns, in the syntax of path.Match, of the principals that the token may enroll
+	TokenLifetime time.Duration
+}
+
+// Members and Expirations are only included for ADMIN_COMMAND_MEMBERS, and Token and TokenExpiration are only included
+// for ADMIN_COMMAND_TOKEN.
+type AdminResponse struct {
+	ServerInstance  string
+	Cursor          uint64
+	MemberCount     int
+	Members         map[string]string    // map of principals -> public keys
+	Expirations     map[string]time.Time // map of principals -> when they will be dropped, unless they ping again
+	Token           string
+	TokenExpiration time.Time
 }
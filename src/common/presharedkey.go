@@ -0,0 +1,17 @@
+package common
+
+import "time"
+
+// how long farad hands out the same preshared key for a pair of nodes before moving on to the next one
+const PRESHARED_KEY_ROTATION = time.Hour
+
+// PresharedKeyEpoch returns the rotation period that 't' falls in. Epochs follow wall-clock time, so that nodes with
+// roughly synchronized clocks switch to the next preshared keys together.
+func PresharedKeyEpoch(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(PRESHARED_KEY_ROTATION/time.Second)
+}
+
+// PresharedKeyEpochStart returns the time at which nodes should start using the preshared keys of an epoch.
+func PresharedKeyEpochStart(epoch uint64) time.Time {
+	return time.Unix(int64(epoch*uint64(PRESHARED_KEY_ROTATION/time.Second)), 0)
+}
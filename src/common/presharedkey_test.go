@@ -0,0 +1,21 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresharedKeyEpoch(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	epoch := PresharedKeyEpoch(now)
+	start := PresharedKeyEpochStart(epoch)
+	if now.Before(start) || !now.Before(start.Add(PRESHARED_KEY_ROTATION)) {
+		t.Errorf("epoch %d starts at %v, which does not contain %v", epoch, start, now)
+	}
+	if PresharedKeyEpoch(start.Add(PRESHARED_KEY_ROTATION)) != epoch+1 {
+		t.Error("the next epoch should start where this one ends")
+	}
+	if PresharedKeyEpoch(start.Add(-time.Second)) != epoch-1 {
+		t.Error("the previous epoch should end where this one starts")
+	}
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// how far ahead of a verifier's clock a snapshot's timestamp may be, since farad and nodes won't agree exactly
+const SNAPSHOT_CLOCK_SKEW = time.Minute
+
+// the view of the cluster that farad sent in a FaradResponse, as signed by farad so that it can be passed between nodes
+// and checked without contacting farad.
+type ClusterSnapshot struct {
+	ServerInstance string
+	// the cursor that the changes are relative to, or 0 if every member is included
+	Since        uint64
+	Cursor       uint64
+	Members      map[string]string // map of principals -> public keys
+	NextKeys     map[string]string
+	PreviousKeys map[string]string
+	// members that have left since Since, if it is not 0
+	Departed  []string
+	Timestamp time.Time
+}
+
+// Payload is the JSON encoding of a ClusterSnapshot, which is kept as it was signed, so that verifiers don't need to
+// reproduce the exact encoding.
+type SignedSnapshot struct {
+	Payload   []byte
+	Signature []byte
+}
+
+// signPayload signs with farad's snapshot key, which may be an RSA, ECDSA, or Ed25519 key. RSA and ECDSA signatures are
+// over the SHA-256 digest of the payload.
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func checkPayloadSignature(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch pubkey := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pubkey, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+		rest, err := asn1.Unmarshal(signature, &parsed)
+		return err == nil && len(rest) == 0 && ecdsa.Verify(pubkey, digest[:], parsed.R, parsed.S)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pubkey, payload, signature)
+	default:
+		return false
+	}
+}
+
+// SignSnapshot signs a snapshot with farad's snapshot key.
+func SignSnapshot(key crypto.Signer, snapshot *ClusterSnapshot) (*SignedSnapshot, error) {
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("while encoding snapshot: %s", err.Error())
+	}
+	signature, err := signPayload(key, payload)
+	if err != nil {
+		return nil, fmt.Errorf("while signing snapshot: %s", err.Error())
+	}
+	return &SignedSnapshot{Payload: payload, Signature: signature}, nil
+}
+
+// VerifySnapshot checks that a snapshot was signed by farad's snapshot key, and decodes it. It does not check whether
+// the snapshot is current; see SnapshotVerifier for that.
+func VerifySnapshot(key crypto.PublicKey, signed *SignedSnapshot) (*ClusterSnapshot, error) {
+	if signed == nil {
+		return nil, errors.New("snapshot is not signed")
+	}
+	if !checkPayloadSignature(key, signed.Payload, signed.Signature) {
+		return nil, errors.New("invalid snapshot signature")
+	}
+	snapshot := &ClusterSnapshot{}
+	if err := json.Unmarshal(signed.Payload, snapshot); err != nil {
+		return nil, fmt.Errorf("while decoding snapshot: %s", err.Error())
+	}
+	return snapshot, nil
+}
+
+// A SnapshotVerifier verifies a sequence of snapshots, such as those received by one node, and refuses any that are
+// older than the last one it accepted, so that a stale view of the cluster can't be replayed to the node. A
+// SnapshotVerifier IS UNSYNCHRONIZED.
+type SnapshotVerifier struct {
+	key     crypto.PublicKey
+	max_age time.Duration
+	last    *ClusterSnapshot
+}
+
+// NewSnapshotVerifier creates a SnapshotVerifier for snapshots signed by 'key', which are refused once they are older
+// than max_age.
+func NewSnapshotVerifier(key crypto.PublicKey, max_age time.Duration) *SnapshotVerifier {
+	return &SnapshotVerifier{key: key, max_age: max_age}
+}
+
+// Accept verifies a snapshot, and checks that it is recent and follows on from the last snapshot accepted. A snapshot
+// from the same instance of farad must not go back in time or to an earlier cursor, and its changes must be relative to
+// a cursor no later than the last one accepted. A snapshot from a different instance of farad must be newer, and must
+// include every member, since cursors are not comparable between instances.
+func (v *SnapshotVerifier) Accept(signed *SignedSnapshot) (*ClusterSnapshot, error) {
+	snapshot, err := VerifySnapshot(v.key, signed)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if snapshot.Timestamp.Add(v.max_age).Before(now) {
+		return nil, fmt.Errorf("snapshot from %v is too old", snapshot.Timestamp)
+	}
+	if snapshot.Timestamp.After(now.Add(SNAPSHOT_CLOCK_SKEW)) {
+		return nil, fmt.Errorf("snapshot from %v is in the future", snapshot.Timestamp)
+	}
+	if v.last != nil {
+		if snapshot.Timestamp.Before(v.last.Timestamp) {
+			return nil, fmt.Errorf("snapshot from %v is older than the last one accepted", snapshot.Timestamp)
+		}
+		if snapshot.ServerInstance == v.last.ServerInstance {
+			if snapshot.Cursor < v.last.Cursor {
+				return nil, fmt.Errorf("snapshot at cursor %d is behind the last one accepted, at %d", snapshot.Cursor, v.last.Cursor)
+			}
+			if snapshot.Since > v.last.Cursor {
+				return nil, fmt.Errorf("snapshot only has changes since cursor %d, after the last one accepted, at %d", snapshot.Since, v.last.Cursor)
+			}
+		} else if !snapshot.Timestamp.After(v.last.Timestamp) || snapshot.Since != 0 {
+			return nil, errors.New("snapshot from a different server instance does not replace the last one accepted")
+		}
+	} else if snapshot.Since != 0 {
+		return nil, errors.New("the first snapshot accepted must include every member")
+	}
+	v.last = snapshot
+	return snapshot, nil
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"crypto"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+func signForTests(t *testing.T, key crypto.Signer, snapshot ClusterSnapshot) *SignedSnapshot {
+	signed, err := SignSnapshot(key, &snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSignSnapshot(t *testing.T) {
+	for _, algorithm := range testkeyutil.KeyAlgorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			key := testkeyutil.GenerateKeyForTests(t, algorithm)
+			signed := signForTests(t, key, ClusterSnapshot{
+				ServerInstance: "instance-a",
+				Cursor:         3,
+				Members:        map[string]string{"node-a": "key-a"},
+				Timestamp:      time.Now(),
+			})
+			snapshot, err := VerifySnapshot(key.Public(), signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.ServerInstance != "instance-a" || snapshot.Cursor != 3 || snapshot.Members["node-a"] != "key-a" {
+				t.Errorf("wrong snapshot: %+v", snapshot)
+			}
+			signed.Payload[len(signed.Payload)-2] ^= 1
+			_, err = VerifySnapshot(key.Public(), signed)
+			testutil.CheckError(t, err, "invalid snapshot signature")
+		})
+	}
+}
+
+func TestVerifySnapshot_WrongKey(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	signed := signForTests(t, key, ClusterSnapshot{Timestamp: time.Now()})
+	_, err := VerifySnapshot(other.Public(), signed)
+	testutil.CheckError(t, err, "invalid snapshot signature")
+	_, err = VerifySnapshot(key.Public(), nil)
+	testutil.CheckError(t, err, "snapshot is not signed")
+}
+
+func TestSnapshotVerifier(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.Ed25519)
+	v := NewSnapshotVerifier(key.Public(), time.Minute)
+	now := time.Now()
+	_, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Since: 2, Cursor: 4, Timestamp: now}))
+	testutil.CheckError(t, err, "the first snapshot accepted must include every member")
+	first := signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Cursor: 4, Timestamp: now.Add(-time.Second * 10)})
+	if _, err := v.Accept(first); err != nil {
+		t.Fatal(err)
+	}
+	// changes since an earlier cursor are fine, and so is a snapshot that only confirms nothing has changed
+	if _, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Since: 3, Cursor: 5, Timestamp: now.Add(-time.Second * 5)})); err != nil {
+		t.Error(err)
+	}
+	if _, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Since: 5, Cursor: 5, Timestamp: now})); err != nil {
+		t.Error(err)
+	}
+	_, err = v.Accept(first)
+	testutil.CheckError(t, err, "is older than the last one accepted")
+	_, err = v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Cursor: 4, Timestamp: now}))
+	testutil.CheckError(t, err, "snapshot at cursor 4 is behind the last one accepted, at 5")
+	_, err = v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Since: 6, Cursor: 7, Timestamp: now}))
+	testutil.CheckError(t, err, "only has changes since cursor 6")
+}
+
+func TestSnapshotVerifier_NewInstance(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.Ed25519)
+	v := NewSnapshotVerifier(key.Public(), time.Minute)
+	now := time.Now()
+	if _, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "a", Cursor: 40, Timestamp: now.Add(-time.Second)})); err != nil {
+		t.Fatal(err)
+	}
+	_, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "b", Since: 1, Cursor: 2, Timestamp: now}))
+	testutil.CheckError(t, err, "does not replace the last one accepted")
+	if _, err := v.Accept(signForTests(t, key, ClusterSnapshot{ServerInstance: "b", Cursor: 2, Timestamp: now})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotVerifier_Freshness(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.Ed25519)
+	v := NewSnapshotVerifier(key.Public(), time.Minute)
+	_, err := v.Accept(signForTests(t, key, ClusterSnapshot{Timestamp: time.Now().Add(-time.Minute * 2)}))
+	testutil.CheckError(t, err, "is too old")
+	_, err = v.Accept(signForTests(t, key, ClusterSnapshot{Timestamp: time.Now().Add(SNAPSHOT_CLOCK_SKEW * 2)}))
+	testutil.CheckError(t, err, "is in the future")
+}
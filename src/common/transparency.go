@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A KeyBinding is an entry in farad's key transparency log, recording that a principal announced a key while
+// authenticated by a particular certificate.
+type KeyBinding struct {
+	Principal string
+	Key       string
+	Serial    string // of the certificate, in hexadecimal
+	Time      time.Time
+}
+
+// the state of farad's key transparency log, as a Merkle tree hash over every KeyBinding in the log, computed as in
+// RFC 6962.
+type TreeHead struct {
+	Size      uint64
+	RootHash  []byte
+	Timestamp time.Time // of the last entry in the log
+}
+
+// Payload is the JSON encoding of a TreeHead, signed with farad's snapshot key.
+type SignedTreeHead struct {
+	Payload   []byte
+	Signature []byte
+}
+
+// proves that a KeyBinding is entry Index of the log, in the tree described by a TreeHead.
+type KeyInclusion struct {
+	Binding KeyBinding
+	Index   uint64
+	Path    [][]byte
+}
+
+// MerkleLeafHash hashes an entry of a log, as in RFC 6962.
+func MerkleLeafHash(binding KeyBinding) ([]byte, error) {
+	encoded, err := json.Marshal(binding)
+	if err != nil {
+		return nil, fmt.Errorf("while encoding key binding: %s", err.Error())
+	}
+	hash := sha256.Sum256(append([]byte{0}, encoded...))
+	return hash[:], nil
+}
+
+// MerkleNodeHash combines the hashes of two subtrees, as in RFC 6962.
+func MerkleNodeHash(left []byte, right []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte{1})
+	hasher.Write(left)
+	hasher.Write(right)
+	return hasher.Sum(nil)
+}
+
+// SignTreeHead signs a tree head with farad's snapshot key.
+func SignTreeHead(key crypto.Signer, head *TreeHead) (*SignedTreeHead, error) {
+	payload, err := json.Marshal(head)
+	if err != nil {
+		return nil, fmt.Errorf("while encoding tree head: %s", err.Error())
+	}
+	signature, err := signPayload(key, payload)
+	if err != nil {
+		return nil, fmt.Errorf("while signing tree head: %s", err.Error())
+	}
+	return &SignedTreeHead{Payload: payload, Signature: signature}, nil
+}
+
+// VerifyTreeHead checks that a tree head was signed by farad's snapshot key, and decodes it.
+func VerifyTreeHead(key crypto.PublicKey, signed *SignedTreeHead) (*TreeHead, error) {
+	if signed == nil {
+		return nil, errors.New("tree head is not signed")
+	}
+	if !checkPayloadSignature(key, signed.Payload, signed.Signature) {
+		return nil, errors.New("invalid tree head signature")
+	}
+	head := &TreeHead{}
+	if err := json.Unmarshal(signed.Payload, head); err != nil {
+		return nil, fmt.Errorf("while decoding tree head: %s", err.Error())
+	}
+	return head, nil
+}
+
+// VerifyKeyInclusion checks that the log described by 'head' binds 'principal' to 'key', so that a node can make sure
+// that a key was logged before it accepts it from a peer.
+func VerifyKeyInclusion(head *TreeHead, principal string, key string, inclusion *KeyInclusion) error {
+	if inclusion == nil {
+		return fmt.Errorf("key of %q was not shown to be logged", principal)
+	}
+	if inclusion.Binding.Principal != principal || inclusion.Binding.Key != key {
+		return fmt.Errorf("logged binding of %q does not match key %q", principal, key)
+	}
+	leaf, err := MerkleLeafHash(inclusion.Binding)
+	if err != nil {
+		return err
+	}
+	if !VerifyInclusion(leaf, inclusion.Index, head.Size, inclusion.Path, head.RootHash) {
+		return fmt.Errorf("invalid inclusion proof for key of %q", principal)
+	}
+	return nil
+}
+
+// VerifyInclusion checks an inclusion proof for the leaf at 'index' of a tree of 'size' leaves, as described in
+// RFC 9162.
+func VerifyInclusion(leaf []byte, index uint64, size uint64, path [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = MerkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = MerkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks a proof that a tree of second_size leaves extends a tree of first_size leaves, as described
+// in RFC 9162, so that a node can make sure that the log has only been appended to since it last checked.
+func VerifyConsistency(first_size uint64, second_size uint64, first_root []byte, second_root []byte, proof [][]byte) bool {
+	if first_size > second_size {
+		return false
+	}
+	if first_size == second_size {
+		return len(proof) == 0 && bytes.Equal(first_root, second_root)
+	}
+	if first_size == 0 {
+		// every tree extends the empty tree
+		return len(proof) == 0
+	}
+	if first_size&(first_size-1) == 0 {
+		proof = append([][]byte{first_root}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := first_size-1, second_size-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = MerkleNodeHash(c, fr)
+			sr = MerkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = MerkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, first_root) && bytes.Equal(sr, second_root)
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+func TestSignTreeHead(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	leaf, err := MerkleLeafHash(KeyBinding{Principal: "node-a", Key: "key-a", Serial: "1", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignTreeHead(key, &TreeHead{Size: 1, RootHash: leaf, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := VerifyTreeHead(key.Public(), signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != 1 || string(head.RootHash) != string(leaf) {
+		t.Errorf("wrong tree head: %+v", head)
+	}
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	_, err = VerifyTreeHead(other.Public(), signed)
+	testutil.CheckError(t, err, "invalid tree head signature")
+	_, err = VerifyTreeHead(key.Public(), nil)
+	testutil.CheckError(t, err, "tree head is not signed")
+}
+
+// a tree of three leaves: root = H(H(a, b), c)
+func threeLeaves(t *testing.T) ([]KeyBinding, [][]byte, []byte) {
+	bindings := []KeyBinding{
+		{Principal: "node-a", Key: "key-a", Serial: "1"},
+		{Principal: "node-b", Key: "key-b", Serial: "2"},
+		{Principal: "node-c", Key: "key-c", Serial: "3"},
+	}
+	leaves := [][]byte{}
+	for _, binding := range bindings {
+		leaf, err := MerkleLeafHash(binding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	return bindings, leaves, MerkleNodeHash(MerkleNodeHash(leaves[0], leaves[1]), leaves[2])
+}
+
+func TestVerifyKeyInclusion(t *testing.T) {
+	bindings, leaves, root := threeLeaves(t)
+	head := &TreeHead{Size: 3, RootHash: root}
+	inclusion := &KeyInclusion{Binding: bindings[1], Index: 1, Path: [][]byte{leaves[0], leaves[2]}}
+	if err := VerifyKeyInclusion(head, "node-b", "key-b", inclusion); err != nil {
+		t.Error(err)
+	}
+	testutil.CheckError(t, VerifyKeyInclusion(head, "node-b", "key-x", inclusion), "logged binding of \"node-b\" does not match key \"key-x\"")
+	testutil.CheckError(t, VerifyKeyInclusion(head, "node-b", "key-b", nil), "key of \"node-b\" was not shown to be logged")
+	inclusion.Index = 0
+	testutil.CheckError(t, VerifyKeyInclusion(head, "node-b", "key-b", inclusion), "invalid inclusion proof")
+	// the last leaf only needs the hash of the complete subtree to its left
+	if !VerifyInclusion(leaves[2], 2, 3, [][]byte{MerkleNodeHash(leaves[0], leaves[1])}, root) {
+		t.Error("should have verified inclusion of the last leaf")
+	}
+	if VerifyInclusion(leaves[2], 3, 3, nil, root) {
+		t.Error("should not verify a leaf beyond the tree")
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	_, leaves, root := threeLeaves(t)
+	first := MerkleNodeHash(leaves[0], leaves[1])
+	if !VerifyConsistency(2, 3, first, root, [][]byte{leaves[2]}) {
+		t.Error("should have verified consistency from two leaves to three")
+	}
+	if !VerifyConsistency(1, 3, leaves[0], root, [][]byte{leaves[1], leaves[2]}) {
+		t.Error("should have verified consistency from one leaf to three")
+	}
+	if VerifyConsistency(2, 3, leaves[0], root, [][]byte{leaves[2]}) {
+		t.Error("should not verify consistency with the wrong old root")
+	}
+	if VerifyConsistency(3, 2, root, first, nil) {
+		t.Error("should not verify consistency with a smaller tree")
+	}
+	if !VerifyConsistency(3, 3, root, root, nil) || VerifyConsistency(3, 3, root, first, nil) {
+		t.Error("a tree should only be consistent with itself")
+	}
+}
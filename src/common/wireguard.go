@@ -0,0 +1,44 @@
+package common
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+)
+
+// ValidateWireGuardKey checks that a key is a WireGuard public key, in the form used by wg(8): 32 bytes, in standard
+// base64, spelled the one way that wg(8) spells it.
+func ValidateWireGuardKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	// other spellings of the same key, such as with line breaks or stray low bits, would get past checks that compare
+	// keys as strings
+	if err != nil || len(raw) != 32 || base64.StdEncoding.EncodeToString(raw) != key {
+		return fmt.Errorf("invalid WireGuard key %q", key)
+	}
+	return nil
+}
+
+// PinnedKey finds the WireGuard public key pinned by the extension identified by 'oid', among the extensions of a
+// certificate or certificate request. The extension value must be a single ASN.1 string holding the key, as accepted by
+// ValidateWireGuardKey. If there is no such extension, the result is empty.
+func PinnedKey(extensions []pkix.Extension, oid asn1.ObjectIdentifier) (string, error) {
+	for _, ext := range extensions {
+		if !ext.Id.Equal(oid) {
+			continue
+		}
+		var key string
+		rest, err := asn1.Unmarshal(ext.Value, &key)
+		if err != nil {
+			return "", fmt.Errorf("while parsing pinned key extension %s: %s", oid, err.Error())
+		}
+		if len(rest) > 0 {
+			return "", fmt.Errorf("trailing data in pinned key extension %s", oid)
+		}
+		if err := ValidateWireGuardKey(key); err != nil {
+			return "", fmt.Errorf("pinned key extension %s holds an invalid WireGuard key", oid)
+		}
+		return key, nil
+	}
+	return "", nil
+}
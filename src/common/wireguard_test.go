@@ -0,0 +1,57 @@
+package common
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+	"util/testutil"
+)
+
+const TEST_WIREGUARD_KEY = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+
+var testOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+
+func TestValidateWireGuardKey(t *testing.T) {
+	if err := ValidateWireGuardKey(TEST_WIREGUARD_KEY); err != nil {
+		t.Error(err)
+	}
+	for _, invalid := range []string{"", "key-a", "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg", "AAAA",
+		// the same key, spelled differently
+		"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dh=", "xTIBA5rboUvnH4htodjb\n6e697QjLERt1NAB4mZqp8Dg="} {
+		testutil.CheckError(t, ValidateWireGuardKey(invalid), "invalid WireGuard key")
+	}
+}
+
+func extensionWith(t *testing.T, value string) pkix.Extension {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: testOID, Value: der}
+}
+
+func TestPinnedKey(t *testing.T) {
+	other := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: []byte{0x05, 0x00}}
+	key, err := PinnedKey([]pkix.Extension{other, extensionWith(t, TEST_WIREGUARD_KEY)}, testOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != TEST_WIREGUARD_KEY {
+		t.Errorf("wrong key: %q", key)
+	}
+	key, err = PinnedKey([]pkix.Extension{other}, testOID)
+	if err != nil || key != "" {
+		t.Errorf("should not have found a key: %q %v", key, err)
+	}
+}
+
+func TestPinnedKey_Invalid(t *testing.T) {
+	_, err := PinnedKey([]pkix.Extension{extensionWith(t, "key-a")}, testOID)
+	testutil.CheckError(t, err, "pinned key extension 1.3.6.1.4.1.99999.2 holds an invalid WireGuard key")
+	_, err = PinnedKey([]pkix.Extension{{Id: testOID, Value: []byte{0xff}}}, testOID)
+	testutil.CheckError(t, err, "while parsing pinned key extension")
+	ext := extensionWith(t, TEST_WIREGUARD_KEY)
+	ext.Value = append(ext.Value, 0)
+	_, err = PinnedKey([]pkix.Extension{ext}, testOID)
+	testutil.CheckError(t, err, "trailing data in pinned key extension")
+}
@@ -0,0 +1,151 @@
+// Package enrollment lets nodes obtain certificates through farad, either with a one-time join token when they don't
+// have a certificate yet, or by authenticating with their current certificate when it needs to be renewed.
+package enrollment
+
+import (
+	"authority"
+	"common"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+	"util/wraputil"
+)
+
+// join tokens are meant to be handed to a machine as it is provisioned, not kept around
+const MAX_TOKEN_LIFETIME = time.Hour * 24 * 7
+
+type joinToken struct {
+	patterns []string
+	expires  time.Time
+}
+
+// An Enroller issues node certificates from an authority. It is safe to use from multiple goroutines.
+type Enroller struct {
+	authority *authority.Authority
+	validity  time.Duration
+	// keyed by the SHA-256 hash of each token, so that the tokens themselves are never kept
+	tokens map[[sha256.Size]byte]joinToken
+	lock   sync.Mutex
+}
+
+// NewEnroller creates an Enroller that issues certificates valid for the specified duration. The certificates should
+// be short-lived, since nodes renew them automatically.
+func NewEnroller(ca *authority.Authority, validity time.Duration) *Enroller {
+	return &Enroller{
+		authority: ca,
+		validity:  validity,
+		tokens:    map[[sha256.Size]byte]joinToken{},
+	}
+}
+
+// Authority is the authority that issues certificates to enrolled nodes, which must be trusted by farad.
+func (e *Enroller) Authority() *authority.Authority {
+	return e.authority
+}
+
+// CreateToken generates a join token that can be used once, within the specified lifetime, to enroll a node whose
+// principal matches at least one of the patterns. Tokens only exist in memory, so they are lost if farad restarts.
+func (e *Enroller) CreateToken(patterns []string, lifetime time.Duration) (string, time.Time, error) {
+	if len(patterns) == 0 {
+		return "", time.Time{}, errors.New("join token must allow at least one principal pattern")
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid principal pattern %q", pattern)
+		}
+	}
+	if lifetime <= 0 || lifetime > MAX_TOKEN_LIFETIME {
+		return "", time.Time{}, fmt.Errorf("join token lifetime must be positive and at most %v", MAX_TOKEN_LIFETIME)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, fmt.Errorf("while generating join token: %s", err.Error())
+	}
+	token := hex.EncodeToString(secret)
+	expires := time.Now().Add(lifetime)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.dropExpired()
+	e.tokens[sha256.Sum256([]byte(token))] = joinToken{patterns: append([]string{}, patterns...), expires: expires}
+	return token, expires, nil
+}
+
+func (e *Enroller) dropExpired() {
+	now := time.Now()
+	for hash, token := range e.tokens {
+		if now.After(token.expires) {
+			delete(e.tokens, hash)
+		}
+	}
+}
+
+// redeem uses up a join token, as long as it allows the principal. If it doesn't, the token can still be used for a
+// principal that it does allow.
+func (e *Enroller) redeem(token string, principal string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.dropExpired()
+	hash := sha256.Sum256([]byte(token))
+	found, ok := e.tokens[hash]
+	if !ok {
+		return errors.New("invalid, expired, or already used join token")
+	}
+	for _, pattern := range found.patterns {
+		if matched, err := path.Match(pattern, principal); err == nil && matched {
+			delete(e.tokens, hash)
+			return nil
+		}
+	}
+	return fmt.Errorf("join token does not allow principal %q", principal)
+}
+
+// Enroll handles an enrollment request. remote_principal is the principal of the node, if it authenticated with a
+// certificate, or empty otherwise. A request with a join token may enroll any principal that the token allows, but a
+// request without one may only renew the certificate of the node that sent it. The principal that the returned
+// certificate is issued for is returned along with it.
+func (e *Enroller) Enroll(remote_principal string, req *common.EnrollRequest) (*common.EnrollResponse, string, error) {
+	if req.Version != common.FARADAY_PROTOCOL_VERSION {
+		return nil, "", fmt.Errorf("wrong faraday version: %d instead of %d", req.Version, common.FARADAY_PROTOCOL_VERSION)
+	}
+	csr, err := wraputil.LoadX509CSRFromPEM([]byte(req.CSR))
+	if err != nil {
+		return nil, "", fmt.Errorf("while parsing certificate request: %s", err.Error())
+	}
+	// checked before redeeming the token, so that a bad request doesn't use it up
+	if err := csr.CheckSignature(); err != nil {
+		return nil, "", fmt.Errorf("while checking certificate request: %s", err.Error())
+	}
+	principal := csr.Subject.CommonName
+	if principal == "" {
+		return nil, "", errors.New("certificate request has no common name")
+	}
+	// the certificate can authenticate servers, so a node may not claim any name besides its own, such as farad's
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, "", fmt.Errorf("certificate request asks for names other than %q", principal)
+	}
+	for _, name := range csr.DNSNames {
+		if name != principal {
+			return nil, "", fmt.Errorf("certificate request asks for names other than %q", principal)
+		}
+	}
+	if req.Token != "" {
+		if err := e.redeem(req.Token, principal); err != nil {
+			return nil, "", err
+		}
+	} else if remote_principal == "" {
+		return nil, "", errors.New("enrollment requires a join token or a certificate")
+	} else if principal != remote_principal {
+		return nil, "", fmt.Errorf("%q may not renew the certificate of %q without a join token", remote_principal, principal)
+	}
+	cert, err := e.authority.SignCSR(csr, e.validity)
+	if err != nil {
+		return nil, "", err
+	}
+	return &common.EnrollResponse{Chain: string(e.authority.Chain(cert))}, principal, nil
+}
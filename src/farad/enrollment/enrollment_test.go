@@ -0,0 +1,242 @@
+package enrollment
+
+import (
+	"authority"
+	"common"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+	"util/wraputil"
+)
+
+func tempEnroller(t *testing.T) (*Enroller, func()) {
+	dir, err := ioutil.TempDir("", "enrollment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := authority.Init(dir, "test-ca", "ecdsa", time.Hour*24)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return NewEnroller(ca, time.Hour), func() { os.RemoveAll(dir) }
+}
+
+func requestFor(t *testing.T, key crypto.Signer, token string, principal string) *common.EnrollRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: principal},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &common.EnrollRequest{
+		Version: common.FARADAY_PROTOCOL_VERSION,
+		Token:   token,
+		CSR:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	}
+}
+
+func csrWithNames(t *testing.T, key crypto.Signer, principal string, dns ...string) string {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: principal},
+		DNSNames: dns,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func checkIssued(t *testing.T, e *Enroller, response *common.EnrollResponse, key crypto.Signer, principal string) {
+	chain, err := wraputil.LoadX509ChainFromPEM([]byte(response.Chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || !chain[1].Equal(e.Authority().Cert) {
+		t.Error("wrong chain")
+	}
+	if chain[0].Subject.CommonName != principal || len(chain[0].DNSNames) != 1 || chain[0].DNSNames[0] != principal {
+		t.Errorf("wrong names: %q %v", chain[0].Subject.CommonName, chain[0].DNSNames)
+	}
+	if err := wraputil.CheckKeyMatchesCert(key, chain[0]); err != nil {
+		t.Error(err)
+	}
+	if chain[0].NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Error("certificate should be short-lived")
+	}
+}
+
+func TestEnroll_Token(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, expires, err := e.CreateToken([]string{"rack3-*", "spare"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.After(time.Now().Add(time.Minute)) {
+		t.Error("wrong expiration")
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	response, principal, err := e.Enroll("", requestFor(t, key, token, "rack3-node7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "rack3-node7" {
+		t.Errorf("wrong principal: %q", principal)
+	}
+	checkIssued(t, e, response, key, "rack3-node7")
+}
+
+func TestEnroll_OwnNameOnly(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"node-*"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	// asking for the principal as a DNS name is harmless
+	req := requestFor(t, key, token, "node-a")
+	req.CSR = csrWithNames(t, key, "node-a", "node-a")
+	response, principal, err := e.Enroll("", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "node-a" {
+		t.Errorf("wrong principal: %q", principal)
+	}
+	checkIssued(t, e, response, key, "node-a")
+}
+
+func TestEnroll_TokenUsedOnce(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"*"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	if _, _, err := e.Enroll("", requestFor(t, key, token, "node-a")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = e.Enroll("", requestFor(t, key, token, "node-b"))
+	testutil.CheckError(t, err, "invalid, expired, or already used join token")
+}
+
+func TestEnroll_TokenScope(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"rack3-*"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	_, _, err = e.Enroll("", requestFor(t, key, token, "rack4-node1"))
+	testutil.CheckError(t, err, "join token does not allow principal \"rack4-node1\"")
+	// a request that the token doesn't allow doesn't use it up
+	if _, _, err := e.Enroll("", requestFor(t, key, token, "rack3-node1")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnroll_TokenExpired(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"*"}, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	_, _, err = e.Enroll("", requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), token, "node-a"))
+	testutil.CheckError(t, err, "invalid, expired, or already used join token")
+}
+
+func TestEnroll_WrongToken(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	if _, _, err := e.CreateToken([]string{"*"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := e.Enroll("", requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "0123456789abcdef", "node-a"))
+	testutil.CheckError(t, err, "invalid, expired, or already used join token")
+}
+
+func TestEnroll_Renewal(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.Ed25519)
+	response, principal, err := e.Enroll("node-a", requestFor(t, key, "", "node-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "node-a" {
+		t.Errorf("wrong principal: %q", principal)
+	}
+	checkIssued(t, e, response, key, "node-a")
+}
+
+func TestEnroll_RenewalOfOtherPrincipal(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	_, _, err := e.Enroll("node-a", requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "", "node-b"))
+	testutil.CheckError(t, err, "\"node-a\" may not renew the certificate of \"node-b\" without a join token")
+}
+
+func TestEnroll_Unauthenticated(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	_, _, err := e.Enroll("", requestFor(t, testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA), "", "node-a"))
+	testutil.CheckError(t, err, "enrollment requires a join token or a certificate")
+}
+
+func TestEnroll_BadRequests(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"*"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+
+	req := requestFor(t, key, token, "node-a")
+	req.Version = 0
+	_, _, err = e.Enroll("", req)
+	testutil.CheckError(t, err, "wrong faraday version")
+
+	_, _, err = e.Enroll("", &common.EnrollRequest{Version: common.FARADAY_PROTOCOL_VERSION, Token: token, CSR: "garbage"})
+	testutil.CheckError(t, err, "while parsing certificate request")
+
+	_, _, err = e.Enroll("", requestFor(t, key, token, ""))
+	testutil.CheckError(t, err, "certificate request has no common name")
+
+	req = requestFor(t, key, token, "node-a")
+	req.CSR = csrWithNames(t, key, "node-a", "farad.example.com")
+	_, _, err = e.Enroll("", req)
+	testutil.CheckError(t, err, "asks for names other than \"node-a\"")
+
+	// none of these should have used up the token
+	if _, _, err := e.Enroll("", requestFor(t, key, token, "node-a")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateToken_Invalid(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	_, _, err := e.CreateToken(nil, time.Minute)
+	testutil.CheckError(t, err, "join token must allow at least one principal pattern")
+	_, _, err = e.CreateToken([]string{"rack[3"}, time.Minute)
+	testutil.CheckError(t, err, "invalid principal pattern \"rack[3\"")
+	_, _, err = e.CreateToken([]string{"*"}, 0)
+	testutil.CheckError(t, err, "join token lifetime must be positive")
+	_, _, err = e.CreateToken([]string{"*"}, MAX_TOKEN_LIFETIME+time.Second)
+	testutil.CheckError(t, err, "join token lifetime must be positive")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"common"
+	"farad/enrollment"
+	"fmt"
+	"os"
+	"os/user"
+	"remote"
+	"strconv"
+)
+
+// AuthorizeAdmin allows root, farad's own user, and (if admin_gid is not negative) members of the admin group to use
+// the admin socket, whether it is their primary group or a supplementary one.
+func AuthorizeAdmin(admin_gid int) func(creds remote.PeerCredentials) error {
+	return func(creds remote.PeerCredentials) error {
+		if remote.AllowOwnerAndRoot(creds) == nil {
+			return nil
+		}
+		if admin_gid >= 0 && (creds.GID == uint32(admin_gid) || inGroup(creds.UID, admin_gid)) {
+			return nil
+		}
+		return fmt.Errorf("unauthorized admin connection from %s", creds)
+	}
+}
+
+// inGroup checks whether a user is a supplementary member of a group, according to the user database, since the kernel
+// only reports the primary group of the process on the other end of a socket.
+func inGroup(uid uint32, gid int) bool {
+	account, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return false
+	}
+	groups, err := account.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, group := range groups {
+		if group == strconv.Itoa(gid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *State) HandleAdmin(server_id string, enroller *enrollment.Enroller) remote.AdminHandler {
+	return func(creds remote.PeerCredentials, parse func(interface{}) error) (interface{}, error) {
+		req := &common.AdminRequest{}
+		if err := parse(req); err != nil {
+			return nil, err
+		}
+		if req.Command == common.ADMIN_COMMAND_RELOAD {
+			// locks the state itself, once the CRLs have been read
+			if err := state.sweepRevocations(); err != nil {
+				return nil, fmt.Errorf("while reloading CRLs: %s", err.Error())
+			}
+		} else if req.Command == common.ADMIN_COMMAND_TOKEN {
+			// tokens are kept by the enroller, not the cluster state, so the state doesn't need to be locked
+			response := &common.AdminResponse{ServerInstance: server_id}
+			if err := createToken(enroller, req, response); err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		members := state.members.Snapshot()
+		_, _, now := state.hist.Since(0)
+		response := &common.AdminResponse{
+			ServerInstance: server_id,
+			Cursor:         now,
+			MemberCount:    len(members),
+		}
+		switch req.Command {
+		case common.ADMIN_COMMAND_STATUS, common.ADMIN_COMMAND_RELOAD:
+		case common.ADMIN_COMMAND_MEMBERS:
+			response.Members = members
+			response.Expirations = state.members.Expirations()
+		default:
+			return nil, fmt.Errorf("unknown admin command: %q", req.Command)
+		}
+		return response, nil
+	}
+}
+
+// StartAdmin serves the admin socket at the specified path. The returned stop function and exit channel are the same as
+// for remote.LocalContext.StartServe.
+func (state *State) StartAdmin(path string, admin_gid int, server_id string, enroller *enrollment.Enroller) (func() error, chan error, error) {
+	admin := remote.AdminContext{
+		Handler:   state.HandleAdmin(server_id, enroller),
+		Authorize: AuthorizeAdmin(admin_gid),
+		Codecs:    []remote.Codec{remote.JSONCodec, remote.GobCodec},
+		Timeout:   ADMIN_TIMEOUT,
+	}
+	stop, cherr, err := admin.StartServe(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func() error {
+		err := stop(SHUTDOWN_DEADLINE)
+		os.Remove(path)
+		return err
+	}, cherr, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"remote"
+	"strings"
+	"time"
+	"util/pkcs11util"
+	"util/secretutil"
+	"util/wraputil"
+)
+
+// A StringList is a command-line flag that may be specified more than once.
+type StringList []string
+
+func (list *StringList) String() string {
+	return strings.Join(*list, " ")
+}
+
+func (list *StringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// LoadCertificateBundle loads every certificate in a PEM file, which may hold more than one.
+func LoadCertificateBundle(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := wraputil.LoadX509CertsFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %s", path, err.Error())
+	}
+	return certs, nil
+}
+
+// LoadKeypairFiles loads farad's own certificate, and the RSA, ECDSA, or Ed25519 private key that goes with it. If the
+// key is encrypted, passphrase_spec says where to find its passphrase, as described by secretutil.ReadPassphrase. The
+// key path may instead be a PKCS#11 URI, as described by pkcs11util.ParseURI, in which case the key stays on the token.
+func LoadKeypairFiles(certpath string, keypath string, passphrase_spec string) (tls.Certificate, error) {
+	certdata, err := ioutil.ReadFile(certpath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if strings.HasPrefix(keypath, "pkcs11:") {
+		if passphrase_spec != "" {
+			return tls.Certificate{}, errors.New("keys on PKCS#11 tokens take a pin-source in their URI, not a passphrase")
+		}
+		return loadTokenKeypair(certpath, certdata, keypath)
+	}
+	keydata, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var passphrase []byte
+	if passphrase_spec != "" {
+		passphrase, err = secretutil.ReadPassphrase(passphrase_spec)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		defer secretutil.Wipe(passphrase)
+	}
+	keypair, err := wraputil.LoadEncryptedTLSKeypairFromPEM(certdata, keydata, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while loading %s and %s: %s", certpath, keypath, err.Error())
+	}
+	return keypair, nil
+}
+
+func loadTokenKeypair(certpath string, certdata []byte, uri string) (tls.Certificate, error) {
+	chain, err := wraputil.LoadX509ChainFromPEM(certdata)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while parsing %s: %s", certpath, err.Error())
+	}
+	config, err := pkcs11util.ParseURI(uri)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// the key is never closed, because it is used for as long as farad runs
+	key, err := pkcs11util.Open(config, chain[0].PublicKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while opening key for %s: %s", certpath, err.Error())
+	}
+	keypair := tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, cert := range chain {
+		keypair.Certificate = append(keypair.Certificate, cert.Raw)
+	}
+	return keypair, nil
+}
+
+func LoadIntermediates(paths []string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for _, path := range paths {
+		bundle, err := LoadCertificateBundle(path)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, bundle...)
+	}
+	return certs, nil
+}
+
+// LoadPrincipalConstraints parses constraints of the form <ca-path>=<pattern>[,<pattern>...]. If the CA file is a
+// bundle, such as the old and new certificates of a sub-CA that is being rolled, every CA in it is constrained.
+func LoadPrincipalConstraints(specs []string) ([]remote.PrincipalConstraint, error) {
+	constraints := []remote.PrincipalConstraint{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid constraint %q: expected <ca-path>=<pattern>[,<pattern>...]", spec)
+		}
+		authorities, err := LoadCertificateBundle(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, authority := range authorities {
+			constraints = append(constraints, remote.PrincipalConstraint{
+				Authority: authority,
+				Allowed:   strings.Split(parts[1], ","),
+			})
+		}
+	}
+	return constraints, nil
+}
+
+// A LeaseClass bounds the leases that nodes may ask for, by their principals, so that nodes on reliable networks can be
+// kept through short outages, while ephemeral ones are forgotten soon after they go away.
+type LeaseClass struct {
+	// in the syntax of path.Match
+	Pattern string
+	Min     time.Duration
+	Max     time.Duration
+}
+
+// LoadLeaseClasses parses lease classes of the form <pattern>=<min>,<max>.
+func LoadLeaseClasses(specs []string) ([]LeaseClass, error) {
+	classes := []LeaseClass{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid lease class %q: expected <pattern>=<min>,<max>", spec)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in lease class %q: %s", spec, err.Error())
+		}
+		bounds := strings.Split(parts[1], ",")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid lease class %q: expected <pattern>=<min>,<max>", spec)
+		}
+		min, err := time.ParseDuration(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("while parsing lease class %q: %s", spec, err.Error())
+		}
+		max, err := time.ParseDuration(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("while parsing lease class %q: %s", spec, err.Error())
+		}
+		if min <= 0 || max < min {
+			return nil, fmt.Errorf("invalid lease class %q: bounds must be positive, and in order", spec)
+		}
+		classes = append(classes, LeaseClass{Pattern: parts[0], Min: min, Max: max})
+	}
+	return classes, nil
+}
+
+// LoadSnapshotKey loads the private key with which farad signs snapshots of the cluster, which should not be the same
+// as its TLS key, so that nodes can trust snapshots without trusting anything else signed by farad. If the key is
+// encrypted, passphrase_spec says where to find its passphrase, as for LoadKeypairFiles.
+func LoadSnapshotKey(path string, passphrase_spec string) (crypto.Signer, error) {
+	keydata, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var passphrase []byte
+	if passphrase_spec != "" {
+		passphrase, err = secretutil.ReadPassphrase(passphrase_spec)
+		if err != nil {
+			return nil, err
+		}
+		defer secretutil.Wipe(passphrase)
+	}
+	key, err := wraputil.LoadEncryptedPrivateKeyFromPEM(keydata, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("while loading %s: %s", path, err.Error())
+	}
+	return key, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"authority"
+	"bytes"
+	"common"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"farad/enrollment"
+	"fmt"
+	"log"
+	"remote"
+	"time"
+	"util/secretutil"
+)
+
+// LoadEnroller opens the authority that issues certificates to enrolling nodes. Its key may be encrypted, with
+// passphrase_spec saying where to find the passphrase, as described by secretutil.ReadPassphrase. The authority must be
+// one of the CAs that farad trusts, or else nodes would be unable to use the certificates that it issues. If
+// pinned_key_oid is set, nodes may pin their WireGuard keys in their certificates by requesting that extension.
+func LoadEnroller(dir string, passphrase_spec string, validity time.Duration, trusted []*x509.Certificate, pinned_key_oid asn1.ObjectIdentifier) (*enrollment.Enroller, error) {
+	var passphrase []byte
+	if passphrase_spec != "" {
+		var err error
+		passphrase, err = secretutil.ReadPassphrase(passphrase_spec)
+		if err != nil {
+			return nil, err
+		}
+		defer secretutil.Wipe(passphrase)
+	}
+	ca, err := authority.Open(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ca.PinnedKeyOID = pinned_key_oid
+	for _, cert := range trusted {
+		if bytes.Equal(cert.Raw, ca.Cert.Raw) {
+			return enrollment.NewEnroller(ca, validity), nil
+		}
+	}
+	return nil, fmt.Errorf("enrollment authority in %s is not one of the trusted CAs", dir)
+}
+
+func (state *State) HandleEnroll(enroller *enrollment.Enroller) remote.EnrollHandler {
+	return func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		req := &common.EnrollRequest{}
+		if err := parse(req); err != nil {
+			return nil, err
+		}
+		if remote_cert != nil {
+			state.lock.Lock()
+			revoked := state.isRevoked(remote_cert)
+			state.lock.Unlock()
+			if revoked {
+				return nil, fmt.Errorf("certificate %x of %q has been revoked", remote_cert.SerialNumber, remote_principal)
+			}
+		}
+		response, principal, err := enroller.Enroll(remote_principal, req)
+		if err != nil {
+			return nil, err
+		}
+		if remote_principal == "" {
+			log.Println("Enrolled", principal, "with a join token")
+		} else {
+			log.Println("Issued a new certificate for", principal, "at the request of", remote_principal)
+		}
+		return response, nil
+	}
+}
+
+// createToken handles ADMIN_COMMAND_TOKEN.
+func createToken(enroller *enrollment.Enroller, req *common.AdminRequest, response *common.AdminResponse) error {
+	if enroller == nil {
+		return errors.New("enrollment is not enabled")
+	}
+	token, expires, err := enroller.CreateToken(req.TokenPatterns, req.TokenLifetime)
+	if err != nil {
+		return err
+	}
+	response.Token = token
+	response.TokenExpiration = expires
+	return nil
+}
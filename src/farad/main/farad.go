@@ -2,27 +2,177 @@ package main
 
 import (
 	"common"
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
+	"farad/enrollment"
 	"farad/history"
 	"farad/membership"
+	"farad/presharedkey"
+	"farad/revocation"
+	"farad/transparency"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path"
 	"remote"
 	"sync"
+	"syscall"
 	"time"
-	"util/timeutil"
-	"util/wraputil"
+	"util/secretutil"
+	"util/sockutil"
 )
 
+// 1836 is the year the faraday cage was invented
+const DEFAULT_BIND_ADDR = ":1836"
+
+// how long to wait for in-flight requests to finish when asked to shut down
+const SHUTDOWN_DEADLINE = time.Second * 5
+
+// local tools may take longer to read their results than nodes do
+const ADMIN_TIMEOUT = time.Second * 5
+
+// how often CRLs are reloaded, and members with revoked or expired certificates are evicted
+const REVOCATION_INTERVAL = time.Minute
+
+// the lease of nodes that don't ask for one, and of every node outside of the lease classes
+const DEFAULT_LEASE = time.Second * 2
+
+// long enough for every peer to hear about a node's new key, at least once, before the old one is forgotten
+const DEFAULT_KEY_ROTATION_OVERLAP = time.Second * 30
+
+// enrolled nodes renew their certificates well before they expire, so they can be short-lived
+const DEFAULT_ENROLL_VALIDITY = time.Hour * 24
+
 type State struct {
 	members *membership.MemberContext
 	hist    *history.History
-	lock    sync.Mutex
+	// nil if no CRLs were configured
+	revoked *revocation.List
+	// nil if there is no key transparency log
+	keylog *transparency.Log
+	// the signature of the current head of keylog, which only changes when an entry is appended
+	signed_head *common.SignedTreeHead
+	// nil if farad doesn't hand out preshared keys
+	presharedKeys *presharedkey.Deriver
+	lock          sync.Mutex
+}
+
+// isRevoked checks the certificate of a node against the CRLs. The state must be locked, so that the check is ordered
+// with sweepRevocations.
+func (state *State) isRevoked(cert *x509.Certificate) bool {
+	return state.revoked != nil && state.revoked.IsRevoked(cert.RawIssuer, cert.SerialNumber)
+}
+
+// grantLease clamps the lease that a node asked for, or DEFAULT_LEASE if it didn't ask, to the bounds of its class.
+func grantLease(classes []LeaseClass, principal string, requested time.Duration) time.Duration {
+	min, max := DEFAULT_LEASE, DEFAULT_LEASE
+	for _, class := range classes {
+		// patterns were checked when they were loaded
+		if matched, _ := path.Match(class.Pattern, principal); matched {
+			min, max = class.Min, class.Max
+			break
+		}
+	}
+	lease := requested
+	if lease == 0 {
+		lease = DEFAULT_LEASE
+	}
+	if lease < min {
+		lease = min
+	}
+	if lease > max {
+		lease = max
+	}
+	return lease
+}
+
+// departed lists each changed principal that is no longer in the cluster, once.
+func departed(changes []string, cluster map[string]string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, principal := range changes {
+		if _, found := cluster[principal]; !found && !seen[principal] {
+			seen[principal] = true
+			result = append(result, principal)
+		}
+	}
+	return result
+}
+
+// addPresharedKeys includes the preshared keys that a node shares with its peers in the response, for the current
+// epoch and the next one. If the node already has the keys of the current epoch, only the specified peers are
+// included, rather than every member of the cluster. The state must be locked.
+func (state *State) addPresharedKeys(response *common.FaradResponse, principal string, known_epoch uint64, peers []string) {
+	epoch := common.PresharedKeyEpoch(time.Now())
+	if known_epoch != epoch {
+		peers = nil
+		for peer := range state.members.Snapshot() {
+			peers = append(peers, peer)
+		}
+	}
+	response.PresharedKeyEpoch = epoch
+	response.PresharedKeys = state.presharedKeys.KeysFor(principal, peers, epoch)
+	response.NextPresharedKeys = state.presharedKeys.KeysFor(principal, peers, epoch+1)
+}
+
+// sweepRevocations reloads the CRLs, if there are any, and evicts members whose certificates have since been revoked or
+// have expired. If the CRLs can't be reloaded, the previous ones are still used, and the error is returned.
+func (state *State) sweepRevocations() error {
+	var err error
+	if state.revoked != nil {
+		err = state.revoked.Reload()
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.members.EvictRevoked(func(credential membership.Credential) bool {
+		return state.revoked != nil && state.revoked.IsRevoked(credential.RawIssuer, credential.Serial)
+	})
+	return err
+}
+
+// treeHead signs the current head of the key transparency log, unless it was already signed. The state must be locked.
+func (state *State) treeHead(key crypto.Signer) (*common.SignedTreeHead, error) {
+	if state.signed_head == nil {
+		head := state.keylog.Head()
+		signed, err := common.SignTreeHead(key, &head)
+		if err != nil {
+			return nil, err
+		}
+		state.signed_head = signed
+	}
+	return state.signed_head, nil
+}
+
+// proveKeys adds the key transparency tree head to a response, along with proofs that every key in the response was
+// logged, and that the log has only been appended to since the tree head that the node last saw. The state must be
+// locked.
+func (state *State) proveKeys(key crypto.Signer, tree_size uint64, response *common.FaradResponse) error {
+	head, err := state.treeHead(key)
+	if err != nil {
+		return err
+	}
+	response.TreeHead = head
+	if tree_size <= state.keylog.Size() {
+		response.Consistency, err = state.keylog.Consistency(tree_size)
+		if err != nil {
+			return err
+		}
+	}
+	response.Inclusions = map[string]*common.KeyInclusion{}
+	for principal, key := range response.CurrentCluster {
+		inclusion := state.keylog.Inclusion(principal)
+		if inclusion != nil && inclusion.Binding.Key == key {
+			response.Inclusions[principal] = inclusion
+		}
+	}
+	return nil
 }
 
 func GenServerId() (string, error) {
@@ -34,11 +184,69 @@ func GenServerId() (string, error) {
 	return hex.EncodeToString(server_id), nil
 }
 
-func FaradMain(authority *x509.Certificate, cert tls.Certificate) error {
+// Config holds everything that FaradMain needs, as determined from the command line.
+type Config struct {
+	// every CA trusted to issue node certificates; more than one while a CA is being rolled
+	Authorities []*x509.Certificate
+	Cert        tls.Certificate
+	Listeners   []net.Listener
+	// how to find the principal of each node from its certificate
+	Principal remote.PrincipalExtractor
+	// sub-CAs that nodes might not send along with their certificates
+	Intermediates []*x509.Certificate
+	// limits on which principals each CA may issue
+	Constraints []remote.PrincipalConstraint
+	// the path of the admin socket, or empty if it should not be served
+	AdminPath string
+	// the group allowed to use the admin socket, besides root and farad's own user; negative if there is none
+	AdminGID int
+	// issues certificates to nodes that enroll through farad, or nil if enrollment is disabled
+	Enroller *enrollment.Enroller
+	// certificates that have been revoked, and must not be used by members; nil if there are no CRLs
+	Revoked *revocation.List
+	// the extension in which node certificates may pin their WireGuard keys, or nil if they can't
+	PinnedKeyOID asn1.ObjectIdentifier
+	// whether node certificates must pin their WireGuard keys
+	RequirePinnedKeys bool
+	// how long peers are still given a node's previous key after the node rotates to a new one
+	KeyRotationOverlap time.Duration
+	// derives the preshared keys of pairs of nodes, or nil if farad doesn't hand them out
+	PresharedKeys *presharedkey.Deriver
+	// bounds on the leases that nodes may ask for; the first class that matches a node applies, and nodes that match no
+	// class are always given DEFAULT_LEASE
+	Leases []LeaseClass
+	// signs a snapshot of the cluster into each response, or nil if responses aren't signed; also signs the heads of
+	// KeyLog
+	SnapshotKey crypto.Signer
+	// records every key announced by each principal, or nil if there is no key transparency log; while there is one,
+	// keys that members will rotate to aren't given to peers until the members switch to them
+	KeyLog *transparency.Log
+}
+
+func FaradMain(config Config) error {
 	state := State{
-		members: membership.NewMemberContext(time.Second * 2), // expire after two seconds without contact
+		members: membership.NewMemberContext(DEFAULT_LEASE, config.KeyRotationOverlap),
 		hist:    history.NewHistory(500),
+		revoked: config.Revoked,
+		keylog:  config.KeyLog,
+
+		presharedKeys: config.PresharedKeys,
+	}
+	if config.RequirePinnedKeys {
+		state.members.RequirePinnedKeys()
 	}
+	// both run with the state locked
+	state.members.OnEvict(func(eviction membership.Eviction) {
+		log.Printf("Evicted %s (certificate %x): %s", eviction.Principal, eviction.Serial, eviction.Reason)
+		// so that peers drop the member
+		state.hist.AddUpdate(eviction.Principal)
+	})
+	state.members.OnSettle(func(principal string) {
+		// so that peers stop accepting the previous key
+		state.hist.AddUpdate(principal)
+	})
+	stop_reaper := state.members.StartReaper(&state.lock)
+	defer stop_reaper()
 
 	server_id, err := GenServerId()
 	if err != nil {
@@ -46,12 +254,22 @@ func FaradMain(authority *x509.Certificate, cert tls.Certificate) error {
 	}
 
 	pool := x509.NewCertPool()
-	pool.AddCert(authority)
+	for _, authority := range config.Authorities {
+		pool.AddCert(authority)
+	}
 	server := remote.LocalContext{
-		RootCA:    pool,
+		// farad only ever receives requests, so the CA is only used for nodes' client certificates
+		ClientCA:  pool,
 		Timeout:   time.Millisecond * 100,
-		LocalCert: cert,
-		Handler: func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+		LocalCert: config.Cert,
+		Principal: config.Principal,
+		// nodes' certificates may be issued by sub-CAs of the CA, each of which may only issue some principals
+		Intermediates:        config.Intermediates,
+		PrincipalConstraints: config.Constraints,
+		Codecs:               []remote.Codec{remote.GobCodec, remote.JSONCodec},
+		// full snapshots are sent after a restart, and they can get large
+		CompressionThreshold: 4096,
+		Handler: func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 			req := &common.FaradRequest{}
 			if err := parse(req); err != nil {
 				return nil, err
@@ -63,9 +281,44 @@ func FaradMain(authority *x509.Certificate, cert tls.Certificate) error {
 				// this must be a new server (or the wrong server...?) -- so we should send everything
 				req.Cursor = 0
 			}
+			credential := membership.CredentialOf(remote_cert)
+			if config.PinnedKeyOID != nil {
+				pinned, err := common.PinnedKey(remote_cert.Extensions, config.PinnedKeyOID)
+				if err != nil {
+					return nil, err
+				}
+				credential.PinnedKey = pinned
+			}
 			state.lock.Lock()
 			defer state.lock.Unlock()
-			did_revision_occur, err := state.members.UpdatePing(remote_principal, req.Key)
+			// only checked with the state locked, so that a sweep can't evict the member between the check and the ping
+			if state.isRevoked(remote_cert) {
+				return nil, fmt.Errorf("certificate %x of %q has been revoked", remote_cert.SerialNumber, remote_principal)
+			}
+			if req.Leave {
+				// the departure is recorded in the history when the member is evicted
+				if _, err := state.members.Leave(remote_principal, req.Key); err != nil {
+					return nil, err
+				}
+				_, _, now := state.hist.Since(0)
+				return &common.FaradResponse{Cursor: now, ServerInstance: server_id}, nil
+			}
+			if state.keylog != nil {
+				// a key must be logged before anyone is told about it, so it is logged before the ping takes effect,
+				// and if logging fails, the node must try again
+				if err := state.members.CheckPing(remote_principal, req.Key, req.NextKey, credential); err != nil {
+					return nil, err
+				}
+				appended, err := state.keylog.Record(remote_principal, req.Key, credential.Serial)
+				if err != nil {
+					return nil, err
+				}
+				if appended {
+					state.signed_head = nil
+				}
+			}
+			lease := grantLease(config.Leases, remote_principal, req.Lease)
+			did_revision_occur, err := state.members.UpdatePingWithLease(remote_principal, req.Key, req.NextKey, credential, lease)
 			if err != nil {
 				return nil, err
 			}
@@ -76,44 +329,257 @@ func FaradMain(authority *x509.Certificate, cert tls.Certificate) error {
 			response := &common.FaradResponse{
 				Cursor:         now,
 				ServerInstance: server_id,
+				Lease:          lease,
 			}
+			// the changes since the cursor, or 0 if every member is included
+			since := req.Cursor
 			if has_all {
 				if req.IncludeMember != "" {
 					changes = append(changes, req.IncludeMember)
 				}
 				response.CurrentCluster = state.members.Subshot(changes)
+				response.Departed = departed(changes, response.CurrentCluster)
 			} else {
 				response.CurrentCluster = state.members.Snapshot()
+				since = 0
+			}
+			principals := make([]string, 0, len(response.CurrentCluster))
+			for principal := range response.CurrentCluster {
+				principals = append(principals, principal)
+			}
+			response.NextKeys, response.PreviousKeys = state.members.Rotations(principals)
+			if state.keylog != nil {
+				// next keys aren't logged until members switch to them, so they can't be proven, and peers must wait
+				response.NextKeys = map[string]string{}
+			}
+			if state.presharedKeys != nil {
+				state.addPresharedKeys(response, remote_principal, req.PresharedKeyEpoch, principals)
+			}
+			if config.SnapshotKey != nil {
+				response.Signed, err = common.SignSnapshot(config.SnapshotKey, &common.ClusterSnapshot{
+					ServerInstance: server_id,
+					Since:          since,
+					Cursor:         now,
+					Members:        response.CurrentCluster,
+					Departed:       response.Departed,
+					NextKeys:       response.NextKeys,
+					PreviousKeys:   response.PreviousKeys,
+					Timestamp:      time.Now(),
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			if state.keylog != nil {
+				if err := state.proveKeys(config.SnapshotKey, req.TreeSize, response); err != nil {
+					return nil, err
+				}
 			}
 			return response, nil
 		},
 	}
-	stop, cherr, err := server.StartServe(":1836")
-	defer stop()
+	if config.Enroller != nil {
+		server.Enroll = state.HandleEnroll(config.Enroller)
+	}
+	stop, cherr, err := server.ServeListeners(config.Listeners...)
 	if err != nil {
+		sockutil.CloseAll(config.Listeners)
 		return err
 	}
 
-	return <-cherr
+	// never delivers anything if there is no admin socket
+	var admin_cherr chan error
+	if config.AdminPath != "" {
+		var stop_admin func() error
+		stop_admin, admin_cherr, err = state.StartAdmin(config.AdminPath, config.AdminGID, server_id, config.Enroller)
+		if err != nil {
+			stop(SHUTDOWN_DEADLINE)
+			return fmt.Errorf("while starting admin socket: %s", err.Error())
+		}
+		defer stop_admin()
+	}
+
+	sweeper := time.NewTicker(REVOCATION_INTERVAL)
+	defer sweeper.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-sweeper.C:
+			if err := state.sweepRevocations(); err != nil {
+				log.Println("Could not reload CRLs, so continuing with the previous ones:", err)
+			}
+		case err := <-cherr:
+			return err
+		case err := <-admin_cherr:
+			stop(SHUTDOWN_DEADLINE)
+			return fmt.Errorf("admin socket failed: %v", err)
+		case sig := <-signals:
+			log.Println("Received", sig, "-- draining requests before shutting down")
+			if err := stop(SHUTDOWN_DEADLINE); err != nil {
+				return err
+			}
+			return <-cherr
+		}
+	}
 }
 
 func main() {
-	if len(os.Args) != 4 {
-		log.Fatalln("Usage: farad <ca-path> <cert-path> <key-path>")
+	admin_path := flag.String("admin-socket", "", "path of a unix socket for local administration (disabled if empty)")
+	admin_gid := flag.Int("admin-gid", -1, "group, besides root and farad's own user, allowed to use the admin socket")
+	passphrase_spec := flag.String("key-passphrase", "", "where to find the passphrase for an encrypted key: file:<path>, env:<variable> or credential:<systemd-credential>")
+	principal_spec := flag.String("principal", "cn", "where to find node principals in certificates: cn, dns, uri:<prefix> or oid:<oid>")
+	intermediate_paths := StringList{}
+	flag.Var(&intermediate_paths, "intermediate", "path of intermediate CA certificates for nodes, which may be a bundle (may be repeated)")
+	constraint_specs := StringList{}
+	flag.Var(&constraint_specs, "constrain", "<ca-path>=<pattern>[,<pattern>...]: only allow a CA to issue matching principals (may be repeated)")
+	crl_paths := StringList{}
+	flag.Var(&crl_paths, "crl", "path of a CRL from one of the CAs, which is reloaded every minute (may be repeated)")
+	lease_specs := StringList{}
+	flag.Var(&lease_specs, "lease-class", "<pattern>=<min>,<max>: bound the leases that nodes with matching principals may ask for; the first match applies, and other nodes are given "+DEFAULT_LEASE.String()+" (may be repeated)")
+	pin_key_oid := flag.String("pin-key-oid", "", "object identifier of the certificate extension in which nodes' WireGuard keys may be pinned (disabled if empty)")
+	require_pinned_keys := flag.Bool("require-pinned-keys", false, "only accept nodes whose certificates pin their WireGuard keys")
+	key_rotation_overlap := flag.Duration("key-rotation-overlap", DEFAULT_KEY_ROTATION_OVERLAP, "how long peers keep being given a node's previous WireGuard key after it rotates to a new one")
+	psk_secret_spec := flag.String("psk-secret", "", "where to find the secret from which preshared keys for pairs of nodes are derived, as for -key-passphrase (disabled if empty)")
+	snapshot_key_path := flag.String("snapshot-key", "", "path of a private key, separate from the TLS key, with which to sign snapshots of the cluster for nodes (disabled if empty)")
+	snapshot_passphrase_spec := flag.String("snapshot-key-passphrase", "", "where to find the passphrase for the snapshot key, as for -key-passphrase")
+	key_log_path := flag.String("key-log", "", "path of an append-only key transparency log of every key announced by each node (disabled if empty; requires -snapshot-key)")
+	enroll_dir := flag.String("enroll-ca", "", "directory of a faraday-ca authority that issues certificates to enrolling nodes (disabled if empty)")
+	enroll_passphrase_spec := flag.String("enroll-ca-passphrase", "", "where to find the passphrase for the enrollment authority's key, as for -key-passphrase")
+	enroll_validity := flag.Duration("enroll-validity", DEFAULT_ENROLL_VALIDITY, "how long certificates issued to enrolling nodes are valid")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: farad [<options>] <ca-path> <cert-path> <key-path | pkcs11-uri> [<bind-addr>...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	principal, err := remote.ParsePrincipalExtractor(*principal_spec)
+	if err != nil {
+		log.Fatalln("Invalid -principal:", err)
+	}
+	cas, err := LoadCertificateBundle(args[0])
+	if err != nil {
+		log.Fatalln("Could not load CA:", err)
+	}
+	intermediates, err := LoadIntermediates(intermediate_paths)
+	if err != nil {
+		log.Fatalln("Could not load intermediate CA:", err)
 	}
-	ca_data, err := ioutil.ReadFile(os.Args[1])
+	constraints, err := LoadPrincipalConstraints(constraint_specs)
 	if err != nil {
-		log.Fatalln("Could not read CA:", err)
+		log.Fatalln("Could not load principal constraints:", err)
 	}
-	ca, err := wraputil.LoadX509CertFromPEM(ca_data)
+	leases, err := LoadLeaseClasses(lease_specs)
 	if err != nil {
-		log.Fatalln("Could not parse CA:", err)
+		log.Fatalln("Could not load lease classes:", err)
+	}
+	var pinned_key_oid asn1.ObjectIdentifier
+	if *pin_key_oid != "" {
+		pinned_key_oid, err = remote.ParseObjectIdentifier(*pin_key_oid)
+		if err != nil {
+			log.Fatalln("Invalid -pin-key-oid:", err)
+		}
+	} else if *require_pinned_keys {
+		log.Fatalln("-require-pinned-keys needs -pin-key-oid")
+	}
+	if *key_rotation_overlap <= 0 {
+		log.Fatalln("-key-rotation-overlap must be positive")
 	}
-	tcert, err := tls.LoadX509KeyPair(os.Args[2], os.Args[3])
+	var revoked *revocation.List
+	if len(crl_paths) > 0 {
+		revoked, err = revocation.Load(crl_paths, append(append([]*x509.Certificate{}, cas...), intermediates...))
+		if err != nil {
+			log.Fatalln("Could not load CRLs:", err)
+		}
+	}
+	var preshared_keys *presharedkey.Deriver
+	if *psk_secret_spec != "" {
+		secret, err := secretutil.ReadPassphrase(*psk_secret_spec)
+		if err != nil {
+			log.Fatalln("Could not load preshared key secret:", err)
+		}
+		preshared_keys, err = presharedkey.NewDeriver(secret)
+		secretutil.Wipe(secret)
+		if err != nil {
+			log.Fatalln("Could not load preshared key secret:", err)
+		}
+	}
+	var enroller *enrollment.Enroller
+	if *enroll_dir != "" {
+		if *principal_spec != "cn" && *principal_spec != "dns" {
+			log.Fatalln("Enrollment requires -principal cn or dns, because that is where issued certificates put the principal")
+		}
+		enroller, err = LoadEnroller(*enroll_dir, *enroll_passphrase_spec, *enroll_validity, cas, pinned_key_oid)
+		if err != nil {
+			log.Fatalln("Could not load enrollment authority:", err)
+		}
+	}
+	var snapshot_key crypto.Signer
+	if *snapshot_key_path != "" {
+		snapshot_key, err = LoadSnapshotKey(*snapshot_key_path, *snapshot_passphrase_spec)
+		if err != nil {
+			log.Fatalln("Could not load snapshot key:", err)
+		}
+	}
+	var keylog *transparency.Log
+	if *key_log_path != "" {
+		if snapshot_key == nil {
+			log.Fatalln("-key-log needs -snapshot-key, with which to sign the heads of the log")
+		}
+		keylog, err = transparency.Open(*key_log_path)
+		if err != nil {
+			log.Fatalln("Could not open key transparency log:", err)
+		}
+		defer keylog.Close()
+	}
+	tcert, err := LoadKeypairFiles(args[1], args[2], *passphrase_spec)
 	if err != nil {
 		log.Fatalln("Could not load cert:", err)
 	}
-	err = FaradMain(ca, tcert)
+	listeners, err := sockutil.SystemdListeners()
+	if err != nil {
+		log.Fatalln("Could not use sockets from systemd:", err)
+	}
+	if len(listeners) == 0 {
+		addrs := args[3:]
+		if len(addrs) == 0 {
+			addrs = []string{DEFAULT_BIND_ADDR}
+		}
+		listeners, err = sockutil.ListenAll(addrs)
+		if err != nil {
+			log.Fatalln("Could not listen:", err)
+		}
+	} else if len(args) > 3 {
+		log.Println("Ignoring bind addresses, because sockets were passed by systemd")
+	}
+	err = FaradMain(Config{
+		Authorities:   cas,
+		Cert:          tcert,
+		Listeners:     listeners,
+		Principal:     principal,
+		Intermediates: intermediates,
+		Constraints:   constraints,
+		AdminPath:     *admin_path,
+		AdminGID:      *admin_gid,
+		Enroller:      enroller,
+		Revoked:       revoked,
+
+		PinnedKeyOID:      pinned_key_oid,
+		RequirePinnedKeys: *require_pinned_keys,
+
+		KeyRotationOverlap: *key_rotation_overlap,
+		PresharedKeys:      preshared_keys,
+		Leases:             leases,
+		SnapshotKey:        snapshot_key,
+		KeyLog:             keylog,
+	})
 	if err != nil {
 		log.Fatalln("farad failed:", err)
 	}
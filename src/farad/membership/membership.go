@@ -1,60 +1,390 @@
 package membership
 
 import (
+	"common"
+	"container/heap"
+	"crypto/x509"
 	"errors"
 	"farad/timerqueue"
+	"fmt"
+	"math/big"
+	"sync"
 	"time"
+	"util/timeutil"
 )
 
+// why members are removed from the cluster, as recorded in each Eviction
+const (
+	REASON_TIMEOUT      = "stopped pinging"
+	REASON_CERT_EXPIRED = "certificate expired"
+	REASON_REVOKED      = "certificate revoked"
+	REASON_LEFT         = "left the cluster"
+)
+
+// A Credential identifies the certificate that a member authenticated with, which limits how long it may stay a member.
+type Credential struct {
+	RawIssuer []byte
+	Serial    *big.Int
+	NotAfter  time.Time
+	// the only key that the member may use, if its certificate pins one, as found by common.PinnedKey
+	PinnedKey string
+}
+
+func CredentialOf(cert *x509.Certificate) Credential {
+	return Credential{RawIssuer: cert.RawIssuer, Serial: cert.SerialNumber, NotAfter: cert.NotAfter}
+}
+
+// An Eviction records a member being removed from the cluster, and why.
+type Eviction struct {
+	Principal string
+	// of the certificate that the member last authenticated with
+	Serial *big.Int
+	Reason string
+	At     time.Time
+}
+
+type member struct {
+	key string
+	// the key that the member has announced it will rotate to, if any
+	next_key string
+	// the key that the member rotated away from, if its overlap period has not yet ended
+	previous_key string
+	credential   Credential
+}
+
+// keys lists every key reserved by the member.
+func (mem member) keys() []string {
+	keys := []string{}
+	for _, key := range []string{mem.key, mem.next_key, mem.previous_key} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// certExpiration is an entry in certExpirations. It is only current if the member still has a certificate that
+// expires at the same time.
+type certExpiration struct {
+	not_after time.Time
+	principal string
+}
+
+// certExpirations is a container/heap of certificate expirations, soonest first.
+type certExpirations []certExpiration
+
+func (h certExpirations) Len() int            { return len(h) }
+func (h certExpirations) Less(i, j int) bool  { return h[i].not_after.Before(h[j].not_after) }
+func (h certExpirations) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *certExpirations) Push(x interface{}) { *h = append(*h, x.(certExpiration)) }
+func (h *certExpirations) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
 // MemberContext IS UNSYNCHRONIZED
 type MemberContext struct {
-	member_keys map[string]string
-	tq          *timerqueue.TimerQueue
+	members map[string]member
+	// map of public keys -> the principal using each one, including keys being rotated to and from, so that no two
+	// members can claim the same key
+	key_owners       map[string]string
+	expiration_time  time.Duration // the lease of members that don't ask for their own
+	tq               *timerqueue.TimerQueue
+	cert_expirations certExpirations
+	// tracks when the overlap period of each rotation ends
+	rotations           *timerqueue.TimerQueue
+	on_evict            []func(Eviction)
+	on_settle           []func(string)
+	require_pinned_keys bool
+	clock               timeutil.Clock
+	// set while a reaper is running, to tell it about a new deadline
+	wake_reaper func(deadline time.Time)
 }
 
-func NewMemberContext(expiration_time time.Duration) *MemberContext {
+// NewMemberContext creates a MemberContext in which members expire after expiration_time without pinging, and in which
+// a key that a member has rotated away from is still distributed for rotation_overlap, so that peers can move to the
+// new key before they stop accepting the old one.
+func NewMemberContext(expiration_time time.Duration, rotation_overlap time.Duration) *MemberContext {
+	return NewMemberContextWithClock(expiration_time, rotation_overlap, timeutil.RealClock)
+}
+
+// NewMemberContextWithClock is like NewMemberContext, except that time is measured by 'clock', including when checking
+// whether certificates have expired.
+func NewMemberContextWithClock(expiration_time time.Duration, rotation_overlap time.Duration, clock timeutil.Clock) *MemberContext {
 	return &MemberContext{
-		member_keys: map[string]string{},
-		tq:          timerqueue.NewTimerQueue(expiration_time),
+		members:         map[string]member{},
+		key_owners:      map[string]string{},
+		expiration_time: expiration_time,
+		tq:              timerqueue.NewTimerQueueWithClock(expiration_time, clock),
+		rotations:       timerqueue.NewTimerQueueWithClock(rotation_overlap, clock),
+		clock:           clock,
 	}
 }
 
-// UpdatePing(...) returns did_revision_occur
-func (m *MemberContext) UpdatePing(principal string, key string) (bool, error) {
+// OnEvict registers a callback to be run whenever a member is removed from the cluster, such as to record the eviction.
+// Callbacks run while the MemberContext is in use, so whatever lock guards it is held, and they must not use the
+// MemberContext themselves.
+func (m *MemberContext) OnEvict(callback func(eviction Eviction)) {
+	m.on_evict = append(m.on_evict, callback)
+}
+
+// OnSettle registers a callback to be run whenever the rotation overlap period of a member ends, so that peers can be
+// told to stop accepting its previous key. Callbacks run under the same conditions as for OnEvict.
+func (m *MemberContext) OnSettle(callback func(principal string)) {
+	m.on_settle = append(m.on_settle, callback)
+}
+
+// RequirePinnedKeys makes UpdatePing reject members whose certificates do not pin their keys. Otherwise, members may
+// use any key, unless their certificates pin one.
+func (m *MemberContext) RequirePinnedKeys() {
+	m.require_pinned_keys = true
+}
+
+// UpdatePing(...) returns did_revision_occur. The member is kept until it stops pinging, or until its certificate
+// expires, whichever is sooner. A key is refused if another member is already using it, or if it is not the key pinned
+// by the member's certificate.
+//
+// To rotate its key without losing connectivity, a member announces the key it will rotate to as next_key, in every
+// ping until it switches to it. Peers are told about both keys, so that they can accept the new key before the member
+// starts using it. Once the member switches, its old key is still distributed until the overlap period ends, for peers
+// that haven't caught up yet. Keys pinned by certificates can't be announced in advance: they are rotated by renewing
+// the certificate.
+func (m *MemberContext) UpdatePing(principal string, key string, next_key string, credential Credential) (bool, error) {
+	return m.UpdatePingWithLease(principal, key, next_key, credential, m.expiration_time)
+}
+
+// CheckPing returns the error that UpdatePing would, without changing anything, so that a ping can be recorded
+// elsewhere before it takes effect.
+func (m *MemberContext) CheckPing(principal string, key string, next_key string, credential Credential) error {
+	_, err := m.checkPing(principal, key, next_key, credential)
+	return err
+}
+
+// checkPing validates a ping, and returns the next key that it announces, which is empty if it is the current key.
+func (m *MemberContext) checkPing(principal string, key string, next_key string, credential Credential) (string, error) {
 	if principal == "" {
-		return false, errors.New("should not be an empty principal")
+		return "", errors.New("should not be an empty principal")
 	}
 	if key == "" {
-		return false, errors.New("should not be an empty key")
+		return "", errors.New("should not be an empty key")
 	}
-	old_key := m.member_keys[principal]
-	revision := false
-	if old_key == "" || old_key != key {
-		m.member_keys[principal] = key
-		revision = true
+	// keys are compared as strings, so they must be in the one form that each key has
+	if err := common.ValidateWireGuardKey(key); err != nil {
+		return "", err
 	}
-	// to track when this should expire
+	if next_key != "" {
+		if err := common.ValidateWireGuardKey(next_key); err != nil {
+			return "", err
+		}
+	}
+	if !m.clock.Now().Before(credential.NotAfter) {
+		return "", fmt.Errorf("certificate of %q has expired", principal)
+	}
+	if credential.PinnedKey != "" && key != credential.PinnedKey {
+		return "", fmt.Errorf("key of %q does not match the key pinned by its certificate", principal)
+	} else if credential.PinnedKey == "" && m.require_pinned_keys {
+		return "", fmt.Errorf("certificate of %q does not pin its key", principal)
+	}
+	if next_key == key {
+		next_key = ""
+	}
+	if next_key != "" && credential.PinnedKey != "" {
+		return "", fmt.Errorf("key of %q is pinned by its certificate, so it can only be rotated by renewing it", principal)
+	}
+	for _, claimed := range []string{key, next_key} {
+		if owner, used := m.holderOf(claimed); claimed != "" && used && owner != principal {
+			return "", fmt.Errorf("key of %q is already in use by %q", principal, owner)
+		}
+	}
+	return next_key, nil
+}
+
+// holderOf returns the member that holds a key. Members that have expired, and rotations that have finished, are
+// ignored even if they haven't been scanned for yet, so that their keys are free to be claimed.
+func (m *MemberContext) holderOf(key string) (string, bool) {
+	owner, used := m.key_owners[key]
+	if !used {
+		return "", false
+	}
+	now := m.clock.Now()
+	mem := m.members[owner]
+	if deadline, found := m.tq.Deadline(owner); found && now.After(deadline) {
+		return "", false
+	}
+	if !now.Before(mem.credential.NotAfter) {
+		return "", false
+	}
+	if key == mem.previous_key {
+		if deadline, found := m.rotations.Deadline(owner); found && now.After(deadline) {
+			return "", false
+		}
+	}
+	return owner, true
+}
+
+// UpdatePingWithLease is like UpdatePing, except that the member is kept until 'lease' passes without another ping,
+// rather than the expiration time that the MemberContext was created with. Each ping replaces the previous lease.
+func (m *MemberContext) UpdatePingWithLease(principal string, key string, next_key string, credential Credential, lease time.Duration) (bool, error) {
+	if lease <= 0 {
+		return false, errors.New("should not be a lease of zero or less")
+	}
+	// so that members that have expired release their keys before anyone else claims them
 	m.scanExpirations()
-	m.tq.Add(principal)
+	next_key, err := m.checkPing(principal, key, next_key, credential)
+	if err != nil {
+		return false, err
+	}
+	old, found := m.members[principal]
+	revision := !found || old.key != key || old.next_key != next_key
+	updated := member{key: key, next_key: next_key, previous_key: old.previous_key, credential: credential}
+	if found && old.key != key {
+		updated.previous_key = old.key
+		m.rotations.Add(principal)
+		m.notifyReaper(m.rotations.Deadline(principal))
+	}
+	if updated.previous_key == key || updated.previous_key == next_key {
+		// rotating back to a key that was only just left
+		updated.previous_key = ""
+	}
+	for _, released := range old.keys() {
+		delete(m.key_owners, released)
+	}
+	for _, claimed := range updated.keys() {
+		m.key_owners[claimed] = principal
+	}
+	m.members[principal] = updated
+	if !found || !old.credential.NotAfter.Equal(credential.NotAfter) {
+		heap.Push(&m.cert_expirations, certExpiration{not_after: credential.NotAfter, principal: principal})
+		m.notifyReaper(credential.NotAfter, true)
+	}
+	// to track when this should expire
+	m.tq.AddWithDelay(principal, lease)
+	m.notifyReaper(m.tq.Deadline(principal))
 	return revision, nil
 }
 
+func (m *MemberContext) evict(principal string, reason string) {
+	eviction := Eviction{
+		Principal: principal,
+		Serial:    m.members[principal].credential.Serial,
+		Reason:    reason,
+		At:        m.clock.Now(),
+	}
+	for _, released := range m.members[principal].keys() {
+		delete(m.key_owners, released)
+	}
+	delete(m.members, principal)
+	for _, callback := range m.on_evict {
+		callback(eviction)
+	}
+}
+
 func (m *MemberContext) scanExpirations() {
 	for {
 		found, elem := m.tq.Query()
 		if !found {
 			break
 		}
-		delete(m.member_keys, elem)
+		if _, present := m.members[elem]; present {
+			m.evict(elem, REASON_TIMEOUT)
+		}
+	}
+	for {
+		found, elem := m.rotations.Query()
+		if !found {
+			break
+		}
+		if mem, present := m.members[elem]; present && mem.previous_key != "" {
+			delete(m.key_owners, mem.previous_key)
+			mem.previous_key = ""
+			m.members[elem] = mem
+			for _, callback := range m.on_settle {
+				callback(elem)
+			}
+		}
+	}
+	now := m.clock.Now()
+	for len(m.cert_expirations) > 0 && !now.Before(m.cert_expirations[0].not_after) {
+		expired := heap.Pop(&m.cert_expirations).(certExpiration)
+		current, present := m.members[expired.principal]
+		if present && current.credential.NotAfter.Equal(expired.not_after) {
+			m.evict(expired.principal, REASON_CERT_EXPIRED)
+		}
+	}
+}
+
+// EvictRevoked removes every member whose certificate is revoked, according to the revoked function, along with any
+// members that have expired.
+func (m *MemberContext) EvictRevoked(revoked func(credential Credential) bool) {
+	m.scanExpirations()
+	for principal, mem := range m.members {
+		if revoked(mem.credential) {
+			m.evict(principal, REASON_REVOKED)
+		}
+	}
+}
+
+// Leave removes a member that is shutting down, so that peers can drop it without waiting for it to stop pinging. It
+// returns whether the member was removed, which it isn't if it had already gone. The key must be the member's current
+// key, so that a member that has since been replaced, such as by a new instance of the same node, isn't removed.
+func (m *MemberContext) Leave(principal string, key string) (bool, error) {
+	m.scanExpirations()
+	mem, found := m.members[principal]
+	if !found {
+		return false, nil
+	}
+	if mem.key != key {
+		return false, fmt.Errorf("%q is no longer using key %q", principal, key)
+	}
+	m.evict(principal, REASON_LEFT)
+	return true, nil
+}
+
+// Rotations returns the keys that the specified members are rotating to, and the keys that they have recently rotated
+// away from, as maps of principals -> public keys. Members that aren't rotating are left out.
+func (m *MemberContext) Rotations(subset []string) (map[string]string, map[string]string) {
+	m.scanExpirations()
+	next, previous := map[string]string{}, map[string]string{}
+	for _, principal := range subset {
+		mem, present := m.members[principal]
+		if !present {
+			continue
+		}
+		if mem.next_key != "" {
+			next[principal] = mem.next_key
+		}
+		if mem.previous_key != "" {
+			previous[principal] = mem.previous_key
+		}
 	}
+	return next, previous
 }
 
 // Snapshot returns a map of principals -> public keys.
 func (m *MemberContext) Snapshot() map[string]string {
 	m.scanExpirations()
 	result := map[string]string{}
-	for principal, mem := range m.member_keys {
-		result[principal] = mem
+	for principal, mem := range m.members {
+		result[principal] = mem.key
+	}
+	return result
+}
+
+// Expirations returns a map of principals -> when they will expire, unless they ping again first. Pinging will not keep
+// a member past the expiration of its certificate.
+func (m *MemberContext) Expirations() map[string]time.Time {
+	m.scanExpirations()
+	result := map[string]time.Time{}
+	for principal, mem := range m.members {
+		expires, found := m.tq.Deadline(principal)
+		if found {
+			if mem.credential.NotAfter.Before(expires) {
+				expires = mem.credential.NotAfter
+			}
+			result[principal] = expires
+		}
 	}
 	return result
 }
@@ -63,11 +393,95 @@ func (m *MemberContext) Subshot(subset []string) map[string]string {
 	m.scanExpirations()
 	result := map[string]string{}
 	for _, principal := range subset {
-		found := m.member_keys[principal]
-		if found == "" {
+		found, present := m.members[principal]
+		if !present {
 			continue
 		}
-		result[principal] = found
+		result[principal] = found.key
 	}
 	return result
 }
+
+// nextDeadline returns the soonest time at which a member might expire, or a rotation might settle. It may be earlier
+// than necessary, if a certificate has since been replaced.
+func (m *MemberContext) nextDeadline() (time.Time, bool) {
+	next, found := m.tq.Next()
+	if rotation, ok := m.rotations.Next(); ok && (!found || rotation.Before(next)) {
+		next, found = rotation, true
+	}
+	if len(m.cert_expirations) > 0 && (!found || m.cert_expirations[0].not_after.Before(next)) {
+		next, found = m.cert_expirations[0].not_after, true
+	}
+	return next, found
+}
+
+func (m *MemberContext) notifyReaper(deadline time.Time, found bool) {
+	if found && m.wake_reaper != nil {
+		m.wake_reaper(deadline)
+	}
+}
+
+// StartReaper expires members in the background as soon as they are due, rather than only when the MemberContext is
+// next used, so that OnEvict and OnSettle callbacks run promptly even if nobody is talking to farad. 'lock' must be the
+// lock that guards the MemberContext, and is held while the reaper expires members. The returned function stops the
+// reaper, and must be called without holding the lock.
+func (m *MemberContext) StartReaper(lock sync.Locker) func() {
+	wake := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	// guarded by the lock
+	waiting, waiting_until := false, time.Time{}
+
+	lock.Lock()
+	m.wake_reaper = func(deadline time.Time) {
+		if !waiting || deadline.Before(waiting_until) {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	lock.Unlock()
+
+	go func() {
+		defer close(done)
+		for {
+			lock.Lock()
+			m.scanExpirations()
+			waiting_until, waiting = m.nextDeadline()
+			now := m.clock.Now()
+			lock.Unlock()
+
+			// never fires, if there is nothing to wait for
+			var fired <-chan time.Time
+			var timer timeutil.Timer
+			if waiting {
+				// members only expire once their deadlines have passed
+				timer = m.clock.NewTimer(waiting_until.Sub(now) + time.Nanosecond)
+				fired = timer.C()
+			}
+			stopping := false
+			select {
+			case <-fired:
+			case <-wake:
+			case <-stop:
+				stopping = true
+			}
+			// so that the timer doesn't linger when the reaper is woken up early
+			if timer != nil {
+				timer.Stop()
+			}
+			if stopping {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		lock.Lock()
+		m.wake_reaper = nil
+		lock.Unlock()
+	}
+}
@@ -1,7 +1,621 @@
 package membership
 
-import "testing"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+	"util/testutil"
+	"util/timeutil"
+)
 
-func TestMissing(t *testing.T) {
-	t.Errorf("no tests implemented for farad.membership")
+// when the fake clock of each test starts
+var testStart = time.Date(2017, 8, 6, 3, 38, 38, 0, time.UTC)
+
+func fakeMemberContext(expiration_time time.Duration, rotation_overlap time.Duration) (*MemberContext, *timeutil.FakeClock) {
+	clock := timeutil.NewFakeClock(testStart)
+	return NewMemberContextWithClock(expiration_time, rotation_overlap, clock), clock
+}
+
+// testKey returns a WireGuard key that stands for 'name'.
+func testKey(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// credentialFor returns a credential that expires 'lifetime' after the start of the test.
+func credentialFor(serial int64, lifetime time.Duration) Credential {
+	return Credential{RawIssuer: []byte("test-ca"), Serial: big.NewInt(serial), NotAfter: testStart.Add(lifetime)}
+}
+
+// recorder collects the events of a MemberContext, which may arrive from a reaper.
+type recorder struct {
+	lock      sync.Mutex
+	evictions []Eviction
+	settled   []string
+}
+
+func recordEvents(m *MemberContext) *recorder {
+	r := &recorder{}
+	m.OnEvict(func(eviction Eviction) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.evictions = append(r.evictions, eviction)
+	})
+	m.OnSettle(func(principal string) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.settled = append(r.settled, principal)
+	})
+	return r
+}
+
+func (r *recorder) takeEvictions() []Eviction {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	evictions := r.evictions
+	r.evictions = nil
+	return evictions
+}
+
+func (r *recorder) takeSettled() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	settled := r.settled
+	r.settled = nil
+	return settled
+}
+
+func checkEvictions(t *testing.T, r *recorder, principals []string, reason string) {
+	evictions := r.takeEvictions()
+	if len(evictions) != len(principals) {
+		t.Fatalf("wrong number of evictions: %v", evictions)
+	}
+	for i, eviction := range evictions {
+		if eviction.Principal != principals[i] || eviction.Reason != reason {
+			t.Errorf("wrong eviction: %+v", eviction)
+		}
+	}
+}
+
+func TestUpdatePing(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	revision, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("joining should be a revision")
+	}
+	revision, err = m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(2, time.Hour*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision {
+		t.Error("a new certificate alone should not be a revision")
+	}
+	revision, err = m.UpdatePing("node-a", testKey("key-b"), "", credentialFor(2, time.Hour*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("a new key should be a revision")
+	}
+	snapshot := m.Snapshot()
+	if len(snapshot) != 1 || snapshot["node-a"] != testKey("key-b") {
+		t.Errorf("wrong snapshot: %v", snapshot)
+	}
+}
+
+func TestUpdatePing_Invalid(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	_, err := m.UpdatePing("", testKey("key-a"), "", credentialFor(1, time.Hour))
+	testutil.CheckError(t, err, "should not be an empty principal")
+	_, err = m.UpdatePing("node-a", "", "", credentialFor(1, time.Hour))
+	testutil.CheckError(t, err, "should not be an empty key")
+	_, err = m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, -time.Second))
+	testutil.CheckError(t, err, "certificate of \"node-a\" has expired")
+	_, err = m.UpdatePing("node-a", "key-a", "", credentialFor(1, time.Hour))
+	testutil.CheckError(t, err, "invalid WireGuard key \"key-a\"")
+	_, err = m.UpdatePing("node-a", testKey("key-a"), "key-a2", credentialFor(1, time.Hour))
+	testutil.CheckError(t, err, "invalid WireGuard key \"key-a2\"")
+	if len(m.Snapshot()) != 0 {
+		t.Error("should not have joined")
+	}
+}
+
+func TestExpiration_Timeout(t *testing.T) {
+	m, clock := fakeMemberContext(time.Millisecond*20, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// pinging again pushes back the deadline
+	clock.Advance(time.Millisecond * 15)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 20)
+	if len(m.Snapshot()) != 1 {
+		t.Error("should not expire until its deadline has passed")
+	}
+	clock.Advance(time.Nanosecond)
+	if len(m.Snapshot()) != 0 {
+		t.Error("should have expired")
+	}
+	evictions := events.takeEvictions()
+	if len(evictions) != 1 || evictions[0].Reason != REASON_TIMEOUT || !evictions[0].At.Equal(clock.Now()) {
+		t.Errorf("wrong evictions: %+v", evictions)
+	}
+	if len(events.takeEvictions()) != 0 {
+		t.Error("evictions should only be taken once")
+	}
+}
+
+func TestExpiration_Lease(t *testing.T) {
+	m, clock := fakeMemberContext(time.Millisecond*20, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePingWithLease("node-a", testKey("key-a"), "", credentialFor(1, time.Hour), time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdatePing("node-b", testKey("key-b"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 30)
+	if _, found := m.Snapshot()["node-a"]; !found {
+		t.Error("node-a should be kept for its longer lease")
+	}
+	checkEvictions(t, events, []string{"node-b"}, REASON_TIMEOUT)
+	// a later ping can ask for a shorter lease
+	if _, err := m.UpdatePingWithLease("node-a", testKey("key-a"), "", credentialFor(1, time.Hour), time.Millisecond*5); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 10)
+	if len(m.Snapshot()) != 0 {
+		t.Error("node-a should have expired")
+	}
+	checkEvictions(t, events, []string{"node-a"}, REASON_TIMEOUT)
+
+	_, err := m.UpdatePingWithLease("node-a", testKey("key-a"), "", credentialFor(1, time.Hour), 0)
+	testutil.CheckError(t, err, "lease of zero")
+}
+
+func TestExpiration_Rejoin(t *testing.T) {
+	m, clock := fakeMemberContext(time.Millisecond*20, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 30)
+	revision, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("rejoining should be a revision")
+	}
+	if m.Snapshot()["node-a"] != testKey("key-a") {
+		t.Error("should have rejoined")
+	}
+	checkEvictions(t, events, []string{"node-a"}, REASON_TIMEOUT)
+}
+
+func TestExpiration_Certificate(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Millisecond*20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdatePing("node-b", testKey("key-b"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	expirations := m.Expirations()
+	if !expirations["node-a"].Equal(testStart.Add(time.Millisecond*20)) || !expirations["node-b"].Equal(testStart.Add(time.Minute)) {
+		t.Errorf("wrong expirations: %v", expirations)
+	}
+	clock.Advance(time.Millisecond * 30)
+	snapshot := m.Snapshot()
+	if len(snapshot) != 1 || snapshot["node-b"] != testKey("key-b") {
+		t.Errorf("wrong snapshot: %v", snapshot)
+	}
+	evictions := events.takeEvictions()
+	if len(evictions) != 1 || evictions[0].Serial.Int64() != 1 || evictions[0].Reason != REASON_CERT_EXPIRED {
+		t.Errorf("wrong evictions: %+v", evictions)
+	}
+}
+
+func TestExpiration_RenewedCertificate(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Millisecond*20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 30)
+	if len(m.Snapshot()) != 1 {
+		t.Error("the old certificate should no longer limit the member")
+	}
+	checkEvictions(t, events, nil, "")
+}
+
+func TestEvictRevoked(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	for i, principal := range []string{"node-a", "node-b", "node-c"} {
+		if _, err := m.UpdatePing(principal, testKey("key-"+principal), "", credentialFor(int64(i), time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.EvictRevoked(func(credential Credential) bool {
+		return string(credential.RawIssuer) == "test-ca" && credential.Serial.Int64() == 1
+	})
+	snapshot := m.Snapshot()
+	if len(snapshot) != 2 || snapshot["node-b"] != "" {
+		t.Errorf("wrong snapshot: %v", snapshot)
+	}
+	checkEvictions(t, events, []string{"node-b"}, REASON_REVOKED)
+}
+
+func TestLeave(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a1"), testKey("key-a2"), credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.Leave("node-a", testKey("key-a2"))
+	testutil.CheckError(t, err, "no longer using key")
+	checkEvictions(t, events, nil, "")
+
+	left, err := m.Leave("node-a", testKey("key-a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !left || len(m.Snapshot()) != 0 {
+		t.Error("node-a should have left")
+	}
+	checkEvictions(t, events, []string{"node-a"}, REASON_LEFT)
+	// both keys are free again
+	if _, err := m.UpdatePing("node-b", testKey("key-a2"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+
+	left, err = m.Leave("node-a", testKey("key-a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left {
+		t.Error("node-a should not leave twice")
+	}
+	checkEvictions(t, events, nil, "")
+}
+
+func TestSubshot(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	for _, principal := range []string{"node-a", "node-b", "node-c"} {
+		if _, err := m.UpdatePing(principal, testKey("key-"+principal), "", credentialFor(1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subshot := m.Subshot([]string{"node-a", "node-c", "node-d"})
+	if len(subshot) != 2 || subshot["node-a"] != testKey("key-node-a") || subshot["node-c"] != testKey("key-node-c") {
+		t.Errorf("wrong subshot: %v", subshot)
+	}
+}
+
+func TestUniqueKeys(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Millisecond*20)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.UpdatePing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour))
+	testutil.CheckError(t, err, "key of \"node-b\" is already in use by \"node-a\"")
+	if _, ok := m.Snapshot()["node-b"]; ok {
+		t.Error("should not have joined")
+	}
+	// once node-a moves to a new key, and the overlap period ends, its old one is free
+	if _, err := m.UpdatePing("node-a", testKey("key-a2"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 30)
+	if _, err := m.UpdatePing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+	_, err = m.UpdatePing("node-c", testKey("key-a2"), "", credentialFor(3, time.Hour))
+	testutil.CheckError(t, err, "already in use by \"node-a\"")
+}
+
+func TestCheckPing(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	if err := m.CheckPing("node-a", testKey("key-a"), testKey("key-a2"), credentialFor(1, time.Hour)); err != nil {
+		t.Error(err)
+	}
+	if len(m.Snapshot()) != 0 {
+		t.Error("checking a ping should not change anything")
+	}
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	err := m.CheckPing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour))
+	testutil.CheckError(t, err, "already in use by \"node-a\"")
+	err = m.CheckPing("", testKey("key-b"), "", credentialFor(2, time.Hour))
+	testutil.CheckError(t, err, "empty principal")
+}
+
+func TestCheckPing_AfterExpiry(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute + time.Second)
+	// node-a has expired, so its key is free, but it has not been evicted yet
+	if err := m.CheckPing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+	events.lock.Lock()
+	evicted := len(events.evictions)
+	events.lock.Unlock()
+	if evicted != 0 {
+		t.Error("checking a ping should not evict anyone")
+	}
+	if _, err := m.UpdatePing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := m.Snapshot(); len(snapshot) != 1 || snapshot["node-b"] != testKey("key-a") {
+		t.Errorf("expected only node-b, not %v", snapshot)
+	}
+}
+
+func TestUniqueKeys_OtherSpellings(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	key := testKey("key-a")
+	if _, err := m.UpdatePing("node-a", key, "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// both decode to the same key as node-a's
+	for _, spelling := range []string{key[:10] + "\n" + key[10:], key + "\r\n"} {
+		_, err := m.UpdatePing("node-b", spelling, "", credentialFor(2, time.Hour))
+		testutil.CheckError(t, err, "invalid WireGuard key")
+		_, err = m.UpdatePing("node-b", testKey("key-b"), spelling, credentialFor(2, time.Hour))
+		testutil.CheckError(t, err, "invalid WireGuard key")
+	}
+}
+
+func TestUniqueKeys_AfterEviction(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	m.EvictRevoked(func(credential Credential) bool { return true })
+	if _, err := m.UpdatePing("node-b", testKey("key-a"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinnedKey(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	pinned := credentialFor(1, time.Hour)
+	pinned.PinnedKey = testKey("key-a")
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", pinned); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.UpdatePing("node-a", testKey("key-b"), "", pinned)
+	testutil.CheckError(t, err, "key of \"node-a\" does not match the key pinned by its certificate")
+	if m.Snapshot()["node-a"] != testKey("key-a") {
+		t.Error("key should not have changed")
+	}
+	// without pinning, any key is fine, unless pinning is required
+	if _, err := m.UpdatePing("node-b", testKey("key-b"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+	m.RequirePinnedKeys()
+	_, err = m.UpdatePing("node-c", testKey("key-c"), "", credentialFor(3, time.Hour))
+	testutil.CheckError(t, err, "certificate of \"node-c\" does not pin its key")
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", pinned); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Millisecond*20)
+	events := recordEvents(m)
+	if _, err := m.UpdatePing("node-a", testKey("key-a1"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	revision, err := m.UpdatePing("node-a", testKey("key-a1"), testKey("key-a2"), credentialFor(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("announcing a next key should be a revision")
+	}
+	next, previous := m.Rotations([]string{"node-a"})
+	if len(next) != 1 || next["node-a"] != testKey("key-a2") || len(previous) != 0 {
+		t.Errorf("wrong rotations: %v %v", next, previous)
+	}
+	// the next key is reserved, even before it is used
+	_, err = m.UpdatePing("node-b", testKey("key-a2"), "", credentialFor(2, time.Hour))
+	testutil.CheckError(t, err, "already in use by \"node-a\"")
+
+	revision, err = m.UpdatePing("node-a", testKey("key-a2"), "", credentialFor(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("switching keys should be a revision")
+	}
+	if m.Snapshot()["node-a"] != testKey("key-a2") {
+		t.Error("should have switched keys")
+	}
+	next, previous = m.Rotations([]string{"node-a"})
+	if len(next) != 0 || len(previous) != 1 || previous["node-a"] != testKey("key-a1") {
+		t.Errorf("wrong rotations: %v %v", next, previous)
+	}
+	_, err = m.UpdatePing("node-b", testKey("key-a1"), "", credentialFor(2, time.Hour))
+	testutil.CheckError(t, err, "already in use by \"node-a\"")
+	if len(events.takeSettled()) != 0 {
+		t.Error("should not have settled yet")
+	}
+
+	clock.Advance(time.Millisecond * 30)
+	next, previous = m.Rotations([]string{"node-a"})
+	if len(next) != 0 || len(previous) != 0 {
+		t.Errorf("wrong rotations: %v %v", next, previous)
+	}
+	settled := events.takeSettled()
+	if len(settled) != 1 || settled[0] != "node-a" {
+		t.Errorf("wrong settled members: %v", settled)
+	}
+	// once the overlap period ends, the old key is free
+	if _, err := m.UpdatePing("node-b", testKey("key-a1"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotation_Cancelled(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	if _, err := m.UpdatePing("node-a", testKey("key-a1"), testKey("key-a2"), credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	revision, err := m.UpdatePing("node-a", testKey("key-a1"), "", credentialFor(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision {
+		t.Error("withdrawing a next key should be a revision")
+	}
+	if next, _ := m.Rotations([]string{"node-a"}); len(next) != 0 {
+		t.Errorf("wrong next keys: %v", next)
+	}
+	if _, err := m.UpdatePing("node-b", testKey("key-a2"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotation_Invalid(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	if _, err := m.UpdatePing("node-b", testKey("key-b"), "", credentialFor(2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.UpdatePing("node-a", testKey("key-a"), testKey("key-b"), credentialFor(1, time.Hour))
+	testutil.CheckError(t, err, "key of \"node-a\" is already in use by \"node-b\"")
+	pinned := credentialFor(1, time.Hour)
+	pinned.PinnedKey = testKey("key-a")
+	_, err = m.UpdatePing("node-a", testKey("key-a"), testKey("key-a2"), pinned)
+	testutil.CheckError(t, err, "can only be rotated by renewing it")
+	if _, ok := m.Snapshot()["node-a"]; ok {
+		t.Error("should not have joined")
+	}
+}
+
+func TestRotation_Eviction(t *testing.T) {
+	m, _ := fakeMemberContext(time.Minute, time.Minute)
+	if _, err := m.UpdatePing("node-a", testKey("key-a1"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdatePing("node-a", testKey("key-a2"), testKey("key-a3"), credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	m.EvictRevoked(func(credential Credential) bool { return true })
+	// every key that the member held is released
+	for i, key := range []string{testKey("key-a1"), testKey("key-a2"), testKey("key-a3")} {
+		if _, err := m.UpdatePing(key, key, "", credentialFor(int64(i+2), time.Hour)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// waitForEvictions waits for a reaper to evict 'count' members.
+func waitForEvictions(t *testing.T, r *recorder, count int) []Eviction {
+	var evictions []Eviction
+	for attempt := 0; len(evictions) < count; attempt++ {
+		if attempt == 1000 {
+			t.Fatalf("reaper only evicted %v", evictions)
+		}
+		time.Sleep(time.Millisecond)
+		evictions = append(evictions, r.takeEvictions()...)
+	}
+	return evictions
+}
+
+func TestReaper(t *testing.T) {
+	m, clock := fakeMemberContext(time.Millisecond*20, time.Minute)
+	events := recordEvents(m)
+	lock := &sync.Mutex{}
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	stop := m.StartReaper(lock)
+	defer stop()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 30)
+	// without anyone else using the MemberContext
+	evictions := waitForEvictions(t, events, 1)
+	if len(evictions) != 1 || evictions[0].Principal != "node-a" || evictions[0].Reason != REASON_TIMEOUT {
+		t.Errorf("wrong evictions: %+v", evictions)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(m.Snapshot()) != 0 {
+		t.Errorf("node-a should have been removed: %v", m.Snapshot())
+	}
+}
+
+func TestReaper_EarlierDeadline(t *testing.T) {
+	m, clock := fakeMemberContext(time.Minute, time.Minute)
+	events := recordEvents(m)
+	lock := &sync.Mutex{}
+	stop := m.StartReaper(lock)
+	defer stop()
+
+	lock.Lock()
+	_, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(1)
+
+	// the reaper is waiting for node-a to time out, but node-b's certificate expires sooner
+	lock.Lock()
+	_, err = m.UpdatePing("node-b", testKey("key-b"), "", credentialFor(2, time.Millisecond*20))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// once woken up, the reaper stops its timer for node-a and waits for node-b instead, so it never has more than one
+	// timer; if the clock moves before it gets to that, the scan after waking up evicts node-b straight away
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 30)
+	evictions := waitForEvictions(t, events, 1)
+	if len(evictions) != 1 || evictions[0].Principal != "node-b" || evictions[0].Reason != REASON_CERT_EXPIRED {
+		t.Errorf("wrong evictions: %+v", evictions)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if _, found := m.Snapshot()["node-a"]; !found {
+		t.Error("node-a should not have been evicted")
+	}
+}
+
+func TestReaper_Stop(t *testing.T) {
+	m, clock := fakeMemberContext(time.Millisecond*20, time.Minute)
+	events := recordEvents(m)
+	lock := &sync.Mutex{}
+	stop := m.StartReaper(lock)
+	stop()
+
+	if _, err := m.UpdatePing("node-a", testKey("key-a"), "", credentialFor(1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond * 30)
+	time.Sleep(time.Millisecond * 10)
+	if evictions := events.takeEvictions(); len(evictions) != 0 {
+		t.Errorf("stopped reaper should not evict anyone: %+v", evictions)
+	}
 }
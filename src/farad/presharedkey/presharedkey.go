@@ -0,0 +1,58 @@
+package presharedkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// the shortest secret that preshared keys may be derived from, so that they are no weaker than the keys themselves
+const MIN_SECRET_LENGTH = 32
+
+// A Deriver derives the WireGuard preshared key of every pair of nodes from a single secret, so that farad can hand
+// them out without having to store them. The key of a pair changes every epoch, as defined by common.PresharedKeyEpoch.
+type Deriver struct {
+	secret []byte
+}
+
+func NewDeriver(secret []byte) (*Deriver, error) {
+	if len(secret) < MIN_SECRET_LENGTH {
+		return nil, fmt.Errorf("preshared key secret is too short: %d bytes instead of at least %d", len(secret), MIN_SECRET_LENGTH)
+	}
+	return &Deriver{secret: append([]byte{}, secret...)}, nil
+}
+
+// Derive computes the preshared key shared by two nodes for an epoch, in the form used by wg(8). The order of the
+// principals doesn't matter, so both nodes of a pair are given the same key.
+func (d *Deriver) Derive(principal_a string, principal_b string, epoch uint64) string {
+	if principal_b < principal_a {
+		principal_a, principal_b = principal_b, principal_a
+	}
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte("faraday preshared key\x00"))
+	for _, principal := range []string{principal_a, principal_b} {
+		// length-prefixed, so that no two pairs of principals are encoded the same way
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(principal)))
+		mac.Write(length)
+		mac.Write([]byte(principal))
+	}
+	encoded_epoch := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded_epoch, epoch)
+	mac.Write(encoded_epoch)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// KeysFor computes the preshared keys that a node shares with each of its peers for an epoch, as a map of the
+// principals of the peers to the keys. The node itself is skipped, if it is listed among the peers.
+func (d *Deriver) KeysFor(principal string, peers []string, epoch uint64) map[string]string {
+	keys := map[string]string{}
+	for _, peer := range peers {
+		if peer != principal {
+			keys[peer] = d.Derive(principal, peer, epoch)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,58 @@
+package presharedkey
+
+import (
+	"bytes"
+	"common"
+	"testing"
+	"util/testutil"
+)
+
+func testDeriver(t *testing.T, fill byte) *Deriver {
+	deriver, err := NewDeriver(bytes.Repeat([]byte{fill}, MIN_SECRET_LENGTH))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deriver
+}
+
+func TestNewDeriver_ShortSecret(t *testing.T) {
+	_, err := NewDeriver(make([]byte, MIN_SECRET_LENGTH-1))
+	testutil.CheckError(t, err, "too short")
+}
+
+func TestDerive(t *testing.T) {
+	deriver := testDeriver(t, 1)
+	key := deriver.Derive("node-a", "node-b", 7)
+	if err := common.ValidateWireGuardKey(key); err != nil {
+		t.Errorf("not usable as a wireguard key: %v", err)
+	}
+	if deriver.Derive("node-b", "node-a", 7) != key {
+		t.Error("both nodes of a pair should get the same key")
+	}
+	if deriver.Derive("node-a", "node-b", 8) == key {
+		t.Error("keys should change every epoch")
+	}
+	if deriver.Derive("node-a", "node-c", 7) == key {
+		t.Error("each pair should get its own key")
+	}
+	if testDeriver(t, 2).Derive("node-a", "node-b", 7) == key {
+		t.Error("keys should depend on the secret")
+	}
+	if deriver.Derive("ab", "c", 7) == deriver.Derive("a", "bc", 7) {
+		t.Error("principals should not run together")
+	}
+}
+
+func TestKeysFor(t *testing.T) {
+	deriver := testDeriver(t, 1)
+	keys := deriver.KeysFor("node-a", []string{"node-a", "node-b", "node-c"}, 7)
+	if len(keys) != 2 {
+		t.Fatalf("expected keys for two peers, not %d", len(keys))
+	}
+	if _, found := keys["node-a"]; found {
+		t.Error("a node should not get a key for itself")
+	}
+	if keys["node-b"] != deriver.KeysFor("node-b", []string{"node-a"}, 7)["node-a"] {
+		t.Error("both nodes of a pair should get the same key")
+	}
+}
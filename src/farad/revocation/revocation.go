@@ -0,0 +1,115 @@
+// Package revocation tracks which node certificates have been revoked, according to CRLs issued by the trusted
+// authorities, such as those generated by faraday-ca.
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+	"util/wraputil"
+)
+
+// A List holds the certificates revoked by a set of CRL files, which can be reloaded as they are reissued. It is safe
+// to use from multiple goroutines.
+type List struct {
+	paths       []string
+	authorities []*x509.Certificate
+	lock        sync.Mutex
+	// keyed by revokedKey
+	revoked map[string]bool
+}
+
+func revokedKey(raw_issuer []byte, serial *big.Int) string {
+	return string(raw_issuer) + "/" + serial.Text(16)
+}
+
+// Load reads every CRL at the specified paths, each of which may be in PEM or DER form. Each CRL must be signed by one
+// of the authorities, and must not have passed its next update time.
+func Load(paths []string, authorities []*x509.Certificate) (*List, error) {
+	list := &List{paths: paths, authorities: authorities}
+	if err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Reload reads the CRL files again. If any of them can't be loaded, the list is left as it was.
+func (list *List) Reload() error {
+	revoked := map[string]bool{}
+	for _, path := range list.paths {
+		crls, err := loadCRLFile(path)
+		if err != nil {
+			return fmt.Errorf("while loading CRL %s: %s", path, err.Error())
+		}
+		for _, crl := range crls {
+			issuer, err := list.issuerOf(crl)
+			if err != nil {
+				return fmt.Errorf("while loading CRL %s: %s", path, err.Error())
+			}
+			for _, entry := range crl.TBSCertList.RevokedCertificates {
+				revoked[revokedKey(issuer.RawSubject, entry.SerialNumber)] = true
+			}
+		}
+	}
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.revoked = revoked
+	return nil
+}
+
+func loadCRLFile(path string) ([]*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*pkix.CertificateList{crl}, nil
+	}
+	blocks, err := wraputil.LoadPEMBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	crls := []*pkix.CertificateList{}
+	for i, block := range blocks {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("found PEM block %d of type \"%s\" instead of X509 CRL", i, block.Type)
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing CRL %d: %s", i, err.Error())
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// issuerOf finds the authority that signed a CRL, and makes sure that the CRL is still current.
+func (list *List) issuerOf(crl *pkix.CertificateList) (*x509.Certificate, error) {
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL expired at %v", crl.TBSCertList.NextUpdate)
+	}
+	for _, authority := range list.authorities {
+		if authority.CheckCRLSignature(crl) == nil {
+			return authority, nil
+		}
+	}
+	return nil, errors.New("CRL was not signed by a trusted authority")
+}
+
+// IsRevoked checks whether the certificate with the specified serial number, issued by the authority with the specified
+// subject, has been revoked.
+func (list *List) IsRevoked(raw_issuer []byte, serial *big.Int) bool {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	return list.revoked[revokedKey(raw_issuer, serial)]
+}
@@ -0,0 +1,170 @@
+package revocation
+
+import (
+	"authority"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+func tempAuthority(t *testing.T, dir string, name string) *authority.Authority {
+	ca, err := authority.Init(filepath.Join(dir, name), name, "ecdsa", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func issue(t *testing.T, ca *authority.Authority, principal string) *x509.Certificate {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: principal}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.SignCSR(csr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeCRL(t *testing.T, ca *authority.Authority, path string, validity time.Duration) {
+	crl, err := ca.CRL(validity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, crl, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := tempAuthority(t, dir, "ca")
+	other := tempAuthority(t, dir, "other")
+	revoked, kept := issue(t, ca, "node-a"), issue(t, ca, "node-b")
+	if err := ca.Revoke(revoked.SerialNumber.Text(16)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.crl")
+	writeCRL(t, ca, path, time.Hour)
+
+	list, err := Load([]string{path}, []*x509.Certificate{other.Cert, ca.Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.IsRevoked(revoked.RawIssuer, revoked.SerialNumber) {
+		t.Error("should have been revoked")
+	}
+	if list.IsRevoked(kept.RawIssuer, kept.SerialNumber) {
+		t.Error("should not have been revoked")
+	}
+	// the same serial number from a different authority is a different certificate
+	if list.IsRevoked(other.Cert.RawSubject, revoked.SerialNumber) {
+		t.Error("should only be revoked for its own issuer")
+	}
+
+	if err := ca.Revoke(kept.SerialNumber.Text(16)); err != nil {
+		t.Fatal(err)
+	}
+	writeCRL(t, ca, path, time.Hour)
+	if err := list.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !list.IsRevoked(kept.RawIssuer, kept.SerialNumber) {
+		t.Error("should have been revoked after reloading")
+	}
+}
+
+func TestList_DER(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := tempAuthority(t, dir, "ca")
+	cert := issue(t, ca, "node-a")
+	if err := ca.Revoke(cert.SerialNumber.Text(16)); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := ca.CRL(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crl)
+	path := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(path, block.Bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Load([]string{path}, []*x509.Certificate{ca.Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.IsRevoked(cert.RawIssuer, cert.SerialNumber) {
+		t.Error("should have been revoked")
+	}
+}
+
+func TestList_Untrusted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := tempAuthority(t, dir, "ca")
+	other := tempAuthority(t, dir, "other")
+	path := filepath.Join(dir, "ca.crl")
+	writeCRL(t, ca, path, time.Hour)
+	_, err = Load([]string{path}, []*x509.Certificate{other.Cert})
+	testutil.CheckError(t, err, "CRL was not signed by a trusted authority")
+}
+
+func TestList_Expired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := tempAuthority(t, dir, "ca")
+	path := filepath.Join(dir, "ca.crl")
+	writeCRL(t, ca, path, time.Hour)
+	list, err := Load([]string{path}, []*x509.Certificate{ca.Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCRL(t, ca, path, -time.Second)
+	testutil.CheckError(t, list.Reload(), "CRL expired at")
+}
+
+func TestList_Malformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := tempAuthority(t, dir, "ca")
+	path := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(path, ca.Bundle(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load([]string{path}, []*x509.Certificate{ca.Cert})
+	testutil.CheckError(t, err, "found PEM block 0 of type \"CERTIFICATE\" instead of X509 CRL")
+	_, err = Load([]string{filepath.Join(dir, "missing.crl")}, []*x509.Certificate{ca.Cert})
+	testutil.CheckError(t, err, "while loading CRL")
+}
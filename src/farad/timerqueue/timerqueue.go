@@ -1,51 +1,131 @@
 package timerqueue
 
-import "time"
+import (
+	"container/heap"
+	"time"
+	"util/timeutil"
+)
 
 type timerElem struct {
 	expires time.Time
-	entry   string
+	// breaks ties between entries that expire at the same time, so that they expire in the order they were added
+	seq   uint64
+	entry string
+	// position in the heap, kept up to date so that an entry can be moved when it is added again
+	index int
 }
 
+// timerHeap is a container/heap of entries, soonest expiration first.
+type timerHeap []*timerElem
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].expires.Equal(h[j].expires) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].expires.Before(h[j].expires)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *timerHeap) Push(x interface{}) {
+	elem := x.(*timerElem)
+	elem.index = len(*h)
+	*h = append(*h, elem)
+}
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return last
+}
+
+// A TimerQueue tracks when each entry expires, a delay after it was last added. It holds one element per live
+// entry, however often entries are added again, and adding or expiring an entry takes O(log n) time.
+//
+// TimerQueue IS UNSYNCHRONIZED
 type TimerQueue struct {
-	delay time.Duration
-	// these should monotonically increase; time glitches are ignored because time.Time objects have a monotonic component
-	queue  []timerElem
-	endmap map[string]time.Time // allows us to figure out if this is the most recent instance of an element
+	delay   time.Duration
+	clock   timeutil.Clock
+	heap    timerHeap
+	entries map[string]*timerElem
+	next    uint64
 }
 
 func NewTimerQueue(delay time.Duration) *TimerQueue {
+	return NewTimerQueueWithClock(delay, timeutil.RealClock)
+}
+
+// NewTimerQueueWithClock is like NewTimerQueue, except that time is measured by 'clock'.
+func NewTimerQueueWithClock(delay time.Duration, clock timeutil.Clock) *TimerQueue {
 	if delay <= 0 {
 		panic("timerqueues must have a positive delay")
 	}
-	return &TimerQueue{delay, []timerElem{}, map[string]time.Time{}}
+	return &TimerQueue{delay: delay, clock: clock, entries: map[string]*timerElem{}}
 }
 
+// Add starts tracking an entry, or pushes back its expiration if it is already being tracked.
 func (t *TimerQueue) Add(entry string) {
 	if t.delay <= 0 {
 		panic("timerqueues must have been created by NewTimerQueue!")
 	}
-	expire_at := time.Now().Add(t.delay)
-	t.queue = append(t.queue, timerElem{
-		expires: expire_at,
-		entry:   entry,
-	})
-	t.endmap[entry] = expire_at
+	t.AddWithDelay(entry, t.delay)
 }
 
+// AddWithDelay is like Add, except that the entry expires 'delay' from now, rather than after the delay of the queue.
+// Entries with different delays may be mixed freely.
+func (t *TimerQueue) AddWithDelay(entry string, delay time.Duration) {
+	if delay <= 0 {
+		panic("entries must have a positive delay")
+	}
+	expire_at := t.clock.Now().Add(delay)
+	t.next++
+	if elem, found := t.entries[entry]; found {
+		elem.expires = expire_at
+		elem.seq = t.next
+		heap.Fix(&t.heap, elem.index)
+		return
+	}
+	elem := &timerElem{expires: expire_at, seq: t.next, entry: entry}
+	heap.Push(&t.heap, elem)
+	t.entries[entry] = elem
+}
+
+// Query removes and returns an entry whose expiration has passed, if there is one, soonest expiration first.
 func (t *TimerQueue) Query() (bool, string) {
 	if t.delay <= 0 {
 		panic("timerqueues must have been created by NewTimerQueue!")
 	}
-	for len(t.queue) > 0 && time.Now().After(t.queue[0].expires) {
-		entry := t.queue[0]
-		t.queue = t.queue[1:]
-		// this time comparison is okay because it's the *EXACT SAME* time object
-		if entry.expires == t.endmap[entry.entry] {
-			delete(t.endmap, entry.entry)
-			return true, entry.entry
-		}
-		// otherwise try again
-	}
-	return false, ""
+	if len(t.heap) == 0 || !t.clock.Now().After(t.heap[0].expires) {
+		return false, ""
+	}
+	elem := heap.Pop(&t.heap).(*timerElem)
+	delete(t.entries, elem.entry)
+	return true, elem.entry
+}
+
+// Deadline returns when the entry will expire, unless it is added again first.
+func (t *TimerQueue) Deadline(entry string) (time.Time, bool) {
+	elem, found := t.entries[entry]
+	if !found {
+		return time.Time{}, false
+	}
+	return elem.expires, true
+}
+
+// Len returns how many entries are being tracked.
+func (t *TimerQueue) Len() int {
+	return len(t.heap)
+}
+
+// Next returns the soonest deadline of any entry, if there are any. Query will return that entry once the deadline has
+// passed.
+func (t *TimerQueue) Next() (time.Time, bool) {
+	if len(t.heap) == 0 {
+		return time.Time{}, false
+	}
+	return t.heap[0].expires, true
 }
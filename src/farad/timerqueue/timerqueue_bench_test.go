@@ -0,0 +1,93 @@
+package timerqueue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"util/timeutil"
+)
+
+// sliceTimerQueue is the previous implementation of TimerQueue, kept to compare against. It appends an element every
+// time an entry is added, and only drops superseded elements once they reach the front of the queue.
+type sliceTimerQueue struct {
+	delay  time.Duration
+	clock  timeutil.Clock
+	queue  []timerElem
+	endmap map[string]time.Time
+}
+
+func (t *sliceTimerQueue) Add(entry string) {
+	expire_at := t.clock.Now().Add(t.delay)
+	t.queue = append(t.queue, timerElem{expires: expire_at, entry: entry})
+	t.endmap[entry] = expire_at
+}
+
+func (t *sliceTimerQueue) Query() (bool, string) {
+	now := t.clock.Now()
+	for len(t.queue) > 0 && now.After(t.queue[0].expires) {
+		entry := t.queue[0]
+		t.queue = t.queue[1:]
+		if entry.expires == t.endmap[entry.entry] {
+			delete(t.endmap, entry.entry)
+			return true, entry.entry
+		}
+	}
+	return false, ""
+}
+
+type queue interface {
+	Add(entry string)
+	Query() (bool, string)
+}
+
+// benchmarkHeartbeats simulates 'nodes' members pinging every 'period', under a much longer expiration, as farad sees
+// them, and reports how many elements the queue holds at the end.
+func benchmarkHeartbeats(b *testing.B, nodes int, create func(delay time.Duration, clock timeutil.Clock) (queue, func() int)) {
+	const period = time.Millisecond * 300
+	clock := timeutil.NewFakeClock(time.Date(2017, 8, 6, 3, 38, 38, 0, time.UTC))
+	tq, length := create(time.Minute, clock)
+	names := make([]string, nodes)
+	for i := range names {
+		names[i] = fmt.Sprintf("node-%d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tq.Add(names[i%nodes])
+		// everyone pings once per period
+		clock.Advance(period / time.Duration(nodes))
+		tq.Query()
+	}
+	b.ReportMetric(float64(length()), "elems")
+}
+
+func BenchmarkHeartbeats(b *testing.B) {
+	for _, nodes := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("heap/%d", nodes), func(b *testing.B) {
+			benchmarkHeartbeats(b, nodes, func(delay time.Duration, clock timeutil.Clock) (queue, func() int) {
+				tq := NewTimerQueueWithClock(delay, clock)
+				return tq, tq.Len
+			})
+		})
+		b.Run(fmt.Sprintf("slice/%d", nodes), func(b *testing.B) {
+			benchmarkHeartbeats(b, nodes, func(delay time.Duration, clock timeutil.Clock) (queue, func() int) {
+				tq := &sliceTimerQueue{delay: delay, clock: clock, endmap: map[string]time.Time{}}
+				return tq, func() int { return len(tq.queue) }
+			})
+		})
+	}
+}
+
+// BenchmarkExpiry measures adding entries that are never refreshed, and expiring them all.
+func BenchmarkExpiry(b *testing.B) {
+	clock := timeutil.NewFakeClock(time.Date(2017, 8, 6, 3, 38, 38, 0, time.UTC))
+	tq := NewTimerQueueWithClock(time.Second, clock)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tq.Add(fmt.Sprintf("node-%d", i))
+	}
+	clock.Advance(time.Second * 2)
+	for found, _ := tq.Query(); found; found, _ = tq.Query() {
+	}
+}
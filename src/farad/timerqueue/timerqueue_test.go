@@ -4,8 +4,14 @@ import (
 	"fmt"
 	"testing"
 	"time"
+	"util/timeutil"
 )
 
+func fakeTimerQueue(delay time.Duration) (*TimerQueue, *timeutil.FakeClock) {
+	clock := timeutil.NewFakeClock(time.Date(2017, 8, 6, 3, 38, 38, 0, time.UTC))
+	return NewTimerQueueWithClock(delay, clock), clock
+}
+
 func TestNewTimerQueue(t *testing.T) {
 	tq := NewTimerQueue(time.Second * 2)
 	if tq.delay != time.Second*2 {
@@ -14,20 +20,19 @@ func TestNewTimerQueue(t *testing.T) {
 }
 
 func TestTimerQueue_Add(t *testing.T) {
-	tq := NewTimerQueue(time.Second)
+	tq, clock := fakeTimerQueue(time.Second)
 	for i := 0; i < 10; i++ {
-		before := time.Now()
 		tq.Add(fmt.Sprintf("entry-%d", i))
-		after := time.Now()
-		original := tq.queue[len(tq.queue)-1].expires.Add(-time.Second)
-		if original.Before(before) || original.After(after) {
-			t.Errorf("time out of range")
+		if deadline, _ := tq.Deadline(fmt.Sprintf("entry-%d", i)); !deadline.Equal(clock.Now().Add(time.Second)) {
+			t.Errorf("wrong expiration time")
 		}
-		if len(tq.queue) != i+1 {
+		clock.Advance(time.Millisecond)
+		if tq.Len() != i+1 {
 			t.Errorf("wrong length of queue")
 		}
-		for qi, qv := range tq.queue {
-			if qv.entry != fmt.Sprintf("entry-%d", qi) {
+		// entries added in order of expiration stay in order in the heap
+		for qi, qv := range tq.heap {
+			if qv.entry != fmt.Sprintf("entry-%d", qi) || qv.index != qi {
 				t.Errorf("wrong element")
 			}
 		}
@@ -35,21 +40,22 @@ func TestTimerQueue_Add(t *testing.T) {
 }
 
 func TestTimerQueue_Query_Simple(t *testing.T) {
-	tq := NewTimerQueue(time.Nanosecond)
+	tq, clock := fakeTimerQueue(time.Nanosecond)
+	// entries only expire once their delay has been exceeded, so each step is longer than the delay
 	found, _ := tq.Query()
 	if found {
 		t.Error("should not have been found")
 	}
 	tq.Add("entry1")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond * 2)
 	tq.Add("entry2")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond * 2)
 	tq.Add("entry3")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond * 2)
 	tq.Add("entry1")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond * 2)
 	tq.Add("entry4")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond * 2)
 
 	found, val := tq.Query()
 	if !found || val != "entry2" {
@@ -78,27 +84,27 @@ func TestTimerQueue_Query_Simple(t *testing.T) {
 }
 
 func TestTimerQueue_Query_Pause(t *testing.T) {
-	tq := NewTimerQueue(time.Millisecond * 20)
+	tq, clock := fakeTimerQueue(time.Millisecond * 20)
 	found, _ := tq.Query()
 	if found {
 		t.Error("should not have been found")
 	}
 	tq.Add("entry1")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond)
 	tq.Add("entry2")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond)
 	tq.Add("entry1")
-	time.Sleep(time.Nanosecond)
+	clock.Advance(time.Nanosecond)
 	found, _ = tq.Query()
 	if found {
 		t.Error("should not be found")
 	}
-	time.Sleep(time.Millisecond * 10)
+	clock.Advance(time.Millisecond * 10)
 	found, _ = tq.Query()
 	if found {
 		t.Error("should not be found")
 	}
-	time.Sleep(time.Millisecond * 10)
+	clock.Advance(time.Millisecond * 10)
 	found, val := tq.Query()
 	if !found {
 		t.Error("should be found")
@@ -120,13 +126,13 @@ func TestTimerQueue_Query_Pause(t *testing.T) {
 }
 
 func TestTimerQueue_Query_Cyclic(t *testing.T) {
-	tq := NewTimerQueue(time.Nanosecond)
+	tq, clock := fakeTimerQueue(time.Nanosecond)
 	tq.Add("test-0")
 	for i := 1; i <= 100; i++ {
 		last := fmt.Sprintf("test-%d", i-1)
 		next := fmt.Sprintf("test-%d", i)
 		tq.Add(next)
-		time.Sleep(time.Nanosecond)
+		clock.Advance(time.Nanosecond * 2)
 		found, val := tq.Query()
 		if !found {
 			t.Error("expected to be found")
@@ -146,10 +152,115 @@ func TestTimerQueue_Query_Cyclic(t *testing.T) {
 	if found {
 		t.Error("expected not found")
 	}
-	if len(tq.queue) != 0 {
-		t.Error("queue should be empty")
+	if len(tq.heap) != 0 {
+		t.Error("heap should be empty")
+	}
+	if len(tq.entries) != 0 {
+		t.Error("entries should be empty")
+	}
+}
+
+func TestTimerQueue_Refresh(t *testing.T) {
+	tq, clock := fakeTimerQueue(time.Second)
+	for i := 0; i < 1000; i++ {
+		tq.Add("entry-a")
+		tq.Add(fmt.Sprintf("entry-%d", i%3))
+		clock.Advance(time.Millisecond)
+	}
+	// superseded expirations are not kept around
+	if tq.Len() != 4 || len(tq.heap) != 4 {
+		t.Errorf("wrong number of tracked entries: %d", tq.Len())
+	}
+	// entry-1 was last added 3ms before the end, entry-2 2ms before, and entry-a then entry-0 1ms before
+	clock.Advance(time.Second - time.Millisecond*2)
+	found, val := tq.Query()
+	if !found || val != "entry-1" {
+		t.Errorf("wrong first expiration: %v %q", found, val)
 	}
-	if len(tq.endmap) != 0 {
-		t.Error("endmap should be empty")
+	found, _ = tq.Query()
+	if found {
+		t.Error("should not be found")
+	}
+	clock.Advance(time.Millisecond + time.Nanosecond)
+	for _, expected := range []string{"entry-2", "entry-a", "entry-0"} {
+		found, val := tq.Query()
+		if !found || val != expected {
+			t.Errorf("expected %q, got %v %q", expected, found, val)
+		}
+	}
+}
+
+func TestTimerQueue_SameDeadline(t *testing.T) {
+	tq, clock := fakeTimerQueue(time.Second)
+	for _, entry := range []string{"entry-c", "entry-a", "entry-b", "entry-a"} {
+		tq.Add(entry)
+	}
+	clock.Advance(time.Second * 2)
+	// entries that expire at the same time expire in the order they were last added
+	for _, expected := range []string{"entry-c", "entry-b", "entry-a"} {
+		found, val := tq.Query()
+		if !found || val != expected {
+			t.Errorf("expected %q, got %v %q", expected, found, val)
+		}
+	}
+}
+
+func TestTimerQueue_Deadline(t *testing.T) {
+	tq, clock := fakeTimerQueue(time.Second)
+	_, found := tq.Deadline("entry1")
+	if found {
+		t.Error("should not be found")
+	}
+	tq.Add("entry1")
+	deadline, found := tq.Deadline("entry1")
+	if !found {
+		t.Fatal("should be found")
+	}
+	if !deadline.Equal(clock.Now().Add(time.Second)) {
+		t.Error("wrong deadline")
+	}
+}
+
+func TestTimerQueue_AddWithDelay(t *testing.T) {
+	tq, clock := fakeTimerQueue(time.Second)
+	tq.AddWithDelay("entry-long", time.Second*3)
+	tq.Add("entry-default")
+	tq.AddWithDelay("entry-short", time.Millisecond)
+	if deadline, _ := tq.Deadline("entry-long"); !deadline.Equal(clock.Now().Add(time.Second * 3)) {
+		t.Error("wrong deadline")
+	}
+	// entries expire in the order of their deadlines, not the order they were added
+	expected := []string{"entry-short", "entry-default", "entry-long"}
+	for _, entry := range expected {
+		clock.Advance(time.Second + time.Nanosecond)
+		found, queried := tq.Query()
+		if !found || queried != entry {
+			t.Errorf("expected %s, got %v %s", entry, found, queried)
+		}
+	}
+	// a shorter delay can replace a longer one
+	tq.AddWithDelay("entry", time.Hour)
+	tq.AddWithDelay("entry", time.Millisecond)
+	clock.Advance(time.Millisecond * 2)
+	if found, queried := tq.Query(); !found || queried != "entry" {
+		t.Errorf("expected entry, got %v %s", found, queried)
+	}
+}
+
+func TestTimerQueue_Next(t *testing.T) {
+	tq, clock := fakeTimerQueue(time.Second)
+	if _, found := tq.Next(); found {
+		t.Error("should not be found")
+	}
+	tq.Add("entry1")
+	start := clock.Now()
+	clock.Advance(time.Millisecond)
+	tq.Add("entry2")
+	if next, found := tq.Next(); !found || !next.Equal(start.Add(time.Second)) {
+		t.Errorf("wrong next deadline: %v", next)
+	}
+	tq.Add("entry1")
+	if next, _ := tq.Next(); !next.Equal(start.Add(time.Second + time.Millisecond)) {
+		t.Errorf("wrong next deadline after refreshing: %v", next)
 	}
 }
@@ -0,0 +1,226 @@
+// Package transparency keeps farad's key transparency log: an append-only record of every key that each principal has
+// announced, hashed into a Merkle tree so that nodes can check that the keys they are given were logged, and that the
+// log is never rewritten.
+package transparency
+
+import (
+	"bufio"
+	"common"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Log IS UNSYNCHRONIZED
+type Log struct {
+	file *os.File
+	// levels[0] holds the hash of every leaf, and levels[i][j] holds the hash of the complete subtree of 2^i leaves
+	// starting at leaf j*2^i
+	levels  [][][]byte
+	entries []common.KeyBinding
+	// map of principals -> index of the latest binding of each one
+	latest map[string]uint64
+	// of the file, up to the end of the last complete entry
+	size int64
+}
+
+// Open reads the log at 'path', creating it if it does not exist, and keeps it open so that further entries can be
+// appended. Each line of the file is the JSON encoding of a common.KeyBinding. A final line without a newline can only
+// be left by a write that was interrupted, such as by a crash, before its entry was ever used, so it is truncated away.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log := &Log{file: file, latest: map[string]uint64{}}
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				if err := file.Truncate(log.size); err != nil {
+					file.Close()
+					return nil, fmt.Errorf("while truncating incomplete entry at line %d of %s: %s", line, path, err.Error())
+				}
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("while reading %s: %s", path, err.Error())
+		}
+		var binding common.KeyBinding
+		if err := json.Unmarshal(data, &binding); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("while reading line %d of %s: %s", line, path, err.Error())
+		}
+		if err := log.add(binding); err != nil {
+			file.Close()
+			return nil, err
+		}
+		log.size += int64(len(data))
+	}
+	return log, nil
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// add hashes an entry into the tree, without writing it to the file.
+func (l *Log) add(binding common.KeyBinding) error {
+	hash, err := common.MerkleLeafHash(binding)
+	if err != nil {
+		return err
+	}
+	index := uint64(len(l.entries))
+	l.entries = append(l.entries, binding)
+	l.latest[binding.Principal] = index
+	// complete every subtree that this leaf finishes
+	for level := 0; ; level++ {
+		if level == len(l.levels) {
+			l.levels = append(l.levels, nil)
+		}
+		l.levels[level] = append(l.levels[level], hash)
+		count := len(l.levels[level])
+		if count%2 == 1 {
+			return nil
+		}
+		hash = common.MerkleNodeHash(l.levels[level][count-2], l.levels[level][count-1])
+	}
+}
+
+// Record appends a binding of a principal to a key, unless that is already its latest binding, along with the serial of
+// the certificate it authenticated with. It returns whether an entry was appended. Each entry is synced to disk before
+// Record returns, so that no key is handed out before it is logged.
+func (l *Log) Record(principal string, key string, serial *big.Int) (bool, error) {
+	binding := common.KeyBinding{Principal: principal, Key: key, Serial: serial.Text(16), Time: time.Now().UTC()}
+	if index, found := l.latest[principal]; found {
+		current := l.entries[index]
+		if current.Key == binding.Key && current.Serial == binding.Serial {
+			return false, nil
+		}
+	}
+	encoded, err := json.Marshal(binding)
+	if err != nil {
+		return false, fmt.Errorf("while encoding key binding: %s", err.Error())
+	}
+	line := append(encoded, '\n')
+	if err := l.append(line); err != nil {
+		// so that the next entry doesn't follow a partial line
+		if terr := l.file.Truncate(l.size); terr != nil {
+			return false, fmt.Errorf("while appending to key log: %s, and then while truncating it: %s", err.Error(), terr.Error())
+		}
+		return false, fmt.Errorf("while appending to key log: %s", err.Error())
+	}
+	l.size += int64(len(line))
+	return true, l.add(binding)
+}
+
+// append writes a line to the end of the file, and syncs it to disk.
+func (l *Log) append(line []byte) error {
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *Log) Size() uint64 {
+	return uint64(len(l.entries))
+}
+
+// largestPowerOfTwoBelow returns the largest power of two smaller than n, which must be at least 2.
+func largestPowerOfTwoBelow(n uint64) uint64 {
+	k := uint64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// hashRange returns the hash of the tree over leaves [start, end), which must not be empty.
+func (l *Log) hashRange(start uint64, end uint64) []byte {
+	size := end - start
+	if size&(size-1) == 0 && start%size == 0 {
+		level := 0
+		for uint64(1)<<uint(level) < size {
+			level++
+		}
+		return l.levels[level][start/size]
+	}
+	k := largestPowerOfTwoBelow(size)
+	return common.MerkleNodeHash(l.hashRange(start, start+k), l.hashRange(start+k, end))
+}
+
+// Head describes the tree over the whole log.
+func (l *Log) Head() common.TreeHead {
+	head := common.TreeHead{Size: l.Size()}
+	if head.Size == 0 {
+		// as defined by RFC 6962
+		empty := sha256.Sum256(nil)
+		head.RootHash = empty[:]
+	} else {
+		head.RootHash = l.hashRange(0, head.Size)
+		head.Timestamp = l.entries[head.Size-1].Time
+	}
+	return head
+}
+
+// path computes the inclusion path for leaf m of the tree over leaves [start, end), as in RFC 6962.
+func (l *Log) path(m uint64, start uint64, end uint64) [][]byte {
+	size := end - start
+	if size == 1 {
+		return nil
+	}
+	k := largestPowerOfTwoBelow(size)
+	if m < k {
+		return append(l.path(m, start, start+k), l.hashRange(start+k, end))
+	}
+	return append(l.path(m-k, start+k, end), l.hashRange(start, start+k))
+}
+
+// Inclusion proves that the latest binding of a principal is in the tree over the whole log. It returns nil if the
+// principal has never been logged.
+func (l *Log) Inclusion(principal string) *common.KeyInclusion {
+	index, found := l.latest[principal]
+	if !found {
+		return nil
+	}
+	return &common.KeyInclusion{
+		Binding: l.entries[index],
+		Index:   index,
+		Path:    l.path(index, 0, l.Size()),
+	}
+}
+
+// subproof computes the consistency proof between the first m leaves of [start, end) and the whole range, as in
+// RFC 6962.
+func (l *Log) subproof(m uint64, start uint64, end uint64, complete bool) [][]byte {
+	size := end - start
+	if m == size {
+		if complete {
+			return nil
+		}
+		return [][]byte{l.hashRange(start, end)}
+	}
+	k := largestPowerOfTwoBelow(size)
+	if m <= k {
+		return append(l.subproof(m, start, start+k, complete), l.hashRange(start+k, end))
+	}
+	return append(l.subproof(m-k, start+k, end, false), l.hashRange(start, start+k))
+}
+
+// Consistency proves that the tree over the whole log extends the tree over the first 'size' entries.
+func (l *Log) Consistency(size uint64) ([][]byte, error) {
+	if size > l.Size() {
+		return nil, errors.New("cannot prove consistency with a tree larger than the log")
+	}
+	if size == 0 || size == l.Size() {
+		return nil, nil
+	}
+	return l.subproof(size, 0, l.Size(), true), nil
+}
@@ -0,0 +1,221 @@
+package transparency
+
+import (
+	"bytes"
+	"common"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"util/testutil"
+)
+
+func tempLog(t *testing.T) (*Log, string) {
+	dir, err := ioutil.TempDir("", "transparency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.log")
+	log, err := Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return log, path
+}
+
+func cleanup(log *Log, path string) {
+	log.Close()
+	os.RemoveAll(filepath.Dir(path))
+}
+
+// referenceRoot computes the tree hash directly from the definition in RFC 6962.
+func referenceRoot(t *testing.T, bindings []common.KeyBinding) []byte {
+	if len(bindings) == 1 {
+		leaf, err := common.MerkleLeafHash(bindings[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	k := largestPowerOfTwoBelow(uint64(len(bindings)))
+	return common.MerkleNodeHash(referenceRoot(t, bindings[:k]), referenceRoot(t, bindings[k:]))
+}
+
+func record(t *testing.T, log *Log, principal string, key string, serial int64) {
+	appended, err := log.Record(principal, key, big.NewInt(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !appended {
+		t.Fatalf("binding of %q to %q should have been appended", principal, key)
+	}
+}
+
+func TestProofs(t *testing.T) {
+	log, path := tempLog(t)
+	defer cleanup(log, path)
+	empty := sha256.Sum256(nil)
+	if head := log.Head(); head.Size != 0 || !bytes.Equal(head.RootHash, empty[:]) {
+		t.Errorf("wrong empty tree head: %+v", head)
+	}
+	heads := []common.TreeHead{log.Head()}
+	for size := 1; size <= 20; size++ {
+		record(t, log, fmt.Sprintf("node-%d", size-1), fmt.Sprintf("key-%d", size-1), 1)
+		head := log.Head()
+		heads = append(heads, head)
+		if head.Size != uint64(size) || !bytes.Equal(head.RootHash, referenceRoot(t, log.entries)) {
+			t.Fatalf("wrong tree head at size %d", size)
+		}
+		for index := 0; index < size; index++ {
+			principal := fmt.Sprintf("node-%d", index)
+			inclusion := log.Inclusion(principal)
+			if err := common.VerifyKeyInclusion(&head, principal, fmt.Sprintf("key-%d", index), inclusion); err != nil {
+				t.Errorf("at size %d: %v", size, err)
+			}
+		}
+		for old := 0; old <= size; old++ {
+			proof, err := log.Consistency(uint64(old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !common.VerifyConsistency(uint64(old), uint64(size), heads[old].RootHash, head.RootHash, proof) {
+				t.Errorf("invalid consistency proof from size %d to %d", old, size)
+			}
+		}
+	}
+	_, err := log.Consistency(21)
+	testutil.CheckError(t, err, "cannot prove consistency with a tree larger than the log")
+	if log.Inclusion("node-missing") != nil {
+		t.Error("should not have an inclusion proof for a principal that was never logged")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	log, path := tempLog(t)
+	defer cleanup(log, path)
+	record(t, log, "node-a", "key-a", 1)
+	appended, err := log.Record("node-a", "key-a", big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended {
+		t.Error("the same binding should not be logged twice")
+	}
+	// a renewed certificate, or a new key, is a new binding
+	record(t, log, "node-a", "key-a", 2)
+	record(t, log, "node-a", "key-a2", 2)
+	record(t, log, "node-b", "key-b", 3)
+	inclusion := log.Inclusion("node-a")
+	if inclusion.Index != 2 || inclusion.Binding.Key != "key-a2" || inclusion.Binding.Serial != "2" {
+		t.Errorf("wrong latest binding: %+v", inclusion)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	log, path := tempLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	for i := 0; i < 5; i++ {
+		record(t, log, fmt.Sprintf("node-%d", i), "key", int64(i))
+	}
+	head := log.Head()
+	log.Close()
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	reopened := log.Head()
+	if reopened.Size != head.Size || !bytes.Equal(reopened.RootHash, head.RootHash) || !reopened.Timestamp.Equal(head.Timestamp) {
+		t.Errorf("wrong tree head after reopening: %+v instead of %+v", reopened, head)
+	}
+	// appending continues from where the file left off
+	record(t, log, "node-5", "key", 5)
+	if err := common.VerifyKeyInclusion(&common.TreeHead{Size: 6, RootHash: log.Head().RootHash}, "node-0", "key", log.Inclusion("node-0")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpen_Corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.log")
+	if err := ioutil.WriteFile(path, []byte("{\"Principal\":\"node-a\"}\n{\"Princ\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(path)
+	testutil.CheckError(t, err, "while reading line 2 of")
+}
+
+func TestOpen_TornWrite(t *testing.T) {
+	log, path := tempLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	record(t, log, "node-a", "key-a", 1)
+	head := log.Head()
+	log.Close()
+	// as if farad crashed partway through appending an entry
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("{\"Principal\":\"node-b\",\"Ke")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if reopened := log.Head(); reopened.Size != 1 || !bytes.Equal(reopened.RootHash, head.RootHash) {
+		t.Errorf("incomplete entry should have been dropped: %+v", reopened)
+	}
+	record(t, log, "node-b", "key-b", 2)
+	log.Close()
+	// the new entry must not have been joined onto the incomplete one
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Size() != 2 || log.Inclusion("node-b") == nil {
+		t.Errorf("wrong entries after reopening: %d", log.Size())
+	}
+}
+
+func TestRecord_FailedWrite(t *testing.T) {
+	log, path := tempLog(t)
+	defer cleanup(log, path)
+	record(t, log, "node-a", "key-a", 1)
+	// writes fail through a descriptor that can only read
+	writable := log.file
+	readonly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.file = readonly
+	_, err = log.Record("node-b", "key-b", big.NewInt(2))
+	testutil.CheckError(t, err, "while appending to key log")
+	if log.Size() != 1 {
+		t.Error("a failed entry should not be added to the tree")
+	}
+	readonly.Close()
+	log.file = writable
+	record(t, log, "node-b", "key-b", 2)
+	log.Close()
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Size() != 2 {
+		t.Errorf("wrong size after reopening: %d", log.Size())
+	}
+}
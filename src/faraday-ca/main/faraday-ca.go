@@ -0,0 +1,134 @@
+package main
+
+import (
+	"authority"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"remote"
+	"time"
+	"util/secretutil"
+	"util/wraputil"
+)
+
+// long enough that the authority rarely needs to be rolled
+const DEFAULT_CA_VALIDITY = time.Hour * 24 * 365 * 10
+
+// short enough that a lost node certificate doesn't stay useful for long, even if nobody revokes it
+const DEFAULT_CERT_VALIDITY = time.Hour * 24 * 90
+
+const DEFAULT_CRL_VALIDITY = time.Hour * 24 * 7
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: faraday-ca [<options>] <ca-dir> init <name>")
+	fmt.Fprintln(os.Stderr, "       faraday-ca [<options>] <ca-dir> sign <csr-path> <out-path>")
+	fmt.Fprintln(os.Stderr, "       faraday-ca [<options>] <ca-dir> revoke <serial>")
+	fmt.Fprintln(os.Stderr, "       faraday-ca [<options>] <ca-dir> crl <out-path>")
+	fmt.Fprintln(os.Stderr, "       faraday-ca [<options>] <ca-dir> list")
+	flag.PrintDefaults()
+}
+
+func openAuthority(dir string, passphrase_spec string) (*authority.Authority, error) {
+	var passphrase []byte
+	if passphrase_spec != "" {
+		var err error
+		passphrase, err = secretutil.ReadPassphrase(passphrase_spec)
+		if err != nil {
+			return nil, err
+		}
+		defer secretutil.Wipe(passphrase)
+	}
+	return authority.Open(dir, passphrase)
+}
+
+func main() {
+	algorithm := flag.String("algorithm", "ecdsa", "key algorithm for a new authority: ecdsa, ed25519 or rsa")
+	validity := flag.Duration("validity", 0, "how long issued certificates are valid (default 90 days for node certificates, 10 years for the authority)")
+	crl_validity := flag.Duration("crl-validity", DEFAULT_CRL_VALIDITY, "how long a CRL is valid before it must be regenerated")
+	pin_key_oid := flag.String("pin-key-oid", "", "object identifier of the extension in which nodes may request that their WireGuard keys be pinned (disabled if empty)")
+	passphrase_spec := flag.String("key-passphrase", "", "where to find the passphrase for an encrypted authority key: file:<path>, env:<variable> or credential:<systemd-credential>")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	dir, command, args := args[0], args[1], args[2:]
+	expected_args := map[string]int{"init": 1, "sign": 2, "revoke": 1, "crl": 1, "list": 0}
+	if count, found := expected_args[command]; !found || len(args) != count {
+		usage()
+		os.Exit(1)
+	}
+
+	if command == "init" {
+		if *validity == 0 {
+			*validity = DEFAULT_CA_VALIDITY
+		}
+		ca, err := authority.Init(dir, args[0], *algorithm, *validity)
+		if err != nil {
+			log.Fatalln("Could not create authority:", err)
+		}
+		log.Printf("Created authority %q, valid until %v; distribute %s/ca.pem to farad and nodes", args[0], ca.Cert.NotAfter, dir)
+		return
+	}
+
+	ca, err := openAuthority(dir, *passphrase_spec)
+	if err != nil {
+		log.Fatalln("Could not open authority:", err)
+	}
+	if *pin_key_oid != "" {
+		ca.PinnedKeyOID, err = remote.ParseObjectIdentifier(*pin_key_oid)
+		if err != nil {
+			log.Fatalln("Invalid -pin-key-oid:", err)
+		}
+	}
+	switch command {
+	case "sign":
+		if *validity == 0 {
+			*validity = DEFAULT_CERT_VALIDITY
+		}
+		csrdata, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			log.Fatalln("Could not read certificate request:", err)
+		}
+		csr, err := wraputil.LoadX509CSRFromPEM(csrdata)
+		if err != nil {
+			log.Fatalln("Could not parse certificate request:", err)
+		}
+		cert, err := ca.SignCSR(csr, *validity)
+		if err != nil {
+			log.Fatalln("Could not sign certificate request:", err)
+		}
+		if err := ioutil.WriteFile(args[1], ca.Chain(cert), 0644); err != nil {
+			log.Fatalln("Could not write certificate:", err)
+		}
+		log.Printf("Issued certificate %x for %q, valid until %v", cert.SerialNumber, cert.Subject.CommonName, cert.NotAfter)
+	case "revoke":
+		if err := ca.Revoke(args[0]); err != nil {
+			log.Fatalln("Could not revoke certificate:", err)
+		}
+		log.Println("Revoked certificate", args[0], "-- regenerate and distribute the CRL")
+	case "crl":
+		crl, err := ca.CRL(*crl_validity)
+		if err != nil {
+			log.Fatalln("Could not generate CRL:", err)
+		}
+		if err := ioutil.WriteFile(args[0], crl, 0644); err != nil {
+			log.Fatalln("Could not write CRL:", err)
+		}
+	case "list":
+		issued, err := ca.Issued()
+		if err != nil {
+			log.Fatalln("Could not read index:", err)
+		}
+		output, err := json.MarshalIndent(issued, "", "  ")
+		if err != nil {
+			log.Fatalln("Could not format index:", err)
+		}
+		os.Stdout.Write(append(output, '\n'))
+	}
+}
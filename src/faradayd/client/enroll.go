@@ -0,0 +1,106 @@
+// Package client holds the parts of faradayd that talk to farad, kept apart from the daemon itself so that they can
+// be tested, and reused by other nodes.
+package client
+
+import (
+	"common"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"util/timeutil"
+	"util/wraputil"
+)
+
+// how long to wait before trying again, after failing to renew a certificate
+const RENEWAL_RETRY = time.Minute
+
+// A Sender transfers individual requests to farad, such as a remote.Remote.
+type Sender interface {
+	Send(message interface{}, result interface{}) error
+}
+
+// Enroll asks farad for a certificate for 'principal', with 'key' as its private key. A node that doesn't have a
+// certificate yet must pass a join token, and send the request over a connection from remote.ConnectEnrollment without
+// a certificate; a node renewing its certificate passes an empty token, and sends the request over a connection that
+// presents its current certificate.
+func Enroll(conn Sender, key crypto.Signer, principal string, token string) (tls.Certificate, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: principal},
+	}, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while creating certificate request: %s", err.Error())
+	}
+	req := &common.EnrollRequest{
+		Version: common.FARADAY_PROTOCOL_VERSION,
+		Token:   token,
+		CSR:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	}
+	response := &common.EnrollResponse{}
+	if err := conn.Send(req, response); err != nil {
+		return tls.Certificate{}, err
+	}
+	chain, err := wraputil.LoadX509ChainFromPEM([]byte(response.Chain))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while loading issued certificate: %s", err.Error())
+	}
+	if err := wraputil.CheckKeyMatchesCert(key, chain[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	if chain[0].Subject.CommonName != principal {
+		return tls.Certificate{}, fmt.Errorf("issued certificate is for %q instead of %q", chain[0].Subject.CommonName, principal)
+	}
+	cert := tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, link := range chain {
+		cert.Certificate = append(cert.Certificate, link.Raw)
+	}
+	return cert, nil
+}
+
+// RenewalTime returns when a certificate should be renewed: two thirds of the way through its validity, which leaves
+// time to try again if farad is unreachable.
+func RenewalTime(cert *x509.Certificate) time.Time {
+	return cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+}
+
+// KeepRenewed calls renew() at the RenewalTime of 'cert', and then at the RenewalTime of each certificate that it
+// returns, until halt() (the returned function) is called. If renew() fails, it is tried again every RENEWAL_RETRY
+// until it succeeds.
+func KeepRenewed(clock timeutil.Clock, cert *x509.Certificate, renew func() (*x509.Certificate, error)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wait := RenewalTime(cert).Sub(clock.Now())
+		for {
+			timer := clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-stop:
+				timer.Stop()
+				return
+			}
+			renewed, err := renew()
+			if err != nil {
+				log.Println("Could not renew certificate:", err)
+				wait = RENEWAL_RETRY
+				continue
+			}
+			cert = renewed
+			wait = RenewalTime(cert).Sub(clock.Now())
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
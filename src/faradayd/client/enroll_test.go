@@ -0,0 +1,174 @@
+package client
+
+import (
+	"authority"
+	"common"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"farad/enrollment"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+	"util/timeutil"
+)
+
+// senderFunc passes requests to a function, rather than over the network.
+type senderFunc func(message interface{}, result interface{}) error
+
+func (f senderFunc) Send(message interface{}, result interface{}) error {
+	return f(message, result)
+}
+
+// roundTrip encodes and decodes a message, as sending it would.
+func roundTrip(t *testing.T, message interface{}, result interface{}) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// enrollVia returns a Sender that enrolls nodes through 'e', as if authenticated as 'principal'.
+func enrollVia(t *testing.T, e *enrollment.Enroller, principal string) Sender {
+	return senderFunc(func(message interface{}, result interface{}) error {
+		req := &common.EnrollRequest{}
+		roundTrip(t, message, req)
+		response, _, err := e.Enroll(principal, req)
+		if err != nil {
+			return err
+		}
+		roundTrip(t, response, result)
+		return nil
+	})
+}
+
+func tempEnroller(t *testing.T) (*enrollment.Enroller, func()) {
+	dir, err := ioutil.TempDir("", "enrollment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := authority.Init(dir, "test-ca", "ecdsa", time.Hour*24)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return enrollment.NewEnroller(ca, time.Hour), func() { os.RemoveAll(dir) }
+}
+
+func TestEnroll(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	token, _, err := e.CreateToken([]string{"node-*"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	cert, err := Enroll(enrollVia(t, e, ""), key, "node-a", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Subject.CommonName != "node-a" || len(cert.Certificate) != 2 || cert.PrivateKey != key {
+		t.Error("wrong certificate")
+	}
+	// renewing with the new certificate, rather than a token
+	renewed, err := Enroll(enrollVia(t, e, "node-a"), key, "node-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("should have been a new certificate")
+	}
+}
+
+func TestEnroll_Refused(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	_, err := Enroll(enrollVia(t, e, ""), key, "node-a", "not-a-token")
+	if err == nil {
+		t.Error("should have been refused")
+	}
+}
+
+func TestEnroll_WrongKey(t *testing.T) {
+	e, cleanup := tempEnroller(t)
+	defer cleanup()
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	issued := &common.EnrollResponse{}
+	capture := senderFunc(func(message interface{}, result interface{}) error {
+		err := enrollVia(t, e, "node-a").Send(message, result)
+		roundTrip(t, result, issued)
+		return err
+	})
+	if _, err := Enroll(capture, other, "node-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	// as if farad had answered a different request
+	replay := senderFunc(func(message interface{}, result interface{}) error {
+		roundTrip(t, issued, result)
+		return nil
+	})
+	_, err := Enroll(replay, key, "node-a", "")
+	testutil.CheckError(t, err, "private key does not match certificate")
+}
+
+func TestRenewalTime(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(time.Hour * 3)}
+	if !RenewalTime(cert).Equal(start.Add(time.Hour * 2)) {
+		t.Error("wrong renewal time:", RenewalTime(cert))
+	}
+}
+
+func TestKeepRenewed(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := timeutil.NewFakeClock(start)
+	renewals := make(chan time.Time)
+	failing := true
+	var lock sync.Mutex
+	renew := func() (*x509.Certificate, error) {
+		now := clock.Now()
+		renewals <- now
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			return nil, errors.New("farad is unreachable")
+		}
+		return &x509.Certificate{NotBefore: now, NotAfter: now.Add(time.Hour * 3)}, nil
+	}
+	halt := KeepRenewed(clock, &x509.Certificate{NotBefore: start, NotAfter: start.Add(time.Hour * 3)}, renew)
+	defer halt()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour * 2)
+	if at := <-renewals; !at.Equal(start.Add(time.Hour * 2)) {
+		t.Error("renewed at the wrong time:", at)
+	}
+	// tried again after failing
+	clock.BlockUntil(1)
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	clock.Advance(RENEWAL_RETRY)
+	<-renewals
+	// and then at the renewal time of the new certificate
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour*2 - time.Second)
+	select {
+	case at := <-renewals:
+		t.Error("renewed too early:", at)
+	default:
+	}
+	clock.Advance(time.Second)
+	if at := <-renewals; !at.Equal(start.Add(time.Hour*4 + RENEWAL_RETRY)) {
+		t.Error("renewed at the wrong time:", at)
+	}
+}
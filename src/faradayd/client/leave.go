@@ -0,0 +1,15 @@
+package client
+
+import "common"
+
+// Leave tells farad that a node is shutting down, so that farad removes it at once and tells its peers to drop it,
+// rather than waiting for its lease to run out. 'key' must be the node's current key. It should be sent during an
+// orderly shutdown, once the node has stopped pinging farad, since a later ping would add it back.
+func Leave(conn Sender, key string) error {
+	req := &common.FaradRequest{
+		Version: common.FARADAY_PROTOCOL_VERSION,
+		Key:     key,
+		Leave:   true,
+	}
+	return conn.Send(req, &common.FaradResponse{})
+}
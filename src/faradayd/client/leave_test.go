@@ -0,0 +1,29 @@
+package client
+
+import (
+	"common"
+	"errors"
+	"testing"
+	"util/testutil"
+)
+
+func TestLeave(t *testing.T) {
+	var sent common.FaradRequest
+	conn := senderFunc(func(message interface{}, result interface{}) error {
+		roundTrip(t, message, &sent)
+		return nil
+	})
+	if err := Leave(conn, "key-a"); err != nil {
+		t.Fatal(err)
+	}
+	if !sent.Leave || sent.Key != "key-a" || sent.Version != common.FARADAY_PROTOCOL_VERSION {
+		t.Error("wrong request:", sent)
+	}
+}
+
+func TestLeave_Refused(t *testing.T) {
+	conn := senderFunc(func(message interface{}, result interface{}) error {
+		return errors.New("key of \"node-a\" does not match")
+	})
+	testutil.CheckError(t, Leave(conn, "key-a"), "does not match")
+}
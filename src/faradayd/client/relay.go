@@ -0,0 +1,46 @@
+package client
+
+import "common"
+
+// how many snapshots of changes a SnapshotRelay holds after the last snapshot that included every member, before it
+// asks for a new one of those
+const MAX_RELAYED_CHANGES = 64
+
+// A SnapshotRelay verifies the signed snapshots that a node receives, whether from farad or from its peers, and holds on
+// to them so that they can be passed on to peers that miss them while farad is unreachable. It holds the last snapshot
+// that included every member and the snapshots of changes accepted since, so that a peer can catch up from any point.
+// A SnapshotRelay IS UNSYNCHRONIZED.
+type SnapshotRelay struct {
+	verifier *common.SnapshotVerifier
+	held     []*common.SignedSnapshot
+}
+
+// NewSnapshotRelay creates a SnapshotRelay that checks snapshots with 'verifier'.
+func NewSnapshotRelay(verifier *common.SnapshotVerifier) *SnapshotRelay {
+	return &SnapshotRelay{verifier: verifier}
+}
+
+// Accept verifies a snapshot, as SnapshotVerifier.Accept does, and holds on to it if it is accepted.
+func (r *SnapshotRelay) Accept(signed *common.SignedSnapshot) (*common.ClusterSnapshot, error) {
+	snapshot, err := r.verifier.Accept(signed)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Since == 0 {
+		r.held = nil
+	}
+	r.held = append(r.held, signed)
+	return snapshot, nil
+}
+
+// Relay returns the snapshots to pass on to a peer, oldest first. The peer should accept each in turn, and ignore those
+// that it refuses for being behind what it has already accepted.
+func (r *SnapshotRelay) Relay() []*common.SignedSnapshot {
+	return append([]*common.SignedSnapshot(nil), r.held...)
+}
+
+// WantsFull returns whether the node should ask farad for every member, by sending a cursor of 0, because it has no
+// snapshot that includes every member, or is holding too many changes since the last one.
+func (r *SnapshotRelay) WantsFull() bool {
+	return len(r.held) == 0 || len(r.held) > MAX_RELAYED_CHANGES
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"common"
+	"crypto"
+	"testing"
+	"time"
+	"util/testkeyutil"
+)
+
+func signForTests(t *testing.T, key crypto.Signer, since uint64, cursor uint64, members map[string]string) *common.SignedSnapshot {
+	signed, err := common.SignSnapshot(key, &common.ClusterSnapshot{
+		ServerInstance: "instance-a",
+		Since:          since,
+		Cursor:         cursor,
+		Members:        members,
+		Timestamp:      time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSnapshotRelay(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	node := NewSnapshotRelay(common.NewSnapshotVerifier(key.Public(), time.Hour))
+	if !node.WantsFull() {
+		t.Error("should want every member to start with")
+	}
+	if _, err := node.Accept(signForTests(t, key, 0, 5, map[string]string{"node-a": "key-a"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.Accept(signForTests(t, key, 5, 7, map[string]string{"node-b": "key-b"})); err != nil {
+		t.Fatal(err)
+	}
+	if node.WantsFull() {
+		t.Error("should not want every member again yet")
+	}
+
+	// a peer that has heard nothing from farad can catch up from the relayed snapshots
+	peer := NewSnapshotRelay(common.NewSnapshotVerifier(key.Public(), time.Hour))
+	members := map[string]string{}
+	for _, signed := range node.Relay() {
+		snapshot, err := peer.Accept(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for principal, key := range snapshot.Members {
+			members[principal] = key
+		}
+	}
+	if len(members) != 2 || members["node-a"] != "key-a" || members["node-b"] != "key-b" {
+		t.Error("wrong members:", members)
+	}
+
+	// a snapshot of every member replaces everything held before it
+	if _, err := node.Accept(signForTests(t, key, 0, 8, map[string]string{"node-a": "key-a"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Relay()) != 1 {
+		t.Error("should only hold the latest snapshot of every member")
+	}
+}
+
+func TestSnapshotRelay_Refused(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	node := NewSnapshotRelay(common.NewSnapshotVerifier(key.Public(), time.Hour))
+	if _, err := node.Accept(signForTests(t, other, 0, 5, map[string]string{"node-a": "key-a"})); err == nil {
+		t.Error("should have refused a snapshot signed by the wrong key")
+	}
+	if len(node.Relay()) != 0 {
+		t.Error("should not relay a snapshot that was refused")
+	}
+}
+
+func TestSnapshotRelay_TooManyChanges(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	node := NewSnapshotRelay(common.NewSnapshotVerifier(key.Public(), time.Hour))
+	if _, err := node.Accept(signForTests(t, key, 0, 1, nil)); err != nil {
+		t.Fatal(err)
+	}
+	for cursor := uint64(1); cursor <= MAX_RELAYED_CHANGES; cursor++ {
+		if _, err := node.Accept(signForTests(t, key, cursor, cursor+1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !node.WantsFull() {
+		t.Error("should want every member again")
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"time"
+	"util/timeutil"
+)
+
+// A Rotator decides when a node rotates its WireGuard key, following the protocol of FaradRequest.NextKey: a new key is
+// announced to farad first, and the node only switches to it once farad has been distributing it for long enough that
+// every peer has had a chance to learn it. A Rotator IS UNSYNCHRONIZED.
+type Rotator struct {
+	clock    timeutil.Clock
+	interval time.Duration
+	overlap  time.Duration
+	generate func() (string, error)
+	key      string
+	next_key string
+	// when the node switched to 'key'
+	rotated time.Time
+	// when farad first accepted 'next_key', or zero if it hasn't yet
+	announced time.Time
+}
+
+// NewRotator creates a Rotator for a node that currently uses 'key', which is rotated every 'interval'. 'overlap' must
+// be at least as long as peers take to hear from farad. generate() creates a new key pair for the node, and returns its
+// public key; the node must keep its old private key until it switches to the new one.
+func NewRotator(clock timeutil.Clock, key string, interval time.Duration, overlap time.Duration, generate func() (string, error)) *Rotator {
+	return &Rotator{
+		clock:    clock,
+		interval: interval,
+		overlap:  overlap,
+		generate: generate,
+		key:      key,
+		rotated:  clock.Now(),
+	}
+}
+
+// Keys returns the Key and NextKey to send in the next FaradRequest. Once the current key is due to be rotated, a new
+// key is generated and returned as the next key, and once farad has accepted it for 'overlap', it becomes the current
+// key. The node must use whichever key is returned as the current key.
+func (r *Rotator) Keys() (string, string, error) {
+	now := r.clock.Now()
+	if r.next_key == "" && !now.Before(r.rotated.Add(r.interval)) {
+		next_key, err := r.generate()
+		if err != nil {
+			return "", "", fmt.Errorf("while generating next key: %s", err.Error())
+		}
+		r.next_key = next_key
+	}
+	if r.next_key != "" && !r.announced.IsZero() && !now.Before(r.announced.Add(r.overlap)) {
+		r.key, r.next_key = r.next_key, ""
+		r.rotated, r.announced = now, time.Time{}
+	}
+	return r.key, r.next_key, nil
+}
+
+// Accepted records that farad accepted a request with the keys returned by Keys, so that the overlap period for the
+// next key starts. A request that farad refused doesn't count, since farad won't have told any peers about the key.
+func (r *Rotator) Accepted(key string, next_key string) {
+	if key == r.key && next_key != "" && next_key == r.next_key && r.announced.IsZero() {
+		r.announced = r.clock.Now()
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"util/testutil"
+	"util/timeutil"
+)
+
+// numberedKeys returns a generate function for a Rotator, which names keys in order.
+func numberedKeys() func() (string, error) {
+	count := 0
+	return func() (string, error) {
+		count++
+		return fmt.Sprintf("key-%d", count), nil
+	}
+}
+
+func checkKeys(t *testing.T, r *Rotator, key string, next_key string) {
+	gotKey, gotNext, err := r.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotKey != key || gotNext != next_key {
+		t.Errorf("expected keys %q and %q, not %q and %q", key, next_key, gotKey, gotNext)
+	}
+}
+
+func TestRotator(t *testing.T) {
+	clock := timeutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRotator(clock, "key-0", time.Hour, time.Minute, numberedKeys())
+	checkKeys(t, r, "key-0", "")
+	clock.Advance(time.Hour)
+	checkKeys(t, r, "key-0", "key-1")
+	// not switched to until farad has accepted it for long enough
+	clock.Advance(time.Minute)
+	checkKeys(t, r, "key-0", "key-1")
+	r.Accepted("key-0", "key-1")
+	clock.Advance(time.Minute - time.Second)
+	r.Accepted("key-0", "key-1")
+	checkKeys(t, r, "key-0", "key-1")
+	clock.Advance(time.Second)
+	checkKeys(t, r, "key-1", "")
+	// and rotated again an interval after the switch
+	clock.Advance(time.Hour - time.Second)
+	checkKeys(t, r, "key-1", "")
+	clock.Advance(time.Second)
+	checkKeys(t, r, "key-1", "key-2")
+}
+
+func TestRotator_GenerateFails(t *testing.T) {
+	clock := timeutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := NewRotator(clock, "key-0", time.Hour, time.Minute, func() (string, error) {
+		return "", errors.New("no randomness")
+	})
+	clock.Advance(time.Hour)
+	_, _, err := r.Keys()
+	testutil.CheckError(t, err, "no randomness")
+}
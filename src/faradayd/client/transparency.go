@@ -0,0 +1,58 @@
+package client
+
+import (
+	"common"
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A KeyChecker checks the proofs from farad's key transparency log that come with each FaradResponse, so that a node
+// only passes a peer's key to wireguard once it has been shown to be logged, and notices if the log is ever rewritten.
+// A KeyChecker IS UNSYNCHRONIZED.
+type KeyChecker struct {
+	key  crypto.PublicKey
+	head *common.TreeHead
+}
+
+// NewKeyChecker creates a KeyChecker for tree heads signed by farad's snapshot key.
+func NewKeyChecker(key crypto.PublicKey) *KeyChecker {
+	return &KeyChecker{key: key}
+}
+
+// TreeSize returns the size of the last tree head checked, to send as FaradRequest.TreeSize.
+func (c *KeyChecker) TreeSize() uint64 {
+	if c.head == nil {
+		return 0
+	}
+	return c.head.Size
+}
+
+// Check verifies the tree head of a response, and that the log has only been appended to since the last tree head
+// checked. It returns the members of CurrentCluster whose keys were proven to be logged; the others are left out, so
+// that their keys aren't used until a later response proves them. If the tree head can't be verified, none are.
+func (c *KeyChecker) Check(response *common.FaradResponse) (map[string]string, error) {
+	head, err := common.VerifyTreeHead(c.key, response.TreeHead)
+	if err != nil {
+		return nil, err
+	}
+	if c.head != nil {
+		if head.Size < c.head.Size {
+			return nil, fmt.Errorf("tree head of size %d is behind the last one checked, of size %d", head.Size, c.head.Size)
+		}
+		if !common.VerifyConsistency(c.head.Size, head.Size, c.head.RootHash, head.RootHash, response.Consistency) {
+			return nil, errors.New("key transparency log is not consistent with the last tree head checked")
+		}
+	}
+	c.head = head
+	proven := map[string]string{}
+	for principal, key := range response.CurrentCluster {
+		if err := common.VerifyKeyInclusion(head, principal, key, response.Inclusions[principal]); err != nil {
+			log.Println("Not using key:", err)
+			continue
+		}
+		proven[principal] = key
+	}
+	return proven, nil
+}
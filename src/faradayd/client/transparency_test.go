@@ -0,0 +1,134 @@
+package client
+
+import (
+	"common"
+	"crypto"
+	"farad/transparency"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+func tempLog(t *testing.T) (*transparency.Log, func()) {
+	dir, err := ioutil.TempDir("", "transparency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keylog, err := transparency.Open(filepath.Join(dir, "keys.log"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return keylog, func() {
+		keylog.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func record(t *testing.T, keylog *transparency.Log, principal string, key string) {
+	if _, err := keylog.Record(principal, key, big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// provenResponse builds a response listing 'members', with proofs from 'keylog', as farad would for a node that last
+// saw a tree of 'tree_size'.
+func provenResponse(t *testing.T, key crypto.Signer, keylog *transparency.Log, tree_size uint64, members map[string]string) *common.FaradResponse {
+	head := keylog.Head()
+	signed, err := common.SignTreeHead(key, &head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consistency, err := keylog.Consistency(tree_size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &common.FaradResponse{
+		CurrentCluster: members,
+		TreeHead:       signed,
+		Consistency:    consistency,
+		Inclusions:     map[string]*common.KeyInclusion{},
+	}
+	for principal, key := range members {
+		if inclusion := keylog.Inclusion(principal); inclusion != nil && inclusion.Binding.Key == key {
+			response.Inclusions[principal] = inclusion
+		}
+	}
+	return response
+}
+
+func TestKeyChecker(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	keylog, cleanup := tempLog(t)
+	defer cleanup()
+	checker := NewKeyChecker(key.Public())
+
+	record(t, keylog, "node-a", "key-a")
+	record(t, keylog, "node-b", "key-b")
+	proven, err := checker.Check(provenResponse(t, key, keylog, checker.TreeSize(), map[string]string{
+		"node-a": "key-a",
+		"node-b": "key-b",
+		// never logged
+		"node-c": "key-c",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proven) != 2 || proven["node-a"] != "key-a" || proven["node-b"] != "key-b" {
+		t.Error("wrong keys proven:", proven)
+	}
+	if checker.TreeSize() != 2 {
+		t.Error("wrong tree size:", checker.TreeSize())
+	}
+
+	record(t, keylog, "node-c", "key-c")
+	record(t, keylog, "node-a", "key-a2")
+	proven, err = checker.Check(provenResponse(t, key, keylog, checker.TreeSize(), map[string]string{
+		"node-a": "key-a2",
+		"node-c": "key-c",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proven) != 2 || proven["node-a"] != "key-a2" || proven["node-c"] != "key-c" {
+		t.Error("wrong keys proven:", proven)
+	}
+}
+
+func TestKeyChecker_Rewritten(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	checker := NewKeyChecker(key.Public())
+	keylog, cleanup := tempLog(t)
+	defer cleanup()
+	record(t, keylog, "node-a", "key-a")
+	record(t, keylog, "node-b", "key-b")
+	if _, err := checker.Check(provenResponse(t, key, keylog, 0, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a log with a different history
+	forked, cleanup_forked := tempLog(t)
+	defer cleanup_forked()
+	record(t, forked, "node-a", "key-evil")
+	record(t, forked, "node-b", "key-b")
+	record(t, forked, "node-c", "key-c")
+	_, err := checker.Check(provenResponse(t, key, forked, checker.TreeSize(), map[string]string{"node-a": "key-evil"}))
+	testutil.CheckError(t, err, "not consistent")
+	if checker.TreeSize() != 2 {
+		t.Error("should still be at the last tree head that was consistent")
+	}
+}
+
+func TestKeyChecker_WrongSignature(t *testing.T) {
+	key := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	keylog, cleanup := tempLog(t)
+	defer cleanup()
+	record(t, keylog, "node-a", "key-a")
+	_, err := NewKeyChecker(key.Public()).Check(provenResponse(t, other, keylog, 0, map[string]string{"node-a": "key-a"}))
+	testutil.CheckError(t, err, "invalid tree head signature")
+}
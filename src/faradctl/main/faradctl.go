@@ -0,0 +1,41 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"log"
+	"os"
+	"remote"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		log.Fatalln("Usage: faradctl <admin-socket> <status|members|reload|token <lifetime> <principal-pattern>...>")
+	}
+	request := common.AdminRequest{Command: os.Args[2]}
+	if request.Command == common.ADMIN_COMMAND_TOKEN {
+		if len(os.Args) < 5 {
+			log.Fatalln("Usage: faradctl <admin-socket> token <lifetime> <principal-pattern>...")
+		}
+		lifetime, err := time.ParseDuration(os.Args[3])
+		if err != nil {
+			log.Fatalln("Invalid token lifetime:", err)
+		}
+		request.TokenLifetime = lifetime
+		request.TokenPatterns = os.Args[4:]
+	} else if len(os.Args) != 3 {
+		log.Fatalln("Usage: faradctl <admin-socket> <status|members|reload|token <lifetime> <principal-pattern>...>")
+	}
+	conn := remote.ConnectAdmin(os.Args[1], nil, time.Second*5)
+	response := &common.AdminResponse{}
+	err := conn.Send(request, response)
+	if err != nil {
+		log.Fatalln("Request failed:", err)
+	}
+	output, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Fatalln("Could not format response:", err)
+	}
+	os.Stdout.Write(append(output, '\n'))
+}
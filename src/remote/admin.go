@@ -0,0 +1,190 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// PeerCredentials identify the local process on the other end of an admin socket, as reported by the kernel when the
+// connection was made.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+func (creds PeerCredentials) String() string {
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", creds.PID, creds.UID, creds.GID)
+}
+
+// An AdminHandler is a function that handles requests received over an admin socket. It works just like a
+// RequestHandler, except that the requesting process is identified by its credentials rather than by a TLS principal.
+type AdminHandler func(creds PeerCredentials, parse func(interface{}) error) (interface{}, error)
+
+// An AdminContext is a representation of a local endpoint that accepts requests from other processes on the same
+// machine, over a Unix domain socket. No TLS is involved: the kernel vouches for the identity of the requesting
+// process, and Authorize decides whether it may talk to us at all. Requests and responses are encoded in the same way
+// as for LocalContext.
+type AdminContext struct {
+	// The handler used when a request is received from an authorized process.
+	Handler AdminHandler
+	// Called once for each connection, before its first request is handled. If it returns an error, no requests are
+	// served over that connection, and it is closed.
+	Authorize func(creds PeerCredentials) error
+	// The encodings that this system is willing to use, in order of preference. If empty, only JSONCodec is used.
+	Codecs []Codec
+	// The timeout used for all requests, in and out of the admin socket.
+	Timeout time.Duration
+}
+
+// An AdminRemote is a connection to the admin socket of a daemon running on the local machine. Data can be transferred
+// over an AdminRemote by calling the Send() method.
+type AdminRemote struct {
+	client http.Client
+	codecs codecList
+	// set once the daemon says that it accepts gzip, but requests over a local socket are never compressed anyway,
+	// because the compression threshold is 0
+	peerAcceptsGzip int32
+	// set once the daemon says which codecs it accepts, as understood by requestCodec
+	peerCodec int32
+}
+
+type peerCredentialsKey struct{}
+
+// credentialConn remembers the credentials of the process that opened a connection, so that they can be passed to the
+// handler for each request made over that connection.
+type credentialConn struct {
+	net.Conn
+	creds PeerCredentials
+	// authorization is decided by the first request, rather than while accepting, because Authorize may block
+	authorize sync.Once
+	rejected  error
+}
+
+// authorized runs 'authorize' the first time that it is called for a connection, and returns its result every time.
+func (cc *credentialConn) authorized(authorize func(creds PeerCredentials) error) error {
+	cc.authorize.Do(func() {
+		cc.rejected = authorize(cc.creds)
+		if cc.rejected != nil {
+			log.Println("Rejected admin connection:", cc.rejected)
+		}
+	})
+	return cc.rejected
+}
+
+type credentialListener struct {
+	net.Listener
+}
+
+func (l credentialListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		creds, err := peerCredentials(conn)
+		if err != nil {
+			log.Println("Rejected admin connection:", err)
+			conn.Close()
+			continue
+		}
+		return &credentialConn{Conn: conn, creds: creds}, nil
+	}
+}
+
+// AllowOwnerAndRoot is an Authorize function that only allows processes running as root or as the same user as this
+// process.
+func AllowOwnerAndRoot(creds PeerCredentials) error {
+	if creds.UID == 0 || creds.UID == uint32(os.Getuid()) {
+		return nil
+	}
+	return fmt.Errorf("unauthorized admin connection from %s", creds)
+}
+
+// StartServe creates a Unix domain socket at 'path', replacing anything left there by a previous instance, and serves
+// admin requests on it. Its results are the same as for LocalContext.ServeListeners. The socket is only accessible to
+// its owner and group, as a first line of defense; Authorize is still checked for every connection.
+func (admin *AdminContext) StartServe(path string) (func(deadline time.Duration) error, chan error, error) {
+	if admin.Authorize == nil {
+		return nil, nil, errors.New("admin socket requires an Authorize function")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("while removing stale admin socket: %s", err.Error())
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, nil, fmt.Errorf("while restricting admin socket: %s", err.Error())
+	}
+	enc := encoding{defaultCodecs(admin.Codecs), 0}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path != "/faraday" {
+				http.Error(writer, "not found", 404)
+				return
+			}
+			cc, ok := request.Context().Value(peerCredentialsKey{}).(*credentialConn)
+			if !ok {
+				http.Error(writer, "no credentials", 403)
+				return
+			}
+			if cc.authorized(admin.Authorize) != nil {
+				// so that the server closes the connection once the response is written
+				writer.Header().Set("Connection", "close")
+				http.Error(writer, "unauthorized", 403)
+				return
+			}
+			creds := cc.creds
+			serveEncoded(writer, request, enc, creds.String(), func(parse func(interface{}) error) (interface{}, error) {
+				return admin.Handler(creds, parse)
+			})
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if cc, ok := conn.(*credentialConn); ok {
+				return context.WithValue(ctx, peerCredentialsKey{}, cc)
+			}
+			return ctx
+		},
+		ReadTimeout:  admin.Timeout,
+		WriteTimeout: admin.Timeout,
+	}
+	stop, cherr := serveOn(server, []net.Listener{credentialListener{ln}})
+	return stop, cherr, nil
+}
+
+// ConnectAdmin prepares to connect to the admin socket at 'path'. As with ConnectRemote, no connection is made until
+// the first message is sent. 'codecs' lists the encodings to use, as with LocalContext.Codecs.
+func ConnectAdmin(path string, codecs []Codec, timeout time.Duration) AdminRemote {
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, "unix", path)
+			},
+			DisableCompression: true,
+		},
+		Timeout: timeout,
+	}
+	return AdminRemote{client, defaultCodecs(codecs), 0, 0}
+}
+
+// Send transmits an individual request to the admin socket, in the same way as Remote.Send. The request will be handled
+// by the AdminHandler of the daemon.
+func (conn *AdminRemote) Send(message interface{}, result interface{}) error {
+	enc := encoding{conn.codecs, 0}
+	verify := func(*http.Response) error {
+		// the kernel already guarantees that we're talking to whoever owns the socket path
+		return nil
+	}
+	return sendEncoded(&conn.client, "http://admin/faraday", enc, &conn.peerAcceptsGzip, &conn.peerCodec, message, result, verify)
+}
@@ -0,0 +1,151 @@
+package remote
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+	"util/testutil"
+)
+
+func startAdmin(t *testing.T, admin *AdminContext) (string, func()) {
+	dir, err := ioutil.TempDir("", "faraday-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := path.Join(dir, "admin.sock")
+	stop, cherr, err := admin.StartServe(socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return socket, func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAdminEndToEnd(t *testing.T) {
+	var seen PeerCredentials
+	admin := &AdminContext{
+		Timeout: time.Millisecond * 100,
+		Handler: func(creds PeerCredentials, parse func(interface{}) error) (interface{}, error) {
+			ss := &SendStruct{}
+			if err := parse(ss); err != nil {
+				return nil, err
+			}
+			seen = creds
+			return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+		},
+		Authorize: AllowOwnerAndRoot,
+		Codecs:    []Codec{JSONCodec, GobCodec},
+	}
+	socket, stop := startAdmin(t, admin)
+	defer stop()
+
+	conn := ConnectAdmin(socket, []Codec{GobCodec}, time.Millisecond*100)
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
+		t.Error("mismatched response from server:", rs)
+	}
+	if seen.PID != int32(os.Getpid()) || seen.UID != uint32(os.Getuid()) || seen.GID != uint32(os.Getgid()) {
+		t.Error("wrong credentials:", seen)
+	}
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	admin := &AdminContext{
+		Timeout: time.Millisecond * 100,
+		Handler: func(creds PeerCredentials, parse func(interface{}) error) (interface{}, error) {
+			t.Error("should not be here")
+			return nil, errors.New("should not be here")
+		},
+		Authorize: func(creds PeerCredentials) error {
+			return errors.New("nobody is allowed")
+		},
+	}
+	socket, stop := startAdmin(t, admin)
+	defer stop()
+
+	conn := ConnectAdmin(socket, nil, time.Millisecond*100)
+	err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, &RecvStruct{})
+	if err == nil {
+		t.Error("should have been an error")
+	}
+}
+
+func TestAdminSlowAuthorize(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	admin := &AdminContext{
+		Timeout: time.Second,
+		Handler: func(creds PeerCredentials, parse func(interface{}) error) (interface{}, error) {
+			ss := &SendStruct{}
+			if err := parse(ss); err != nil {
+				return nil, err
+			}
+			return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+		},
+		Authorize: func(creds PeerCredentials) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				// the first connection is held up, as if looking up its groups took a while
+				<-release
+			}
+			return nil
+		},
+	}
+	socket, stop := startAdmin(t, admin)
+	defer stop()
+
+	slow := ConnectAdmin(socket, nil, time.Second)
+	done := make(chan error)
+	go func() {
+		done <- slow.Send(SendStruct{ABC: 1}, &RecvStruct{})
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fast := ConnectAdmin(socket, nil, time.Second)
+	for i := 0; i < 2; i++ {
+		if err := fast.Send(SendStruct{ABC: 2}, &RecvStruct{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	// once for each connection, not for each request
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected two authorizations, not %d", calls)
+	}
+}
+
+func TestAdminRequiresAuthorize(t *testing.T) {
+	admin := &AdminContext{}
+	_, _, err := admin.StartServe("/nonexistent/admin.sock")
+	testutil.CheckError(t, err, "admin socket requires an Authorize function")
+}
+
+func TestAllowOwnerAndRoot(t *testing.T) {
+	if AllowOwnerAndRoot(PeerCredentials{UID: 0}) != nil {
+		t.Error("root should be allowed")
+	}
+	if AllowOwnerAndRoot(PeerCredentials{UID: uint32(os.Getuid())}) != nil {
+		t.Error("owner should be allowed")
+	}
+	if os.Getuid() != 12345 && AllowOwnerAndRoot(PeerCredentials{UID: 12345}) == nil {
+		t.Error("others should not be allowed")
+	}
+}
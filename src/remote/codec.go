@@ -0,0 +1,180 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// A Codec converts between Go values and the bytes transmitted over the network. Each Codec is identified by the MIME
+// type it places in the Content-Type and Accept headers, which is how the two ends of a request agree on an encoding.
+type Codec interface {
+	ContentType() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := gob.NewEncoder(buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// JSONCodec encodes values with encoding/json. It is the default when a LocalContext does not specify any Codecs, and
+// is assumed for any request that does not say otherwise.
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec encodes values with encoding/gob. It is much more compact than JSON for large maps of keys, and faster to
+// decode, but can only be spoken by other Go programs.
+var GobCodec Codec = gobCodec{}
+
+// A codecList is the set of codecs supported by one end of a connection, in order of preference.
+type codecList []Codec
+
+func (manager *LocalContext) codecs() codecList {
+	return defaultCodecs(manager.Codecs)
+}
+
+func defaultCodecs(codecs []Codec) codecList {
+	if len(codecs) == 0 {
+		return codecList{JSONCodec}
+	}
+	return codecs
+}
+
+// codecFor finds the supported codec matching a Content-Type header, or nil if there is none. An empty header is
+// treated as JSON, because that was the only encoding before negotiation existed.
+func (codecs codecList) codecFor(contentType string) Codec {
+	if contentType == "" {
+		contentType = JSONCodec.ContentType()
+	}
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, codec := range codecs {
+		if codec.ContentType() == mediatype {
+			return codec
+		}
+	}
+	return nil
+}
+
+// acceptHeader lists the supported codecs, in order of preference, for use in an Accept header.
+func (codecs codecList) acceptHeader() string {
+	types := []string{}
+	for _, codec := range codecs {
+		types = append(types, codec.ContentType())
+	}
+	return strings.Join(types, ", ")
+}
+
+// parseAccept splits an Accept header into the media types that it accepts, in order of preference, and those that it
+// refuses with an explicit q=0. Other quality values are ignored.
+func parseAccept(accept string) ([]string, map[string]bool) {
+	acceptable := []string{}
+	refused := map[string]bool{}
+	for _, option := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(option))
+		if err != nil {
+			continue
+		}
+		if quality, found := params["q"]; found {
+			if q, err := strconv.ParseFloat(quality, 64); err == nil && q == 0 {
+				refused[mediatype] = true
+				continue
+			}
+		}
+		acceptable = append(acceptable, mediatype)
+	}
+	return acceptable, refused
+}
+
+// negotiateCodec picks the codec to use for a response, given the Accept header of the request. The requester's order
+// of preference is respected, and quality values are otherwise ignored, except that an explicit q=0 is honored as a
+// refusal. Returns nil if no supported codec is acceptable.
+func (codecs codecList) negotiateCodec(accept string) Codec {
+	if accept == "" {
+		return codecs.codecFor("")
+	}
+	acceptable, refused := parseAccept(accept)
+	for _, mediatype := range acceptable {
+		if mediatype == "*/*" {
+			for _, codec := range codecs {
+				if !refused[codec.ContentType()] {
+					return codec
+				}
+			}
+			return nil
+		}
+		if codec := codecs.codecFor(mediatype); codec != nil && !refused[mediatype] {
+			return codec
+		}
+	}
+	return nil
+}
+
+// requestCodec picks the codec with which to encode a request, given the index, plus one, of the most preferred local
+// codec that the peer is known to accept, or 0 if that isn't known yet. Until it is, JSON is used if possible, because
+// every peer understands it.
+func (codecs codecList) requestCodec(known int32) Codec {
+	if known > 0 && int(known) <= len(codecs) {
+		return codecs[known-1]
+	}
+	if codec := codecs.codecFor(""); codec != nil {
+		return codec
+	}
+	return codecs[0]
+}
+
+// acceptedIndex finds the most preferred local codec that a peer accepts, according to the Accept header of its
+// response, or to the Content-Type of the response if it didn't send an Accept header. Returns -1 if there is none.
+func (codecs codecList) acceptedIndex(accept string, contentType string) int {
+	if accept == "" {
+		if contentType == "" {
+			return -1
+		}
+		accept = contentType
+	}
+	acceptable, refused := parseAccept(accept)
+	for i, codec := range codecs {
+		if refused[codec.ContentType()] {
+			continue
+		}
+		for _, mediatype := range acceptable {
+			if mediatype == codec.ContentType() || mediatype == "*/*" {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,106 @@
+package remote
+
+import "testing"
+
+func TestCodecFor(t *testing.T) {
+	manager := &LocalContext{Codecs: []Codec{GobCodec, JSONCodec}}
+	if manager.codecs().codecFor("application/json; charset=utf-8") != JSONCodec {
+		t.Error("expected json codec")
+	}
+	if manager.codecs().codecFor("application/x-gob") != GobCodec {
+		t.Error("expected gob codec")
+	}
+	if manager.codecs().codecFor("") != JSONCodec {
+		t.Error("expected json codec by default")
+	}
+	if manager.codecs().codecFor("text/plain") != nil {
+		t.Error("expected no codec")
+	}
+}
+
+func TestCodecFor_DefaultsToJSON(t *testing.T) {
+	manager := &LocalContext{}
+	if manager.codecs().codecFor("application/json") != JSONCodec {
+		t.Error("expected json codec")
+	}
+	if manager.codecs().codecFor("application/x-gob") != nil {
+		t.Error("gob should not be supported unless requested")
+	}
+	if manager.codecs().acceptHeader() != "application/json" {
+		t.Error("wrong accept header:", manager.codecs().acceptHeader())
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	manager := &LocalContext{Codecs: []Codec{JSONCodec, GobCodec}}
+	if manager.codecs().negotiateCodec("application/x-gob, application/json") != GobCodec {
+		t.Error("should respect the requester's preference")
+	}
+	if manager.codecs().negotiateCodec("text/html, application/json;q=0.5") != JSONCodec {
+		t.Error("should skip unsupported types")
+	}
+	if manager.codecs().negotiateCodec("") != JSONCodec {
+		t.Error("should fall back to json")
+	}
+	if manager.codecs().negotiateCodec("*/*") != JSONCodec {
+		t.Error("should pick own preference for wildcard")
+	}
+	if manager.codecs().negotiateCodec("text/html") != nil {
+		t.Error("should find nothing acceptable")
+	}
+	if manager.codecs().negotiateCodec("application/json;q=0") != nil {
+		t.Error("should honor q=0 as a refusal")
+	}
+	if manager.codecs().negotiateCodec("application/json; q=0.0, application/x-gob;q=0.1") != GobCodec {
+		t.Error("should skip refused types")
+	}
+	if manager.codecs().negotiateCodec("*/*, application/json;q=0") != GobCodec {
+		t.Error("should not pick a refused type for wildcard")
+	}
+}
+
+func TestRequestCodec(t *testing.T) {
+	codecs := defaultCodecs([]Codec{GobCodec, JSONCodec})
+	if codecs.requestCodec(0) != JSONCodec {
+		t.Error("should send json until the peer says otherwise")
+	}
+	if codecs.requestCodec(1) != GobCodec {
+		t.Error("should send the codec that the peer accepts")
+	}
+	if defaultCodecs([]Codec{GobCodec}).requestCodec(0) != GobCodec {
+		t.Error("should use the only codec available")
+	}
+}
+
+func TestAcceptedIndex(t *testing.T) {
+	codecs := defaultCodecs([]Codec{GobCodec, JSONCodec})
+	if codecs.acceptedIndex("application/json, application/x-gob", "application/json") != 0 {
+		t.Error("should follow the local preference")
+	}
+	if codecs.acceptedIndex("application/json", "application/json") != 1 {
+		t.Error("should only pick codecs that the peer accepts")
+	}
+	if codecs.acceptedIndex("", "application/x-gob") != 0 {
+		t.Error("should learn from the content type without an accept header")
+	}
+	if codecs.acceptedIndex("application/x-gob;q=0, */*", "application/json") != 1 {
+		t.Error("should honor q=0 as a refusal")
+	}
+	if codecs.acceptedIndex("", "") != -1 || codecs.acceptedIndex("text/html", "text/html") != -1 {
+		t.Error("should find nothing acceptable")
+	}
+}
+
+func TestGobCodec_RoundTrip(t *testing.T) {
+	data, err := GobCodec.Marshal(map[string]string{"a": "key-a", "b": "key-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]string{}
+	if err := GobCodec.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result["a"] != "key-a" || result["b"] != "key-b" {
+		t.Error("mismatched result:", result)
+	}
+}
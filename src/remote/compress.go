@@ -0,0 +1,82 @@
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// the largest body that either end will accept, both as sent and once decompressed, so that a small compressed body
+// can't exhaust memory when it is expanded
+const MAX_BODY_SIZE = 16 * 1024 * 1024
+
+// compressBody gzips an encoded request or response body.
+func compressBody(data []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decompressBody reverses compressBody, according to the Content-Encoding header that came with the body.
+func decompressBody(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		result, err := ioutil.ReadAll(io.LimitReader(reader, MAX_BODY_SIZE+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(result) > MAX_BODY_SIZE {
+			return nil, errBodyTooLarge
+		}
+		return result, reader.Close()
+	default:
+		return nil, unsupportedEncodingError(encoding)
+	}
+}
+
+var errBodyTooLarge = errors.New("body is too large")
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return "unsupported content encoding: " + string(e)
+}
+
+// acceptsGzip checks whether an Accept-Encoding header allows gzip. Quality values are ignored, except that an explicit
+// q=0 is honored as a refusal.
+func acceptsGzip(header string) bool {
+	for _, option := range strings.Split(header, ",") {
+		parts := strings.Split(option, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// shouldCompress decides whether a body of this length is worth compressing, given a CompressionThreshold.
+func shouldCompress(threshold int, length int) bool {
+	return threshold > 0 && length >= threshold
+}
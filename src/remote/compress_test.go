@@ -0,0 +1,195 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"util/testutil"
+)
+
+func TestCompressBody_RoundTrip(t *testing.T) {
+	original := bytes.Repeat([]byte("faraday cage "), 100)
+	compressed, err := compressBody(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(original) {
+		t.Error("repetitive data should have gotten smaller")
+	}
+	result, err := decompressBody(compressed, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original, result) {
+		t.Error("mismatched result after decompression")
+	}
+}
+
+func TestDecompressBody_Identity(t *testing.T) {
+	result, err := decompressBody([]byte("plain"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "plain" {
+		t.Error("should have been unchanged")
+	}
+}
+
+func TestDecompressBody_Unsupported(t *testing.T) {
+	_, err := decompressBody([]byte("plain"), "br")
+	testutil.CheckError(t, err, "unsupported content encoding: br")
+}
+
+func TestDecompressBody_Corrupt(t *testing.T) {
+	_, err := decompressBody([]byte("this is certainly not gzipped data"), "gzip")
+	testutil.CheckError(t, err, "gzip")
+}
+
+func TestDecompressBody_TooLarge(t *testing.T) {
+	compressed, err := compressBody(make([]byte, MAX_BODY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := decompressBody(compressed, "gzip"); err != nil || len(result) != MAX_BODY_SIZE {
+		t.Errorf("a body of exactly the limit should be accepted: %v", err)
+	}
+	// a few kilobytes that would expand past the limit
+	compressed, err = compressBody(make([]byte, MAX_BODY_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decompressBody(compressed, "gzip")
+	testutil.CheckError(t, err, "too large")
+}
+
+func serveTestBody(body []byte, content_encoding string) int {
+	request := httptest.NewRequest("POST", "/faraday", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Encoding", content_encoding)
+	recorder := httptest.NewRecorder()
+	serveEncoded(recorder, request, encoding{codecs: defaultCodecs(nil)}, "test", func(parse func(interface{}) error) (interface{}, error) {
+		var value interface{}
+		if err := parse(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+	return recorder.Code
+}
+
+func TestServeEncoded_TooLarge(t *testing.T) {
+	if code := serveTestBody([]byte("{}"), ""); code != 200 {
+		t.Errorf("small request failed: %d", code)
+	}
+	if code := serveTestBody(make([]byte, MAX_BODY_SIZE+1), ""); code != 413 {
+		t.Errorf("oversized request should have been refused: %d", code)
+	}
+	bomb, err := compressBody(make([]byte, MAX_BODY_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serveTestBody(bomb, "gzip"); code != 413 {
+		t.Errorf("oversized request should have been refused once decompressed: %d", code)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, gzip":      true,
+		"gzip;q=0.5":         true,
+		"gzip; q=0":          false,
+		"gzip;q=0.000":       false,
+		"identity, deflate":  false,
+		"x-gzip, identity":   false,
+		" gzip ;q=1, br;q=0": true,
+	} {
+		if acceptsGzip(header) != expected {
+			t.Errorf("wrong result for %q", header)
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	if shouldCompress(0, 1000000) {
+		t.Error("compression should be disabled by default")
+	}
+	if shouldCompress(1024, 1023) {
+		t.Error("should not compress below the threshold")
+	}
+	if !shouldCompress(1024, 1024) {
+		t.Error("should compress at the threshold")
+	}
+}
+
+// a snapshot comparable to what farad sends after a restart of a large cluster
+func syntheticSnapshot(b *testing.B, members int) map[string]string {
+	snapshot := map[string]string{}
+	key := make([]byte, 32)
+	for i := 0; i < members; i++ {
+		if _, err := rand.Read(key); err != nil {
+			b.Fatal(err)
+		}
+		snapshot[fmt.Sprintf("node-%04d.storage.cluster", i)] = base64.StdEncoding.EncodeToString(key)
+	}
+	return snapshot
+}
+
+// benchmarkSnapshot measures a full encode, transfer and decode of a 2,000-member snapshot, and reports how large the
+// body was on the wire.
+func benchmarkSnapshot(b *testing.B, codec Codec, compress bool) {
+	snapshot := syntheticSnapshot(b, 2000)
+	data, err := codec.Marshal(snapshot)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if compress {
+		data, err = compressBody(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Logf("%d bytes on the wire", len(data))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := codec.Marshal(snapshot)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if compress {
+			data, err = compressBody(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			data, err = decompressBody(data, "gzip")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		result := map[string]string{}
+		if err := codec.Unmarshal(data, &result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSnapshot_JSON(b *testing.B) {
+	benchmarkSnapshot(b, JSONCodec, false)
+}
+
+func BenchmarkSnapshot_JSON_Gzip(b *testing.B) {
+	benchmarkSnapshot(b, JSONCodec, true)
+}
+
+func BenchmarkSnapshot_Gob(b *testing.B) {
+	benchmarkSnapshot(b, GobCodec, false)
+}
+
+func BenchmarkSnapshot_Gob_Gzip(b *testing.B) {
+	benchmarkSnapshot(b, GobCodec, true)
+}
@@ -0,0 +1,223 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// An encoding is how one end of a connection encodes the bodies that it sends, and decodes the bodies that it receives.
+// It is shared between the TLS transport and the admin transport.
+type encoding struct {
+	codecs    codecList
+	threshold int
+}
+
+func (manager *LocalContext) encoding() encoding {
+	return encoding{manager.codecs(), manager.CompressionThreshold}
+}
+
+// postEncoded encodes the message with the codec, compresses it if the peer has said that it accepts that, and posts
+// it with the specified client.
+func postEncoded(client *http.Client, url string, enc encoding, peerAcceptsGzip *int32, codec Codec, message interface{}) (*http.Response, error) {
+	reqbody, err := codec.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("while marshalling request: %s", err.Error())
+	}
+	compressed := false
+	if shouldCompress(enc.threshold, len(reqbody)) && atomic.LoadInt32(peerAcceptsGzip) != 0 {
+		reqbody, err = compressBody(reqbody)
+		if err != nil {
+			return nil, fmt.Errorf("while compressing request: %s", err.Error())
+		}
+		compressed = true
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(reqbody))
+	if err != nil {
+		return nil, fmt.Errorf("while preparing request: %s", err.Error())
+	}
+	request.Header.Set("Content-Type", codec.ContentType())
+	request.Header.Set("Accept", enc.codecs.acceptHeader())
+	request.Header.Set("Accept-Encoding", "gzip")
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("while processing request: %s", err.Error())
+	}
+	return response, nil
+}
+
+// sendEncoded performs a single request with the specified client, encoding the message and decoding the result.
+// peerAcceptsGzip tracks whether the other end has said it can receive compressed requests, and peerCodec tracks which
+// of the local codecs it has said it can receive, as understood by requestCodec. verify is called on the response
+// before its body is used, to check who sent it.
+func sendEncoded(client *http.Client, url string, enc encoding, peerAcceptsGzip *int32, peerCodec *int32, message interface{}, result interface{}, verify func(*http.Response) error) error {
+	codec := enc.codecs.requestCodec(atomic.LoadInt32(peerCodec))
+	response, err := postEncoded(client, url, enc, peerAcceptsGzip, codec, message)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == 415 {
+		// the peer might have been replaced by one that doesn't support what it used to, so start over, and try once
+		// more with the defaults if they are any different
+		atomic.StoreInt32(peerCodec, 0)
+		used_gzip := atomic.SwapInt32(peerAcceptsGzip, 0) != 0
+		if fallback := enc.codecs.requestCodec(0); fallback != codec || used_gzip {
+			response.Body.Close()
+			response, err = postEncoded(client, url, enc, peerAcceptsGzip, fallback, message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	if err := verify(response); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, MAX_BODY_SIZE+1))
+	if err != nil {
+		return fmt.Errorf("while receiving response: %s", err.Error())
+	}
+	if len(body) > MAX_BODY_SIZE {
+		response.Body.Close()
+		return fmt.Errorf("while receiving response: %s", errBodyTooLarge.Error())
+	}
+	err = response.Body.Close()
+	if err != nil {
+		return fmt.Errorf("while closing connection: %s", err.Error())
+	}
+	if acceptsGzip(response.Header.Get("Accept-Encoding")) {
+		atomic.StoreInt32(peerAcceptsGzip, 1)
+	}
+	if index := enc.codecs.acceptedIndex(response.Header.Get("Accept"), response.Header.Get("Content-Type")); index >= 0 {
+		atomic.StoreInt32(peerCodec, int32(index+1))
+	}
+	body, err = decompressBody(body, response.Header.Get("Content-Encoding"))
+	if err != nil {
+		return fmt.Errorf("while decompressing response: %s", err.Error())
+	}
+	codec = enc.codecs.codecFor(response.Header.Get("Content-Type"))
+	if codec == nil {
+		return fmt.Errorf("unsupported content type in response: %s", response.Header.Get("Content-Type"))
+	}
+	err = codec.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("while unmarshalling response: %s", err.Error())
+	}
+	return nil
+}
+
+// serveEncoded handles a single request that has already been authenticated, decoding the request body for handle and
+// encoding its result. requester is only used for logging.
+func serveEncoded(writer http.ResponseWriter, request *http.Request, enc encoding, requester string, handle func(parse func(interface{}) error) (interface{}, error)) {
+	// let the requester know that it may compress future requests, and which codecs it may use for them
+	writer.Header().Set("Accept-Encoding", "gzip")
+	writer.Header().Set("Accept", enc.codecs.acceptHeader())
+	incoming := enc.codecs.codecFor(request.Header.Get("Content-Type"))
+	if incoming == nil {
+		http.Error(writer, "unsupported content type", 415)
+		return
+	}
+	outgoing := enc.codecs.negotiateCodec(request.Header.Get("Accept"))
+	if outgoing == nil {
+		http.Error(writer, "no acceptable content type", 406)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MAX_BODY_SIZE))
+	if err != nil && len(data) >= MAX_BODY_SIZE {
+		http.Error(writer, "request too large", 413)
+		return
+	} else if err != nil {
+		http.Error(writer, "failed to read data", 400)
+		return
+	}
+	data, err = decompressBody(data, request.Header.Get("Content-Encoding"))
+	if _, ok := err.(unsupportedEncodingError); ok {
+		http.Error(writer, "unsupported content encoding", 415)
+		return
+	} else if err == errBodyTooLarge {
+		http.Error(writer, "request too large", 413)
+		return
+	} else if err != nil {
+		http.Error(writer, "failed to decompress data", 400)
+		return
+	}
+	result, err := handle(func(output interface{}) error {
+		return incoming.Unmarshal(data, output)
+	})
+	if err != nil {
+		log.Println("Failed:", err, "during request from", requester)
+		http.Error(writer, "request failed", 500)
+		return
+	}
+	to_write, err := outgoing.Marshal(result)
+	if err != nil {
+		http.Error(writer, "failed to write data", 500)
+		return
+	}
+	if shouldCompress(enc.threshold, len(to_write)) && acceptsGzip(request.Header.Get("Accept-Encoding")) {
+		to_write, err = compressBody(to_write)
+		if err != nil {
+			http.Error(writer, "failed to write data", 500)
+			return
+		}
+		writer.Header().Set("Content-Encoding", "gzip")
+	}
+	writer.Header().Set("Content-Type", outgoing.ContentType())
+	writer.Write(to_write) // TODO: do I need to handle errors from this? does it matter?
+}
+
+// serveOn runs the server on each of the listeners, which should already be wrapped as needed, and returns the stop
+// function and exit channel described by ServeListeners.
+func serveOn(server *http.Server, listeners []net.Listener) (func(deadline time.Duration) error, chan error) {
+	results := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			err := server.Serve(ln)
+			if err == http.ErrServerClosed {
+				err = nil
+			} else {
+				// don't keep serving on only some of the addresses
+				server.Close()
+			}
+			results <- err
+		}(ln)
+	}
+
+	// buffered so that the serving goroutine can exit even if nobody is waiting for the result
+	cherr := make(chan error, 1)
+
+	go func() {
+		var first error
+		for range listeners {
+			if err := <-results; err != nil && first == nil {
+				first = err
+			}
+		}
+		cherr <- first
+	}()
+
+	stop := func(deadline time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("while draining connections: %s", err.Error())
+		}
+		return nil
+	}
+
+	return stop, cherr
+}
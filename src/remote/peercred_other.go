@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package remote
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,172 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A PrincipalExtractor determines the principal of a remote system from the leaf certificate that it authenticated
+// with. It is only ever called on certificates that have already been verified against the trusted authorities.
+type PrincipalExtractor func(cert *x509.Certificate) (string, error)
+
+// CommonNamePrincipal uses the CommonName of the certificate subject as the principal. This is the default.
+func CommonNamePrincipal(cert *x509.Certificate) (string, error) {
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("certificate has no common name")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// DNSPrincipal uses the first DNS name in the subject alternative names of the certificate as the principal.
+func DNSPrincipal(cert *x509.Certificate) (string, error) {
+	if len(cert.DNSNames) == 0 {
+		return "", errors.New("certificate has no DNS names")
+	}
+	return cert.DNSNames[0], nil
+}
+
+// URIPrincipal finds the URI in the subject alternative names of the certificate that starts with 'prefix', and uses
+// the remainder of the URI as the principal. For example, with a prefix of "spiffe://cluster/node/", a certificate for
+// "spiffe://cluster/node/x" has the principal "x". Exactly one URI may match, so that the principal is never ambiguous.
+func URIPrincipal(prefix string) PrincipalExtractor {
+	return func(cert *x509.Certificate) (string, error) {
+		principal := ""
+		found := false
+		for _, uri := range cert.URIs {
+			text := uri.String()
+			if !strings.HasPrefix(text, prefix) {
+				continue
+			}
+			if found {
+				return "", fmt.Errorf("certificate has more than one URI with prefix %q", prefix)
+			}
+			principal, found = text[len(prefix):], true
+		}
+		if !found || principal == "" {
+			return "", fmt.Errorf("certificate has no URI with prefix %q", prefix)
+		}
+		return principal, nil
+	}
+}
+
+// ExtensionPrincipal uses the string stored in the certificate extension identified by 'oid' as the principal. The
+// extension value must be a single ASN.1 string, such as a UTF8String.
+func ExtensionPrincipal(oid asn1.ObjectIdentifier) PrincipalExtractor {
+	return func(cert *x509.Certificate) (string, error) {
+		for _, ext := range cert.Extensions {
+			if !ext.Id.Equal(oid) {
+				continue
+			}
+			var principal string
+			rest, err := asn1.Unmarshal(ext.Value, &principal)
+			if err != nil {
+				return "", fmt.Errorf("while parsing principal extension %s: %s", oid, err.Error())
+			}
+			if len(rest) > 0 {
+				return "", fmt.Errorf("trailing data in principal extension %s", oid)
+			}
+			if principal == "" {
+				return "", fmt.Errorf("empty principal in extension %s", oid)
+			}
+			return principal, nil
+		}
+		return "", fmt.Errorf("certificate has no principal extension %s", oid)
+	}
+}
+
+// ParsePrincipalExtractor converts a textual description of a PrincipalExtractor, as might be passed on a command line,
+// into the extractor itself. The options are "cn", "dns", "uri:<prefix>", and "oid:<dotted-oid>".
+func ParsePrincipalExtractor(spec string) (PrincipalExtractor, error) {
+	switch {
+	case spec == "cn":
+		return CommonNamePrincipal, nil
+	case spec == "dns":
+		return DNSPrincipal, nil
+	case strings.HasPrefix(spec, "uri:"):
+		return URIPrincipal(spec[len("uri:"):]), nil
+	case strings.HasPrefix(spec, "oid:"):
+		oid, err := ParseObjectIdentifier(spec[len("oid:"):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid object identifier in principal spec %q", spec)
+		}
+		return ExtensionPrincipal(oid), nil
+	default:
+		return nil, fmt.Errorf("unknown principal spec %q", spec)
+	}
+}
+
+// ParseObjectIdentifier converts an object identifier in dotted form, such as "1.3.6.1.4.1.99999.1", into its parts.
+func ParseObjectIdentifier(text string) (asn1.ObjectIdentifier, error) {
+	oid := asn1.ObjectIdentifier{}
+	for _, part := range strings.Split(text, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid object identifier %q", text)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid object identifier %q", text)
+	}
+	return oid, nil
+}
+
+func (manager *LocalContext) principalOf(cert *x509.Certificate) (string, error) {
+	if manager.Principal == nil {
+		return CommonNamePrincipal(cert)
+	}
+	return manager.Principal(cert)
+}
+
+// A PrincipalConstraint limits the principals that may be claimed by certificates issued through a particular
+// authority, which may be either a root or an intermediate. For example, a sub-CA for rack 3 might only be allowed to
+// issue principals matching "rack3-*". Standard X.509 name constraints can't express this when principals aren't
+// DNS names or URIs, such as when they are taken from the CommonName.
+type PrincipalConstraint struct {
+	Authority *x509.Certificate
+	// Patterns, in the syntax of path.Match, of which the principal must match at least one.
+	Allowed []string
+}
+
+func (constraint PrincipalConstraint) appliesTo(cert *x509.Certificate) bool {
+	// compare by name and key, rather than raw bytes, so that a reissued authority certificate is still constrained
+	return bytes.Equal(constraint.Authority.RawSubject, cert.RawSubject) &&
+		bytes.Equal(constraint.Authority.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo)
+}
+
+func (constraint PrincipalConstraint) allows(principal string) bool {
+	for _, pattern := range constraint.Allowed {
+		if matched, err := path.Match(pattern, principal); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrincipalConstraints makes sure that at least one of the verified chains is allowed to issue the principal:
+// every authority along that chain must either be unconstrained, or allow the principal.
+func checkPrincipalConstraints(constraints []PrincipalConstraint, principal string, chains [][]*x509.Certificate) error {
+	if len(constraints) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		permitted := true
+		for _, authority := range chain[1:] {
+			for _, constraint := range constraints {
+				if constraint.appliesTo(authority) && !constraint.allows(principal) {
+					permitted = false
+				}
+			}
+		}
+		if permitted {
+			return nil
+		}
+	}
+	return fmt.Errorf("principal %q may not be issued by its certificate authority", principal)
+}
@@ -0,0 +1,227 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+func mustParseURIs(t *testing.T, uris ...string) []*url.URL {
+	result := []*url.URL{}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, parsed)
+	}
+	return result
+}
+
+func TestCommonNamePrincipal(t *testing.T) {
+	principal, err := CommonNamePrincipal(&x509.Certificate{Subject: pkix.Name{CommonName: "node-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "node-a" {
+		t.Error("wrong principal:", principal)
+	}
+	_, err = CommonNamePrincipal(&x509.Certificate{})
+	testutil.CheckError(t, err, "no common name")
+}
+
+func TestDNSPrincipal(t *testing.T) {
+	principal, err := DNSPrincipal(&x509.Certificate{DNSNames: []string{"a.example.com", "b.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "a.example.com" {
+		t.Error("wrong principal:", principal)
+	}
+	_, err = DNSPrincipal(&x509.Certificate{Subject: pkix.Name{CommonName: "node-a"}})
+	testutil.CheckError(t, err, "no DNS names")
+}
+
+func TestURIPrincipal(t *testing.T) {
+	extract := URIPrincipal("spiffe://cluster/node/")
+	principal, err := extract(&x509.Certificate{URIs: mustParseURIs(t, "https://example.com/", "spiffe://cluster/node/x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "x" {
+		t.Error("wrong principal:", principal)
+	}
+	_, err = extract(&x509.Certificate{URIs: mustParseURIs(t, "spiffe://other/node/x")})
+	testutil.CheckError(t, err, "no URI with prefix")
+	_, err = extract(&x509.Certificate{URIs: mustParseURIs(t, "spiffe://cluster/node/")})
+	testutil.CheckError(t, err, "no URI with prefix")
+	_, err = extract(&x509.Certificate{URIs: mustParseURIs(t, "spiffe://cluster/node/x", "spiffe://cluster/node/y")})
+	testutil.CheckError(t, err, "more than one URI")
+}
+
+func TestExtensionPrincipal(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	value, err := asn1.MarshalWithParams("node-a", "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := ExtensionPrincipal(oid)
+	principal, err := extract(&x509.Certificate{Extensions: []pkix.Extension{{Id: oid, Value: value}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal != "node-a" {
+		t.Error("wrong principal:", principal)
+	}
+	_, err = extract(&x509.Certificate{})
+	testutil.CheckError(t, err, "no principal extension 1.3.6.1.4.1.99999.1")
+	_, err = extract(&x509.Certificate{Extensions: []pkix.Extension{{Id: oid, Value: []byte{0xff}}}})
+	testutil.CheckError(t, err, "while parsing principal extension")
+}
+
+func TestParsePrincipalExtractor(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "by-cn"},
+		DNSNames: []string{"by-dns"},
+		URIs:     mustParseURIs(t, "spiffe://cluster/node/by-uri"),
+	}
+	for spec, expected := range map[string]string{
+		"cn":                         "by-cn",
+		"dns":                        "by-dns",
+		"uri:spiffe://cluster/":      "node/by-uri",
+		"uri:spiffe://cluster/node/": "by-uri",
+	} {
+		extract, err := ParsePrincipalExtractor(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		principal, err := extract(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if principal != expected {
+			t.Errorf("wrong principal for %s: %s", spec, principal)
+		}
+	}
+	if _, err := ParsePrincipalExtractor("oid:1.3.6.1.4.1.99999.1"); err != nil {
+		t.Error(err)
+	}
+	_, err := ParsePrincipalExtractor("oid:1.three")
+	testutil.CheckError(t, err, "invalid object identifier")
+	_, err = ParsePrincipalExtractor("oid:1")
+	testutil.CheckError(t, err, "invalid object identifier")
+	_, err = ParsePrincipalExtractor("serial")
+	testutil.CheckError(t, err, "unknown principal spec")
+}
+
+func TestEndToEnd_URIPrincipal(t *testing.T) {
+	withURI := func(uri string) func(*x509.Certificate) {
+		return func(certTemplate *x509.Certificate) {
+			certTemplate.URIs = mustParseURIs(t, uri)
+		}
+	}
+	// the common names are deliberately misleading, to make sure that they aren't used
+	akey, acert := testkeyutil.GenerateTLSKeypairForTests_Customized(t, "node-b", []string{"localhost"}, nil, nil, nil, withURI("spiffe://cluster/node/a"))
+	bkey, bcert := testkeyutil.GenerateTLSKeypairForTests_Customized(t, "node-a", []string{"localhost"}, nil, nil, nil, withURI("spiffe://cluster/node/b"))
+	pool := x509.NewCertPool()
+	pool.AddCert(acert)
+	pool.AddCert(bcert)
+
+	seen := ""
+	a := LocalContext{
+		Timeout:   time.Millisecond * 100,
+		LocalCert: tls.Certificate{Certificate: [][]byte{acert.Raw}, PrivateKey: akey},
+		RootCA:    pool,
+		Principal: URIPrincipal("spiffe://cluster/node/"),
+		Handler: func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+			seen = remote_principal
+			return &RecvStruct{}, nil
+		},
+	}
+	b := LocalContext{
+		Timeout:   time.Millisecond * 100,
+		LocalCert: tls.Certificate{Certificate: [][]byte{bcert.Raw}, PrivateKey: bkey},
+		RootCA:    pool,
+		Principal: URIPrincipal("spiffe://cluster/node/"),
+		Handler: func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+			t.Error("should not be here")
+			return nil, errors.New("should not be here")
+		},
+	}
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn := b.ConnectRemote("node-b", "localhost:1836")
+	err = conn.Send(SendStruct{}, &RecvStruct{})
+	testutil.CheckError(t, err, "mismatched principal while receiving response: \"a\" instead of \"node-b\"")
+
+	conn = b.ConnectRemote("a", "localhost:1836")
+	if err := conn.Send(SendStruct{}, &RecvStruct{}); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "b" {
+		t.Error("wrong principal seen by server:", seen)
+	}
+}
+
+func TestCheckPrincipalConstraints(t *testing.T) {
+	_, root := testkeyutil.GenerateTLSKeypairForTests(t, "root", nil, nil, nil, nil)
+	_, rack3 := testkeyutil.GenerateTLSKeypairForTests(t, "rack-3", nil, nil, nil, nil)
+	_, rack4 := testkeyutil.GenerateTLSKeypairForTests(t, "rack-4", nil, nil, nil, nil)
+	leaf := &x509.Certificate{}
+	constraints := []PrincipalConstraint{
+		{Authority: rack3, Allowed: []string{"rack3-*", "spare-?"}},
+		{Authority: rack4, Allowed: []string{"rack4-*"}},
+	}
+	throughRack3 := [][]*x509.Certificate{{leaf, rack3, root}}
+	for _, principal := range []string{"rack3-a", "rack3-", "spare-1"} {
+		if err := checkPrincipalConstraints(constraints, principal, throughRack3); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, principal := range []string{"rack4-a", "spare-10", "x-rack3-a"} {
+		err := checkPrincipalConstraints(constraints, principal, throughRack3)
+		testutil.CheckError(t, err, "may not be issued by its certificate authority")
+	}
+	// nested constraints must all be satisfied
+	err := checkPrincipalConstraints(constraints, "rack3-a", [][]*x509.Certificate{{leaf, rack3, rack4, root}})
+	testutil.CheckError(t, err, "may not be issued by its certificate authority")
+	// but any one chain is enough
+	if err := checkPrincipalConstraints(constraints, "rack4-a", [][]*x509.Certificate{{leaf, rack3, root}, {leaf, rack4, root}}); err != nil {
+		t.Error(err)
+	}
+	if err := checkPrincipalConstraints(nil, "anything", throughRack3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseObjectIdentifier(t *testing.T) {
+	oid, err := ParseObjectIdentifier("1.3.6.1.4.1.99999.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}) {
+		t.Errorf("wrong object identifier: %v", oid)
+	}
+	for _, invalid := range []string{"", "1", "1.three", "1.-2", "1..2"} {
+		_, err := ParseObjectIdentifier(invalid)
+		testutil.CheckError(t, err, "invalid object identifier")
+	}
+}
@@ -1,38 +1,48 @@
-// Package remote provides an abstraction for sending JSON objects over HTTPS within a network.
+// Package remote provides an abstraction for sending structured objects over HTTPS within a network. Objects are
+// encoded as JSON by default, or with another Codec agreed upon through the Content-Type and Accept headers.
 // To use it, construct an instance of LocalContext and call ConnectRemote or StartServe.
 package remote
 
 import (
-	"bytes"
-	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"time"
+	"util/sockutil"
 )
 
 // A RequestHandler is a function that can be used to handle incoming requests to a serving LocalContext. Data is
-// received in the form of a JSON object, and the RequestHandler retrieves this by calling parse on a prepared object,
-// which decodes the data into that object via json.Unmarshal. The result will be encoded with json.Marshal and
-// transmitted back to the requesting system. remote_principal is the CommonName on the TLS cert used by the remote
-// system to perform authentication. The data transferred to and from this function is both authenticated and
-// confidential, by the security properties of TLS.
-type RequestHandler func(remote_principal string, parse func(interface{}) error) (interface{}, error)
+// received in an encoded form, and the RequestHandler retrieves this by calling parse on a prepared object, which
+// decodes the data into that object with the Codec named by the request. The result will be encoded with the Codec
+// preferred by the requesting system, and transmitted back to it. remote_principal is the principal of the remote
+// system, as determined from its TLS certificate by the Principal of the LocalContext, and remote_cert is that
+// certificate, already verified. The data transferred to and from this function is both authenticated and confidential,
+// by the security properties of TLS.
+type RequestHandler func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error)
+
+// An EnrollHandler is a function that handles enrollment requests, which are how systems obtain their certificates. It
+// works just like a RequestHandler, except that the remote system might not have a certificate yet, in which case
+// remote_principal is empty and remote_cert is nil, and the request is only authenticated by whatever it contains. The
+// local system is still authenticated to the remote system by TLS, so the data transferred is confidential either way.
+type EnrollHandler func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error)
 
 // A Remote is a representation of a connection between the local system and a remote system. The existence of
 // a Remote does not imply that a TCP or HTTPS connection has actually been established.
 // Data can be transferred over a Remote by calling the Send() method.
 type Remote struct {
-	manager    *LocalContext
-	client     http.Client
-	expectedCN string
-	addr       string
+	manager           *LocalContext
+	client            http.Client
+	expectedPrincipal string
+	addr              string
+	// "/faraday" for normal requests, or "/enroll" for enrollment requests
+	path string
+	// set atomically to 1 once the remote system has advertised that it can receive gzipped requests
+	peerAcceptsGzip int32
+	// set atomically once the remote system has advertised which codecs it can receive, as understood by requestCodec
+	peerCodec int32
 }
 
 // A LocalContext is a representation of a local endpoint that can either handle requests from other systems, or
@@ -41,113 +51,229 @@ type Remote struct {
 // You should make sure to fill out all of the fields on a LocalContext, except perhaps Handler.
 type LocalContext struct {
 	// The pool of certificate authorities that this system accepts certificates from, both when connecting to other
-	// systems and when receiving requests from other systems.
+	// systems and when receiving requests from other systems, unless overridden by ClientCA or ServerCA.
 	RootCA *x509.CertPool
+	// The pool of certificate authorities trusted to issue certificates to systems that send requests to this system.
+	// If nil, RootCA is used.
+	ClientCA *x509.CertPool
+	// The pool of certificate authorities trusted to issue certificates to systems that this system sends requests to.
+	// If nil, RootCA is used.
+	ServerCA *x509.CertPool
+	// Intermediate certificates that may be used to complete the chain from another system's certificate to one of the
+	// trusted authorities, in addition to any intermediates that the other system presents itself. May be empty.
+	Intermediates []*x509.Certificate
 	// The certificate used to authenticate this local system to other systems, both when connecting to other systems
 	// and when receiving requests from other systems.
 	LocalCert tls.Certificate
 	// The handler used when a request is received from another system.
 	Handler RequestHandler
+	// The handler used when an enrollment request is received from another system. If nil, enrollment is disabled, and
+	// every system must present a certificate during the TLS handshake.
+	Enroll EnrollHandler
 	// The timeout used for all requests, in and out of the remote.
 	Timeout time.Duration
+	// The encodings that this system is willing to use, in order of preference. The first is used to encode outgoing
+	// requests. If empty, only JSONCodec is used.
+	Codecs []Codec
+	// Request and response bodies at least this many bytes long are compressed with gzip, if the other system accepts
+	// it. Large cluster snapshots compress well, but smaller messages aren't worth the CPU time. Zero disables
+	// compression of outgoing bodies; compressed incoming bodies are always accepted.
+	CompressionThreshold int
+	// How to determine the principal of another system from its TLS certificate, both when connecting to other systems
+	// and when receiving requests from other systems. If nil, CommonNamePrincipal is used.
+	Principal PrincipalExtractor
+	// Limits on which principals may be claimed by certificates issued through particular authorities. These apply in
+	// addition to any name constraints in the certificates themselves, which are always enforced.
+	PrincipalConstraints []PrincipalConstraint
 }
 
 // ConnectRemote prepares to connect to a particular remote system. 'remoteName' is the expected principal of the remote
-// system, as specified in the CommonName field of its TLS certificate, and 'addr' is the address (including port) at
-// which the remote system should be reachable. It returns a Remote object, which can be used to transfer
-// individual requests. Where possible, open HTTPS connections to the server will be reused, to avoid re-negotiating TLS
-// connections.
+// system, as determined from its TLS certificate by the Principal of the LocalContext, and 'addr' is the address
+// (including port) at which the remote system should be reachable. It returns a Remote object, which can be used to
+// transfer individual requests. Where possible, open HTTPS connections to the server will be reused, to avoid
+// re-negotiating TLS connections.
 //
 // Warning: successful return from this function does not imply that a connection has established; this is deferred
 // until the first actual message sent.
 func (manager *LocalContext) ConnectRemote(remoteName string, addr string) Remote {
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// let the connection attempt itself report the bad address
+		hostname = addr
+	}
 	client := http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
-				RootCAs:      manager.RootCA,
-				Certificates: []tls.Certificate{manager.LocalCert},
-				MinVersion:   tls.VersionTLS12,
+				// the standard verification can't use our configured intermediates, so verifyPeer does it instead
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: manager.verifyPeer(false, hostname),
+				Certificates:          []tls.Certificate{manager.LocalCert},
+				MinVersion:            tls.VersionTLS12,
 			},
 			DisableCompression: true,
 		},
 		Timeout: manager.Timeout,
 	}
-	return Remote{manager, client, remoteName, addr}
+	return Remote{manager, client, remoteName, addr, "/faraday", 0, 0}
 }
 
-func (manager *LocalContext) verifyTLS(tls *tls.ConnectionState, isclient bool) (string, error) {
-	if tls == nil || len(tls.VerifiedChains) == 0 || len(tls.VerifiedChains[0]) == 0 {
-		return "", errors.New("no certificate")
-	} else {
-		firstCert := tls.VerifiedChains[0][0]
-		// might be duplicate work, but this guarantees it's correct
-		var auth x509.ExtKeyUsage
-		if isclient {
-			auth = x509.ExtKeyUsageClientAuth
-		} else {
-			auth = x509.ExtKeyUsageServerAuth
-		}
-		chains, err := firstCert.Verify(x509.VerifyOptions{
-			Roots:     manager.RootCA,
-			KeyUsages: []x509.ExtKeyUsage{auth},
-		})
-		if err != nil || len(chains) == 0 {
-			return "", errors.New("no valid certificate")
-		} else {
-			return firstCert.Subject.CommonName, nil
-		}
+// ConnectEnrollment prepares to send enrollment requests to a remote system, which must have an EnrollHandler, in the
+// same way as ConnectRemote. The remote system is authenticated as usual. If the local system doesn't have a
+// certificate yet, LocalCert may be left empty, and requests are sent without one.
+func (manager *LocalContext) ConnectEnrollment(remoteName string, addr string) Remote {
+	conn := manager.ConnectRemote(remoteName, addr)
+	conn.path = "/enroll"
+	if len(manager.LocalCert.Certificate) == 0 {
+		conn.client.Transport.(*http.Transport).TLSClientConfig.Certificates = nil
 	}
+	return conn
 }
 
-// Send transmits an individual request across the network to this remote system. The specified message is encoded as a
-// JSON object with json.Marshal. The result of the request is decoded (with json.Unmarshal) into the result parameter.
-// The request will be handled by the RequestHandler on the remote end.
-// The data transmitted here is both authenticated and confidential, through the security properties of TLS.
-func (conn *Remote) Send(message interface{}, result interface{}) error {
-	reqbody, err := json.Marshal(message)
-	if err != nil {
-		return fmt.Errorf("while marshalling json for request: %s", err.Error())
+// trustedCA returns the pool of authorities trusted to issue certificates to clients, if isclient, or to servers.
+func (manager *LocalContext) trustedCA(isclient bool) *x509.CertPool {
+	if isclient && manager.ClientCA != nil {
+		return manager.ClientCA
+	} else if !isclient && manager.ServerCA != nil {
+		return manager.ServerCA
 	}
-	response, err := conn.client.Post("https://"+conn.addr+"/faraday", "application/json", bytes.NewReader(reqbody))
-	if err != nil {
-		return fmt.Errorf("while processing request: %s", err.Error())
+	return manager.RootCA
+}
+
+// intermediatesFor combines the configured intermediates with any that were presented by the other system.
+func (manager *LocalContext) intermediatesFor(presented []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range manager.Intermediates {
+		pool.AddCert(cert)
 	}
-	if response.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	for _, cert := range presented {
+		pool.AddCert(cert)
 	}
-	principal, err := conn.manager.verifyTLS(response.TLS, false)
-	if err != nil {
-		return err
+	return pool
+}
+
+// verifyChain checks the certificates presented by another system, leaf first, against the authorities trusted for its
+// role: as a client if isclient, and otherwise as a server, in which case its certificate must also be valid for
+// 'hostname' (unless hostname is empty). It returns the principal of the other system, after checking that the
+// authorities that issued its certificate were allowed to issue that principal.
+func (manager *LocalContext) verifyChain(presented []*x509.Certificate, isclient bool, hostname string) (string, error) {
+	if len(presented) == 0 {
+		return "", errors.New("no certificate")
 	}
-	if principal != conn.expectedCN {
-		return fmt.Errorf("mismatched common name while receiving response")
+	var auth x509.ExtKeyUsage
+	if isclient {
+		auth = x509.ExtKeyUsageClientAuth
+	} else {
+		auth = x509.ExtKeyUsageServerAuth
 	}
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return fmt.Errorf("while receiving response: %s", err.Error())
+	chains, err := presented[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         manager.trustedCA(isclient),
+		Intermediates: manager.intermediatesFor(presented[1:]),
+		KeyUsages:     []x509.ExtKeyUsage{auth},
+	})
+	if err != nil || len(chains) == 0 {
+		return "", errors.New("no valid certificate")
 	}
-	err = response.Body.Close()
+	principal, err := manager.principalOf(presented[0])
 	if err != nil {
-		return fmt.Errorf("while closing connection: %s", err.Error())
+		return "", fmt.Errorf("no valid principal: %s", err.Error())
+	}
+	if err := checkPrincipalConstraints(manager.PrincipalConstraints, principal, chains); err != nil {
+		return "", err
+	}
+	return principal, nil
+}
+
+// verifyPeer is used as a tls.Config.VerifyPeerCertificate callback, so that the TLS handshake itself applies the same
+// rules as verifyChain, including the configured intermediates.
+func (manager *LocalContext) verifyPeer(isclient bool, hostname string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 && isclient && manager.Enroll != nil {
+			// systems without certificates may still enroll; verifyTLS keeps them away from everything else
+			return nil
+		}
+		presented := []*x509.Certificate{}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("while parsing certificate: %s", err.Error())
+			}
+			presented = append(presented, cert)
+		}
+		_, err := manager.verifyChain(presented, isclient, hostname)
+		return err
+	}
+}
+
+func (manager *LocalContext) verifyTLS(tls *tls.ConnectionState, isclient bool) (string, error) {
+	if tls == nil {
+		return "", errors.New("no certificate")
 	}
-	err = json.Unmarshal(body, result)
+	// might be duplicate work, but this guarantees it's correct
+	return manager.verifyChain(tls.PeerCertificates, isclient, "")
+}
+
+// Send transmits an individual request across the network to this remote system. The specified message is encoded with
+// the first of the local Codecs, and the remote system is asked to respond with any of them. The result of the request
+// is decoded into the result parameter. The request will be handled by the RequestHandler on the remote end.
+// The request body is only compressed once the remote system has said that it accepts compressed requests, which it
+// does in the headers of every response.
+// The data transmitted here is both authenticated and confidential, through the security properties of TLS.
+func (conn *Remote) Send(message interface{}, result interface{}) error {
+	url := "https://" + conn.addr + conn.path
+	verify := func(response *http.Response) error {
+		principal, err := conn.manager.verifyTLS(response.TLS, false)
+		if err != nil {
+			return err
+		}
+		if principal != conn.expectedPrincipal {
+			return fmt.Errorf("mismatched principal while receiving response: %q instead of %q", principal, conn.expectedPrincipal)
+		}
+		return nil
+	}
+	return sendEncoded(&conn.client, url, conn.manager.encoding(), &conn.peerAcceptsGzip, &conn.peerCodec, message, result, verify)
+}
+
+// StartServe binds each of the specified addresses, and then serves on them as per ServeListeners.
+func (manager *LocalContext) StartServe(addrs ...string) (func(deadline time.Duration) error, chan error, error) {
+	// recommended addr: ":1836" (the year the faraday cage was invented)
+	listeners, err := sockutil.ListenAll(addrs)
 	if err != nil {
-		return fmt.Errorf("while unmarshalling json from response: %s", err.Error())
+		return nil, nil, err
 	}
-	return nil
+	return manager.ServeListeners(listeners...)
 }
 
-// StartServe launches a local HTTPS server that receives requests for this system, as sent via Remote.Send(). As it
+// ServeListeners launches a local HTTPS server that receives requests for this system, as sent via Remote.Send(). As it
 // receives requests, it calls into the RequestHandler registered on the manager, passing it the ability to decode the
-// incoming JSON request, and encoding the result. It returns three results: if it fails to initialize the server, it
-// will return an error in the third result. Otherwise, the first result is a function that can be called to stop the
-// server, and the second result is a channel from which the exit error can be read, if the HTTP server ever stops
-// serving, such as by calling the stop function.
-func (manager *LocalContext) StartServe(addr string) (func(), chan error, error) {
-	// recommended addr: ":1836" (the year the faraday cage was invented)
+// incoming request, and encoding the result. Requests in an encoding not listed in the manager's Codecs are rejected
+// with 415, and requests that accept none of them are rejected with 406. Large results are compressed when the
+// requester accepts gzip. It returns three results: if it fails to initialize the server, it will return an error in
+// the third result. Otherwise, the first result is a function that can be called to stop the server, and the second
+// result is a channel from which the exit error can be read, if the HTTP server ever stops serving. If the server was
+// stopped by the stop function, the exit error is nil.
+//
+// The stop function stops accepting new connections immediately, and then waits up to 'deadline' for requests that are
+// already in progress to finish. If they do not finish in time, the remaining connections are forcibly closed, and an
+// error is returned.
+//
+// The server takes ownership of the listeners, which may have been opened by sockutil.ListenAll or passed in through
+// sockutil.SystemdListeners. If any of them fails, the server stops serving on all of them.
+func (manager *LocalContext) ServeListeners(listeners ...net.Listener) (func(deadline time.Duration) error, chan error, error) {
+	if len(listeners) == 0 {
+		return nil, nil, errors.New("no listeners to serve on")
+	}
+	clientAuth := tls.RequireAnyClientCert
+	if manager.Enroll != nil {
+		// systems that are enrolling for the first time have no certificate to present
+		clientAuth = tls.RequestClientCert
+	}
 	server := &http.Server{
-		Addr: addr,
 		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/enroll" && manager.Enroll != nil {
+				manager.serveEnroll(writer, request)
+				return
+			}
 			if request.URL.Path != "/faraday" {
 				http.Error(writer, "not found", 404)
 				return
@@ -157,49 +283,48 @@ func (manager *LocalContext) StartServe(addr string) (func(), chan error, error)
 				http.Error(writer, "no certificate", 403)
 				return
 			}
-			data, err := ioutil.ReadAll(request.Body)
-			if err != nil {
-				http.Error(writer, "failed to read data", 400)
-				return
-			}
-			result, err := manager.Handler(principal, func(output interface{}) error {
-				return json.Unmarshal(data, output)
+			serveEncoded(writer, request, manager.encoding(), principal, func(parse func(interface{}) error) (interface{}, error) {
+				return manager.Handler(principal, request.TLS.PeerCertificates[0], parse)
 			})
-			if err != nil {
-				log.Println("Failed:", err, "during request from", principal)
-				http.Error(writer, "request failed", 500)
-				return
-			}
-			to_write, err := json.Marshal(result)
-			if err != nil {
-				http.Error(writer, "failed to write data", 500)
-				return
-			}
-			writer.Header().Set("Content-Type", "application/json")
-			writer.Write(to_write) // TODO: do I need to handle errors from this? does it matter?
 		}),
 		TLSConfig: &tls.Config{
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    manager.RootCA,
-			Certificates: []tls.Certificate{manager.LocalCert},
-			MinVersion:   tls.VersionTLS12,
-			NextProtos:   []string{"http/1.1", "h2"},
+			// the standard verification can't use our configured intermediates, so verifyPeer does it instead.
+			// ClientCAs is left empty, because clients won't send certificates issued by intermediates that aren't
+			// listed there.
+			ClientAuth:            clientAuth,
+			VerifyPeerCertificate: manager.verifyPeer(true, ""),
+			Certificates:          []tls.Certificate{manager.LocalCert},
+			MinVersion:            tls.VersionTLS12,
+			NextProtos:            []string{"http/1.1", "h2"},
 		},
 		ReadTimeout:  manager.Timeout,
 		WriteTimeout: manager.Timeout,
 	}
 
-	ln, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		return nil, nil, err
+	tlsListeners := []net.Listener{}
+	for _, ln := range listeners {
+		tlsListeners = append(tlsListeners, tls.NewListener(ln, server.TLSConfig))
 	}
+	stop, cherr := serveOn(server, tlsListeners)
+	return stop, cherr, nil
+}
 
-	cherr := make(chan error)
-
-	go func() {
-		tlsListener := tls.NewListener(ln, server.TLSConfig)
-		cherr <- server.Serve(tlsListener)
-	}()
-
-	return func() { server.Shutdown(context.Background()) }, cherr, nil
+// serveEnroll handles a single enrollment request. A certificate is optional, but must be valid if one is presented.
+func (manager *LocalContext) serveEnroll(writer http.ResponseWriter, request *http.Request) {
+	principal := ""
+	var cert *x509.Certificate
+	requester := "unauthenticated system"
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		var err error
+		principal, err = manager.verifyTLS(request.TLS, true)
+		if err != nil {
+			http.Error(writer, "invalid certificate", 403)
+			return
+		}
+		cert = request.TLS.PeerCertificates[0]
+		requester = principal
+	}
+	serveEncoded(writer, request, manager.encoding(), requester, func(parse func(interface{}) error) (interface{}, error) {
+		return manager.Enroll(principal, cert, parse)
+	})
 }
@@ -10,7 +10,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"util/sockutil"
 	"util/testkeyutil"
+	"util/testutil"
 )
 
 func CreateContextPair(t *testing.T, handlerA RequestHandler, handlerB RequestHandler) (LocalContext, LocalContext) {
@@ -49,14 +51,14 @@ type RecvStruct struct {
 }
 
 func TestEndToEnd(t *testing.T) {
-	af := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		ss := &SendStruct{}
 		if err := parse(ss); err != nil {
 			return nil, err
 		}
 		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
 	}
-	bf := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
@@ -66,13 +68,138 @@ func TestEndToEnd(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer func() {
-		stop()
-		err := <-cherr
-		if err != nil && err != http.ErrServerClosed {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
+		t.Error("mismatched response from server:", rs)
+	}
+}
+
+func TestEndToEnd_Gob(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	a.Codecs = []Codec{JSONCodec, GobCodec}
+	b.Codecs = []Codec{GobCodec}
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
+		t.Error("mismatched response from server:", rs)
+	}
+}
+
+func TestCodecUpgrade(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	for _, server_codecs := range [][]Codec{nil, {JSONCodec, GobCodec}} {
+		a, b := CreateContextPair(t, af, bf)
+		a.Codecs = server_codecs
+		b.Codecs = []Codec{GobCodec, JSONCodec}
+		stop, cherr, err := a.StartServe("localhost:1836")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+		// the first request is sent as json, and the rest as gob once the server has said that it accepts that
+		for i := 0; i < 3; i++ {
+			rs := &RecvStruct{}
+			if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
+				t.Fatal(err)
+			}
+			if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
+				t.Error("mismatched response from server:", rs)
+			}
+		}
+		if server_codecs == nil && conn.peerCodec != 2 {
+			t.Error("json-only server should only be sent json")
+		} else if server_codecs != nil && conn.peerCodec != 1 {
+			t.Error("server should have advertised gob support")
+		}
+
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCodecFallback(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	b.Codecs = []Codec{GobCodec, JSONCodec}
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
 			t.Error(err)
 		}
 	}()
 	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+	// as if the server had been replaced by one that only accepts json
+	conn.peerCodec = 1
 
 	rs := &RecvStruct{}
 	if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
@@ -81,6 +208,87 @@ func TestEndToEnd(t *testing.T) {
 	if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
 		t.Error("mismatched response from server:", rs)
 	}
+	if conn.peerCodec != 2 {
+		t.Error("should have gone back to json")
+	}
+}
+
+func TestUnsupportedCodec(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	b.Codecs = []Codec{GobCodec}
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	rs := &RecvStruct{}
+	err = conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs)
+	if err == nil {
+		t.Error("should have been an error")
+	} else if !strings.Contains(err.Error(), "unexpected status code: 415") {
+		t.Error("wrong error", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	a.CompressionThreshold = 1
+	b.CompressionThreshold = 1
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	// the first request is sent uncompressed, and the rest are compressed once the server has said that it accepts that
+	for i := 0; i < 3; i++ {
+		rs := &RecvStruct{}
+		if err := conn.Send(SendStruct{ABC: 6674, DEF: strings.Repeat("gravitational-singularity", 100)}, rs); err != nil {
+			t.Fatal(err)
+		}
+		if rs.X123 != -6674 || rs.X456 != strings.Repeat("gravitational-singularity", 100) {
+			t.Error("mismatched response from server:", rs)
+		}
+		if conn.peerAcceptsGzip != 1 {
+			t.Error("server should have advertised gzip support")
+		}
+	}
 }
 
 func LaunchProxy(t *testing.T, bind string, direct_to string) (func() int, error) {
@@ -139,14 +347,14 @@ func LaunchProxy(t *testing.T, bind string, direct_to string) (func() int, error
 }
 
 func TestConnectionReuse(t *testing.T) {
-	af := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		ss := &SendStruct{}
 		if err := parse(ss); err != nil {
 			return nil, err
 		}
 		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
 	}
-	bf := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
@@ -156,9 +364,10 @@ func TestConnectionReuse(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer func() {
-		stop()
-		err := <-cherr
-		if err != nil && err != http.ErrServerClosed {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
 			t.Error(err)
 		}
 	}()
@@ -187,11 +396,11 @@ func TestConnectionReuse(t *testing.T) {
 }
 
 func TestNeedsCorrectAuth(t *testing.T) {
-	af := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
-	bf := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
@@ -202,9 +411,10 @@ func TestNeedsCorrectAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer func() {
-		stop()
-		err := <-cherr
-		if err != nil && err != http.ErrServerClosed {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
 			t.Error(err)
 		}
 	}()
@@ -220,11 +430,11 @@ func TestNeedsCorrectAuth(t *testing.T) {
 }
 
 func TestNeedsAnyAuth(t *testing.T) {
-	af := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
-	bf := func(remote_principal string, parse func(interface{}) error) (interface{}, error) {
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
 		t.Error("should not be here")
 		return nil, errors.New("should not be here")
 	}
@@ -234,9 +444,10 @@ func TestNeedsAnyAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer func() {
-		stop()
-		err := <-cherr
-		if err != nil && err != http.ErrServerClosed {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
 			t.Error(err)
 		}
 	}()
@@ -251,3 +462,238 @@ func TestNeedsAnyAuth(t *testing.T) {
 		t.Error("wrong error", err)
 	}
 }
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		close(started)
+		time.Sleep(time.Millisecond * 30)
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	stopped := make(chan error)
+	go func() {
+		<-started
+		stopped <- stop(time.Second)
+	}()
+
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "gravitational-singularity" {
+		t.Error("mismatched response from server:", rs)
+	}
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+	if err := <-cherr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		close(started)
+		time.Sleep(time.Millisecond * 80)
+		return nil, errors.New("too late")
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := b.ConnectRemote("cert-for-a", "localhost:1836")
+
+	go func() {
+		conn.Send(SendStruct{ABC: 6674, DEF: "gravitational-singularity"}, &RecvStruct{})
+	}()
+
+	<-started
+	err = stop(time.Millisecond * 10)
+	testutil.CheckError(t, err, "while draining connections: context deadline exceeded")
+	if err := <-cherr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeMultipleAddresses(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	bf := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, bf)
+	preopened, err := net.Listen("tcp", "localhost:1838")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := sockutil.ListenAll([]string{"localhost:1836", "localhost:1837"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, cherr, err := a.ServeListeners(append(listeners, preopened)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, addr := range []string{"localhost:1836", "localhost:1837", "localhost:1838"} {
+		conn := b.ConnectRemote("cert-for-a", addr)
+		rs := &RecvStruct{}
+		if err := conn.Send(SendStruct{ABC: 6674, DEF: addr}, rs); err != nil {
+			t.Fatal(err)
+		}
+		if rs.X123 != -6674 || rs.X456 != addr {
+			t.Error("mismatched response from server:", rs)
+		}
+	}
+}
+
+func TestServeNoListeners(t *testing.T) {
+	a, _ := CreateContextPair(t, nil, nil)
+	_, _, err := a.ServeListeners()
+	testutil.CheckError(t, err, "no listeners to serve on")
+	_, _, err = a.StartServe()
+	testutil.CheckError(t, err, "no addresses to listen on")
+}
+
+func enrollingServer(t *testing.T, enrolled chan string) (LocalContext, LocalContext, func()) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		return &RecvStruct{X456: remote_principal}, nil
+	}
+	a, b := CreateContextPair(t, af, nil)
+	a.Enroll = func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		ss := &SendStruct{}
+		if err := parse(ss); err != nil {
+			return nil, err
+		}
+		enrolled <- remote_principal
+		return &RecvStruct{X123: -ss.ABC, X456: ss.DEF}, nil
+	}
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEnroll_WithoutCertificate(t *testing.T) {
+	enrolled := make(chan string, 1)
+	_, b, cleanup := enrollingServer(t, enrolled)
+	defer cleanup()
+	b.LocalCert = tls.Certificate{}
+	conn := b.ConnectEnrollment("cert-for-a", "localhost:1836")
+
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674, DEF: "join-token"}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "join-token" {
+		t.Error("mismatched response from server:", rs)
+	}
+	if principal := <-enrolled; principal != "" {
+		t.Errorf("should not have had a principal: %q", principal)
+	}
+}
+
+func TestEnroll_WithCertificate(t *testing.T) {
+	enrolled := make(chan string, 1)
+	_, b, cleanup := enrollingServer(t, enrolled)
+	defer cleanup()
+	conn := b.ConnectEnrollment("cert-for-a", "localhost:1836")
+
+	if err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{}); err != nil {
+		t.Fatal(err)
+	}
+	if principal := <-enrolled; principal != "cert-for-b" {
+		t.Errorf("wrong principal: %q", principal)
+	}
+}
+
+func TestEnroll_ServerAuthenticated(t *testing.T) {
+	enrolled := make(chan string, 1)
+	_, b, cleanup := enrollingServer(t, enrolled)
+	defer cleanup()
+	b.LocalCert = tls.Certificate{}
+	b.RootCA = x509.NewCertPool()
+	conn := b.ConnectEnrollment("cert-for-a", "localhost:1836")
+
+	err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "no valid certificate")
+}
+
+func TestEnroll_StillNeedsCertificate(t *testing.T) {
+	_, b, cleanup := enrollingServer(t, make(chan string, 1))
+	defer cleanup()
+	b.LocalCert = tls.Certificate{}
+	// an enrollment connection, but sent to the normal endpoint
+	conn := b.ConnectEnrollment("cert-for-a", "localhost:1836")
+	conn.path = "/faraday"
+
+	err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "unexpected status code: 403")
+}
+
+func TestEnroll_Disabled(t *testing.T) {
+	af := func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+	a, b := CreateContextPair(t, af, nil)
+	stop, cherr, err := a.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}()
+	conn := b.ConnectEnrollment("cert-for-a", "localhost:1836")
+
+	err = conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "unexpected status code: 404")
+}
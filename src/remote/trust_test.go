@@ -0,0 +1,218 @@
+package remote
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+// a small PKI, in which the server and clients are issued certificates by different authorities
+type splitPKI struct {
+	serverCA, clientCA       *x509.Certificate
+	serverCAKey, clientCAKey *rsa.PrivateKey
+}
+
+func newSplitPKI(t *testing.T) *splitPKI {
+	pki := &splitPKI{}
+	pki.serverCAKey, pki.serverCA = testkeyutil.GenerateTLSKeypairForTests(t, "server-ca", nil, nil, nil, nil)
+	pki.clientCAKey, pki.clientCA = testkeyutil.GenerateTLSKeypairForTests(t, "client-ca", nil, nil, nil, nil)
+	return pki
+}
+
+func (pki *splitPKI) pool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func (pki *splitPKI) context(t *testing.T, name string, issuer *x509.Certificate, issuerKey *rsa.PrivateKey, handler RequestHandler) LocalContext {
+	key, cert := testkeyutil.GenerateTLSKeypairForTests(t, name, []string{"localhost"}, nil, issuer, issuerKey)
+	return LocalContext{
+		Timeout:   time.Millisecond * 100,
+		Handler:   handler,
+		LocalCert: tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key},
+		ClientCA:  pki.pool(pki.clientCA),
+		ServerCA:  pki.pool(pki.serverCA),
+	}
+}
+
+func serveForTest(t *testing.T, server LocalContext) func() {
+	stop, cherr, err := server.StartServe("localhost:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := stop(time.Second); err != nil {
+			t.Error(err)
+		}
+		if err := <-cherr; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func echoHandler(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+	ss := &SendStruct{}
+	if err := parse(ss); err != nil {
+		return nil, err
+	}
+	return &RecvStruct{X123: -ss.ABC, X456: remote_principal}, nil
+}
+
+func unusedHandler(t *testing.T) RequestHandler {
+	return func(remote_principal string, remote_cert *x509.Certificate, parse func(interface{}) error) (interface{}, error) {
+		t.Error("should not be here")
+		return nil, errors.New("should not be here")
+	}
+}
+
+func TestSplitTrust(t *testing.T) {
+	pki := newSplitPKI(t)
+	server := pki.context(t, "farad", pki.serverCA, pki.serverCAKey, echoHandler)
+	client := pki.context(t, "node-a", pki.clientCA, pki.clientCAKey, unusedHandler(t))
+	defer serveForTest(t, server)()
+
+	conn := client.ConnectRemote("farad", "localhost:1836")
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X123 != -6674 || rs.X456 != "node-a" {
+		t.Error("mismatched response from server:", rs)
+	}
+}
+
+func TestSplitTrust_ClientFromServerCA(t *testing.T) {
+	pki := newSplitPKI(t)
+	server := pki.context(t, "farad", pki.serverCA, pki.serverCAKey, unusedHandler(t))
+	// trusted as a server, but not as a client
+	client := pki.context(t, "node-a", pki.serverCA, pki.serverCAKey, unusedHandler(t))
+	defer serveForTest(t, server)()
+
+	conn := client.ConnectRemote("farad", "localhost:1836")
+	err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "remote error: tls: bad certificate")
+}
+
+func TestSplitTrust_ServerFromClientCA(t *testing.T) {
+	pki := newSplitPKI(t)
+	// trusted as a client, but not as a server
+	server := pki.context(t, "farad", pki.clientCA, pki.clientCAKey, unusedHandler(t))
+	client := pki.context(t, "node-a", pki.clientCA, pki.clientCAKey, unusedHandler(t))
+	defer serveForTest(t, server)()
+
+	conn := client.ConnectRemote("farad", "localhost:1836")
+	err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "no valid certificate")
+}
+
+func TestSplitTrust_Intermediates(t *testing.T) {
+	pki := newSplitPKI(t)
+	// node certificates are issued by a sub-CA, which the nodes don't send along with their own certificates
+	subKey, sub := testkeyutil.GenerateTLSKeypairForTests(t, "rack-3", nil, nil, pki.clientCA, pki.clientCAKey)
+	server := pki.context(t, "farad", pki.serverCA, pki.serverCAKey, echoHandler)
+	client := pki.context(t, "node-a", sub, subKey, unusedHandler(t))
+
+	func() {
+		defer serveForTest(t, server)()
+		conn := client.ConnectRemote("farad", "localhost:1836")
+		err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+		testutil.CheckError(t, err, "remote error: tls: bad certificate")
+	}()
+
+	server.Intermediates = []*x509.Certificate{sub}
+	func() {
+		defer serveForTest(t, server)()
+		conn := client.ConnectRemote("farad", "localhost:1836")
+		rs := &RecvStruct{}
+		if err := conn.Send(SendStruct{ABC: 6674}, rs); err != nil {
+			t.Fatal(err)
+		}
+		if rs.X456 != "node-a" {
+			t.Error("mismatched response from server:", rs)
+		}
+	}()
+}
+
+func TestTrustedCA_FallsBackToRootCA(t *testing.T) {
+	root, client, server := x509.NewCertPool(), x509.NewCertPool(), x509.NewCertPool()
+	manager := &LocalContext{RootCA: root}
+	if manager.trustedCA(true) != root || manager.trustedCA(false) != root {
+		t.Error("should have used RootCA")
+	}
+	manager.ClientCA = client
+	manager.ServerCA = server
+	if manager.trustedCA(true) != client || manager.trustedCA(false) != server {
+		t.Error("should have used the pool for each direction")
+	}
+}
+
+func TestPrincipalConstraints(t *testing.T) {
+	pki := newSplitPKI(t)
+	rackKey, rack := testkeyutil.GenerateTLSKeypairForTests(t, "rack-3", nil, nil, pki.clientCA, pki.clientCAKey)
+	server := pki.context(t, "farad", pki.serverCA, pki.serverCAKey, echoHandler)
+	server.Intermediates = []*x509.Certificate{rack}
+	server.PrincipalConstraints = []PrincipalConstraint{{Authority: rack, Allowed: []string{"rack3-*"}}}
+	defer serveForTest(t, server)()
+
+	allowed := pki.context(t, "rack3-node-a", rack, rackKey, unusedHandler(t))
+	conn := allowed.ConnectRemote("farad", "localhost:1836")
+	rs := &RecvStruct{}
+	if err := conn.Send(SendStruct{ABC: 6674}, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.X456 != "rack3-node-a" {
+		t.Error("mismatched response from server:", rs)
+	}
+
+	// the rack-3 authority is trusted, but not to issue this principal
+	forbidden := pki.context(t, "rack4-node-a", rack, rackKey, unusedHandler(t))
+	conn = forbidden.ConnectRemote("farad", "localhost:1836")
+	err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{})
+	testutil.CheckError(t, err, "remote error: tls: bad certificate")
+
+	// but the root authority itself is unconstrained
+	direct := pki.context(t, "rack4-node-a", pki.clientCA, pki.clientCAKey, unusedHandler(t))
+	conn = direct.ConnectRemote("farad", "localhost:1836")
+	if err := conn.Send(SendStruct{ABC: 6674}, &RecvStruct{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	for _, algorithm := range testkeyutil.KeyAlgorithms {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			caKey, ca := testkeyutil.GenerateTLSKeypairForTests_WithAlgorithm(t, algorithm, "ca", nil, nil, nil, nil)
+			context := func(name string, handler RequestHandler) LocalContext {
+				key, cert := testkeyutil.GenerateTLSKeypairForTests_WithAlgorithm(t, algorithm, name, []string{"localhost"}, nil, ca, caKey)
+				pool := x509.NewCertPool()
+				pool.AddCert(ca)
+				return LocalContext{
+					Timeout:   time.Millisecond * 100,
+					Handler:   handler,
+					LocalCert: tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key},
+					RootCA:    pool,
+				}
+			}
+			server := context("farad", echoHandler)
+			client := context("node-a", unusedHandler(t))
+			defer serveForTest(t, server)()
+
+			conn := client.ConnectRemote("farad", "localhost:1836")
+			rs := &RecvStruct{}
+			if err := conn.Send(SendStruct{ABC: 6674}, rs); err != nil {
+				t.Fatal(err)
+			}
+			if rs.X123 != -6674 || rs.X456 != "node-a" {
+				t.Error("mismatched response from server:", rs)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+package pkcs11util
+
+// #cgo pkg-config: p11-kit-1
+// #cgo LDFLAGS: -ldl
+// #include <dlfcn.h>
+// #include <stdlib.h>
+// #include <string.h>
+// #include <p11-kit/pkcs11.h>
+//
+// static CK_RV get_function_list(void *library, CK_FUNCTION_LIST_PTR *functions) {
+// 	CK_C_GetFunctionList get = (CK_C_GetFunctionList) dlsym(library, "C_GetFunctionList");
+// 	if (get == NULL) {
+// 		return CKR_FUNCTION_NOT_SUPPORTED;
+// 	}
+// 	return get(functions);
+// }
+//
+// static CK_RV initialize(CK_FUNCTION_LIST_PTR f) {
+// 	CK_C_INITIALIZE_ARGS args = {0};
+// 	args.flags = CKF_OS_LOCKING_OK;
+// 	CK_RV rv = f->C_Initialize(&args);
+// 	return rv == CKR_CRYPTOKI_ALREADY_INITIALIZED ? CKR_OK : rv;
+// }
+//
+// static CK_RV open_session(CK_FUNCTION_LIST_PTR f, CK_SLOT_ID slot, CK_SESSION_HANDLE *session) {
+// 	return f->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+// }
+//
+// static CK_RV login(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, unsigned char *pin, CK_ULONG pin_len) {
+// 	CK_RV rv = f->C_Login(session, CKU_USER, pin, pin_len);
+// 	return rv == CKR_USER_ALREADY_LOGGED_IN ? CKR_OK : rv;
+// }
+//
+// static CK_RV find_private_key(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, char *label, CK_ULONG label_len,
+// 		CK_OBJECT_HANDLE *objects, CK_ULONG *count) {
+// 	CK_OBJECT_CLASS class = CKO_PRIVATE_KEY;
+// 	CK_ATTRIBUTE template[] = {
+// 		{CKA_CLASS, &class, sizeof(class)},
+// 		{CKA_LABEL, label, label_len},
+// 	};
+// 	CK_RV rv = f->C_FindObjectsInit(session, template, 2);
+// 	if (rv != CKR_OK) {
+// 		return rv;
+// 	}
+// 	// ask for two, so that an ambiguous label can be detected
+// 	rv = f->C_FindObjects(session, objects, 2, count);
+// 	CK_RV final_rv = f->C_FindObjectsFinal(session);
+// 	return rv != CKR_OK ? rv : final_rv;
+// }
+//
+// static CK_RV sign(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key,
+// 		CK_MECHANISM_TYPE kind, CK_MECHANISM_TYPE hash, CK_RSA_PKCS_MGF_TYPE mgf, CK_ULONG salt_length,
+// 		unsigned char *data, CK_ULONG data_len, unsigned char *signature, CK_ULONG *signature_len) {
+// 	CK_RSA_PKCS_PSS_PARAMS pss = {hash, mgf, salt_length};
+// 	CK_MECHANISM mechanism = {kind, NULL, 0};
+// 	if (kind == CKM_RSA_PKCS_PSS) {
+// 		mechanism.pParameter = &pss;
+// 		mechanism.ulParameterLen = sizeof(pss);
+// 	}
+// 	CK_RV rv = f->C_SignInit(session, &mechanism, key);
+// 	if (rv != CKR_OK) {
+// 		return rv;
+// 	}
+// 	return f->C_Sign(session, data, data_len, signature, signature_len);
+// }
+//
+// static CK_RV close_session(CK_FUNCTION_LIST_PTR f, CK_SESSION_HANDLE session) {
+// 	f->C_Logout(session);
+// 	return f->C_CloseSession(session);
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// large enough for a signature by a 16384-bit RSA key, or by any curve
+const MAX_SIGNATURE_LENGTH = 2048
+
+type pkcs11Error C.CK_RV
+
+func (rv pkcs11Error) Error() string {
+	return fmt.Sprintf("PKCS#11 error 0x%x", uint(rv))
+}
+
+func check(rv C.CK_RV, during string) error {
+	if rv != C.CKR_OK {
+		return fmt.Errorf("while %s: %s", during, pkcs11Error(rv).Error())
+	}
+	return nil
+}
+
+type pkcs11Token struct {
+	functions C.CK_FUNCTION_LIST_PTR
+	session   C.CK_SESSION_HANDLE
+	key       C.CK_OBJECT_HANDLE
+}
+
+func openToken(config Config, pin []byte) (token, error) {
+	path := C.CString(config.Module)
+	defer C.free(unsafe.Pointer(path))
+	// the module is never unloaded, because other keys may still be using it
+	library := C.dlopen(path, C.RTLD_NOW|C.RTLD_LOCAL)
+	if library == nil {
+		return nil, fmt.Errorf("while loading PKCS#11 module: %s", C.GoString(C.dlerror()))
+	}
+	tok := &pkcs11Token{}
+	if err := check(C.get_function_list(library, &tok.functions), "loading PKCS#11 module"); err != nil {
+		return nil, err
+	}
+	if err := check(C.initialize(tok.functions), "initializing PKCS#11 module"); err != nil {
+		return nil, err
+	}
+	if err := check(C.open_session(tok.functions, C.CK_SLOT_ID(config.Slot), &tok.session), "opening PKCS#11 session"); err != nil {
+		return nil, err
+	}
+	if err := tok.findKey(config.Label, pin); err != nil {
+		tok.close()
+		return nil, err
+	}
+	return tok, nil
+}
+
+func (tok *pkcs11Token) findKey(label string, pin []byte) error {
+	if len(pin) > 0 {
+		cpin := C.CBytes(pin)
+		rv := C.login(tok.functions, tok.session, (*C.uchar)(cpin), C.CK_ULONG(len(pin)))
+		C.memset(cpin, 0, C.size_t(len(pin)))
+		C.free(cpin)
+		if err := check(rv, "logging in to PKCS#11 token"); err != nil {
+			return err
+		}
+	}
+	clabel := C.CString(label)
+	defer C.free(unsafe.Pointer(clabel))
+	var objects [2]C.CK_OBJECT_HANDLE
+	var count C.CK_ULONG
+	rv := C.find_private_key(tok.functions, tok.session, clabel, C.CK_ULONG(len(label)), &objects[0], &count)
+	if err := check(rv, "finding private key"); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no private key labeled %q found on PKCS#11 token", label)
+	} else if count > 1 {
+		return fmt.Errorf("more than one private key labeled %q found on PKCS#11 token", label)
+	}
+	tok.key = objects[0]
+	return nil
+}
+
+func (tok *pkcs11Token) sign(mech mechanism, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("nothing to sign")
+	}
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+	signature := C.malloc(MAX_SIGNATURE_LENGTH)
+	defer C.free(signature)
+	length := C.CK_ULONG(MAX_SIGNATURE_LENGTH)
+	rv := C.sign(tok.functions, tok.session, tok.key,
+		C.CK_MECHANISM_TYPE(mech.kind), C.CK_MECHANISM_TYPE(mech.hash), C.CK_RSA_PKCS_MGF_TYPE(mech.mgf), C.CK_ULONG(mech.saltLength),
+		(*C.uchar)(cdata), C.CK_ULONG(len(data)), (*C.uchar)(signature), &length)
+	if err := check(rv, "signing with PKCS#11 token"); err != nil {
+		return nil, err
+	}
+	return C.GoBytes(signature, C.int(length)), nil
+}
+
+func (tok *pkcs11Token) close() error {
+	return check(C.close_session(tok.functions, tok.session), "closing PKCS#11 session")
+}
@@ -0,0 +1,10 @@
+//go:build !pkcs11 || !cgo
+// +build !pkcs11 !cgo
+
+package pkcs11util
+
+import "errors"
+
+func openToken(config Config, pin []byte) (token, error) {
+	return nil, errors.New("PKCS#11 support was not compiled in: build with cgo and the pkcs11 tag")
+}
@@ -0,0 +1,243 @@
+package pkcs11util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"util/secretutil"
+)
+
+// mechanisms and mask generation functions, from the PKCS#11 specification
+const (
+	ckmRSAPKCS    = 0x1
+	ckmRSAPKCSPSS = 0xd
+	ckmSHA1       = 0x220
+	ckmSHA224     = 0x255
+	ckmSHA256     = 0x250
+	ckmSHA384     = 0x260
+	ckmSHA512     = 0x270
+	ckmECDSA      = 0x1041
+	ckmEDDSA      = 0x1057
+
+	ckgMGF1SHA1   = 0x1
+	ckgMGF1SHA224 = 0x5
+	ckgMGF1SHA256 = 0x2
+	ckgMGF1SHA384 = 0x3
+	ckgMGF1SHA512 = 0x4
+)
+
+// A mechanism is how the token is asked to sign. For RSA-PSS, it carries the parameters of the PSS padding.
+type mechanism struct {
+	kind       uint
+	hash       uint
+	mgf        uint
+	saltLength uint
+}
+
+// A token is an open session on a PKCS#11 token, logged in, with a private key selected.
+type token interface {
+	sign(mech mechanism, data []byte) ([]byte, error)
+	close() error
+}
+
+// A Key is a crypto.Signer whose private key never leaves a PKCS#11 token. It can be used as the PrivateKey of a
+// tls.Certificate. Since a PKCS#11 session can only perform one operation at a time, concurrent
+// signatures are serialized.
+type Key struct {
+	token  token
+	public crypto.PublicKey
+	lock   sync.Mutex
+}
+
+// newKey wraps a token, after checking that the key selected on it actually belongs to the public key, so that a wrong
+// label is caught immediately rather than during the first handshake.
+func newKey(tok token, public crypto.PublicKey) (*Key, error) {
+	key := &Key{token: tok, public: public}
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := public.(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	message := make([]byte, 32)
+	if _, err := rand.Read(message); err != nil {
+		return nil, err
+	}
+	digest := message
+	if opts.HashFunc() != 0 {
+		sum := sha256.Sum256(message)
+		digest = sum[:]
+	}
+	signature, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("while checking private key: %s", err.Error())
+	}
+	if !verify(public, message, digest, signature) {
+		return nil, errors.New("private key on token does not match certificate")
+	}
+	return key, nil
+}
+
+func verify(public crypto.PublicKey, message []byte, digest []byte, signature []byte) bool {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &parsed); err != nil {
+			return false
+		}
+		return ecdsa.Verify(public, digest, parsed.R, parsed.S)
+	case ed25519.PublicKey:
+		return ed25519.Verify(public, message, signature)
+	default:
+		return false
+	}
+}
+
+func (key *Key) Public() crypto.PublicKey {
+	return key.public
+}
+
+// Sign signs a digest with the key on the token, as described by crypto.Signer. The random source is not used, because
+// the token supplies its own randomness.
+func (key *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mech, data, err := prepareSignature(key.public, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	key.lock.Lock()
+	signature, err := key.token.sign(mech, data)
+	key.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if public, ok := key.public.(*ecdsa.PublicKey); ok {
+		return encodeECDSASignature(public, signature)
+	}
+	return signature, nil
+}
+
+// Close logs out of the token and closes the session. The key may not be used afterwards.
+func (key *Key) Close() error {
+	key.lock.Lock()
+	defer key.lock.Unlock()
+	return key.token.close()
+}
+
+// DER-encoded DigestInfo prefixes for PKCS#1 v1.5 signatures, from RFC 8017, since CKM_RSA_PKCS does not add
+// them itself
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224:  {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+	crypto.MD5SHA1: {}, // used by TLS 1.0 and 1.1, which sign the bare concatenated hashes
+}
+
+var pssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {ckmSHA1, ckgMGF1SHA1},
+	crypto.SHA224: {ckmSHA224, ckgMGF1SHA224},
+	crypto.SHA256: {ckmSHA256, ckgMGF1SHA256},
+	crypto.SHA384: {ckmSHA384, ckgMGF1SHA384},
+	crypto.SHA512: {ckmSHA512, ckgMGF1SHA512},
+}
+
+// prepareSignature works out which mechanism to ask the token for, and what data to give it, to produce the signature
+// that crypto.Signer would have produced for a software key of the same type.
+func prepareSignature(public crypto.PublicKey, digest []byte, opts crypto.SignerOpts) (mechanism, []byte, error) {
+	hash := opts.HashFunc()
+	if hash != 0 && len(digest) != hash.Size() {
+		return mechanism{}, nil, errors.New("digest has the wrong length for its hash")
+	}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			params, ok := pssHashes[hash]
+			if !ok {
+				return mechanism{}, nil, fmt.Errorf("unsupported hash for RSA-PSS: %v", hash)
+			}
+			saltLength := pss.SaltLength
+			if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+				// tokens can't pick the longest possible salt for us, so choose the length that TLS requires
+				saltLength = hash.Size()
+			}
+			if saltLength < 0 {
+				return mechanism{}, nil, fmt.Errorf("invalid RSA-PSS salt length %d", pss.SaltLength)
+			}
+			return mechanism{kind: ckmRSAPKCSPSS, hash: params[0], mgf: params[1], saltLength: uint(saltLength)}, digest, nil
+		}
+		prefix, ok := digestInfoPrefixes[hash]
+		if !ok {
+			return mechanism{}, nil, fmt.Errorf("unsupported hash for RSA: %v", hash)
+		}
+		return mechanism{kind: ckmRSAPKCS}, append(append([]byte{}, prefix...), digest...), nil
+	case *ecdsa.PublicKey:
+		if hash == 0 {
+			return mechanism{}, nil, errors.New("ECDSA requires a hashed message")
+		}
+		return mechanism{kind: ckmECDSA}, digest, nil
+	case ed25519.PublicKey:
+		if hash != 0 {
+			return mechanism{}, nil, errors.New("Ed25519 signs unhashed messages")
+		}
+		return mechanism{kind: ckmEDDSA}, digest, nil
+	default:
+		return mechanism{}, nil, fmt.Errorf("unsupported public key of type %T", public)
+	}
+}
+
+// encodeECDSASignature converts a PKCS#11 ECDSA signature, which is r and s concatenated, into the ASN.1 form that
+// crypto.Signer returns.
+func encodeECDSASignature(public *ecdsa.PublicKey, signature []byte) ([]byte, error) {
+	size := (public.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return nil, fmt.Errorf("ECDSA signature from token has wrong length %d", len(signature))
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+}
+
+// Config describes how to find a private key on a PKCS#11 token.
+type Config struct {
+	// the path of the shared library that implements PKCS#11 for the token, such as libsofthsm2.so
+	Module string
+	Slot   uint
+	// the CKA_LABEL of the private key
+	Label string
+	// where to find the user PIN of the token, as described by secretutil.ReadPassphrase
+	PINSource string
+}
+
+// Open logs in to the token described by config, and finds the private key for the public key, which is usually taken
+// from the certificate that goes with it.
+func Open(config Config, public crypto.PublicKey) (*Key, error) {
+	var pin []byte
+	if config.PINSource != "" {
+		var err error
+		pin, err = secretutil.ReadPassphrase(config.PINSource)
+		if err != nil {
+			return nil, err
+		}
+		defer secretutil.Wipe(pin)
+	}
+	tok, err := openToken(config, pin)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newKey(tok, public)
+	if err != nil {
+		tok.close()
+		return nil, err
+	}
+	return key, nil
+}
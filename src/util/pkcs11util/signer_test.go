@@ -0,0 +1,181 @@
+package pkcs11util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"testing"
+	"util/testkeyutil"
+	"util/testutil"
+)
+
+// softToken behaves like a PKCS#11 token holding a software key, following the PKCS#11 definitions of each mechanism.
+type softToken struct {
+	t      *testing.T
+	key    crypto.Signer
+	closed bool
+}
+
+var pssHashFuncs = map[uint]crypto.Hash{ckmSHA1: crypto.SHA1, ckmSHA256: crypto.SHA256, ckmSHA384: crypto.SHA384, ckmSHA512: crypto.SHA512}
+
+func (tok *softToken) sign(mech mechanism, data []byte) ([]byte, error) {
+	if tok.closed {
+		return nil, errors.New("token is closed")
+	}
+	switch mech.kind {
+	case ckmRSAPKCS:
+		// with no hash, the data is padded and signed as-is, which is what CKM_RSA_PKCS does
+		return rsa.SignPKCS1v15(rand.Reader, tok.key.(*rsa.PrivateKey), crypto.Hash(0), data)
+	case ckmRSAPKCSPSS:
+		hash := pssHashFuncs[mech.hash]
+		if pssHashes[hash][1] != mech.mgf {
+			tok.t.Error("mismatched mask generation function")
+		}
+		return rsa.SignPSS(rand.Reader, tok.key.(*rsa.PrivateKey), hash, data, &rsa.PSSOptions{SaltLength: int(mech.saltLength)})
+	case ckmECDSA:
+		key := tok.key.(*ecdsa.PrivateKey)
+		r, s, err := ecdsa.Sign(rand.Reader, key, data)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		rbytes, sbytes := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rbytes):size], rbytes)
+		copy(signature[2*size-len(sbytes):], sbytes)
+		return signature, nil
+	case ckmEDDSA:
+		return ed25519.Sign(tok.key.(ed25519.PrivateKey), data), nil
+	default:
+		return nil, errors.New("unsupported mechanism")
+	}
+}
+
+func (tok *softToken) close() error {
+	tok.closed = true
+	return nil
+}
+
+func keyFor(t *testing.T, algorithm testkeyutil.KeyAlgorithm) (*Key, crypto.Signer) {
+	software := testkeyutil.GenerateKeyForTests(t, algorithm)
+	key, err := newKey(&softToken{t: t, key: software}, software.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, software
+}
+
+func TestKey_PKCS1v15(t *testing.T) {
+	key, software := keyFor(t, testkeyutil.RSA)
+	for _, hash := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		h := hash.New()
+		h.Write([]byte("topology"))
+		digest := h.Sum(nil)
+		signature, err := key.Sign(rand.Reader, digest, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPKCS1v15(software.Public().(*rsa.PublicKey), hash, digest, signature); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestKey_PSS(t *testing.T) {
+	// PSS needs a larger key than PKCS#1 v1.5 does, for the salt to fit
+	software, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newKey(&softToken{t: t, key: software}, software.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("topology"))
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	signature, err := key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPSS(&software.PublicKey, crypto.SHA256, digest[:], signature, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKey_ECDSA(t *testing.T) {
+	key, software := keyFor(t, testkeyutil.ECDSA)
+	digest := sha256.Sum256([]byte("topology"))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify(software.Public(), nil, digest[:], signature) {
+		t.Error("signature did not verify")
+	}
+}
+
+func TestKey_Ed25519(t *testing.T) {
+	key, software := keyFor(t, testkeyutil.Ed25519)
+	signature, err := key.Sign(rand.Reader, []byte("topology"), crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(software.Public().(ed25519.PublicKey), []byte("topology"), signature) {
+		t.Error("signature did not verify")
+	}
+	_, err = key.Sign(rand.Reader, make([]byte, sha512.Size), crypto.SHA512)
+	testutil.CheckError(t, err, "Ed25519 signs unhashed messages")
+}
+
+func TestKey_WrongDigestLength(t *testing.T) {
+	key, _ := keyFor(t, testkeyutil.ECDSA)
+	_, err := key.Sign(rand.Reader, []byte("short"), crypto.SHA256)
+	testutil.CheckError(t, err, "digest has the wrong length")
+}
+
+func TestNewKey_Mismatch(t *testing.T) {
+	for _, algorithm := range testkeyutil.KeyAlgorithms {
+		tok := &softToken{t: t, key: testkeyutil.GenerateKeyForTests(t, algorithm)}
+		_, err := newKey(tok, testkeyutil.GenerateKeyForTests(t, algorithm).Public())
+		testutil.CheckError(t, err, "private key on token does not match certificate")
+	}
+}
+
+func TestKey_Close(t *testing.T) {
+	key, _ := keyFor(t, testkeyutil.Ed25519)
+	if err := key.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := key.Sign(rand.Reader, []byte("topology"), crypto.Hash(0))
+	testutil.CheckError(t, err, "token is closed")
+}
+
+func TestEncodeECDSASignature(t *testing.T) {
+	key, _ := keyFor(t, testkeyutil.ECDSA)
+	public := key.Public().(*ecdsa.PublicKey)
+	// r and s are padded to the size of the curve by the token, but encoded minimally in ASN.1
+	raw := make([]byte, 64)
+	raw[31], raw[63] = 1, 2
+	encoded, err := encodeECDSASignature(public, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02}
+	if string(encoded) != string(expected) {
+		t.Errorf("wrong encoding: %x", encoded)
+	}
+	_, err = encodeECDSASignature(public, raw[:63])
+	testutil.CheckError(t, err, "wrong length 63")
+}
+
+func TestOpen_MissingModule(t *testing.T) {
+	_, err := Open(Config{Module: "/nonexistent/libsofthsm2.so", Label: "farad"}, nil)
+	if err == nil {
+		t.Error("should not have opened a nonexistent module")
+	}
+}
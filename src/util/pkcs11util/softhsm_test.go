@@ -0,0 +1,161 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+package pkcs11util
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"util/testkeyutil"
+)
+
+const SOFTHSM_PIN = "1234"
+
+// where distributions install SoftHSM2, unless SOFTHSM2_MODULE says otherwise
+var softhsmModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softhsmToken initializes a SoftHSM2 token in a temporary directory, and imports each key into it, labelled by its
+// index. It returns the module and slot of the token, and a PIN source for it. The test is skipped if SoftHSM2 is not
+// installed.
+func softhsmToken(t *testing.T, keys ...crypto.Signer) (string, uint, string, func()) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		for _, candidate := range softhsmModules {
+			if _, err := os.Stat(candidate); err == nil {
+				module = candidate
+				break
+			}
+		}
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if module == "" || err != nil {
+		t.Skip("SoftHSM2 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "softhsm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if err := os.Mkdir(filepath.Join(dir, "tokens"), 0700); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	// read by both softhsm2-util and the module, when it is initialized
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	output, err := exec.Command(util, "--init-token", "--free", "--label", "faraday-test", "--pin", SOFTHSM_PIN, "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		cleanup()
+		t.Fatalf("while initializing token: %s: %s", err.Error(), output)
+	}
+	match := regexp.MustCompile(`slot (\d+)`).FindSubmatch(output)
+	if match == nil {
+		cleanup()
+		t.Fatalf("could not find slot of new token in: %s", output)
+	}
+	var slot uint
+	fmt.Sscan(string(match[1]), &slot)
+
+	for i, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("key-%d.pem", i))
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		output, err := exec.Command(util, "--import", path, "--slot", string(match[1]), "--label", fmt.Sprintf("key-%d", i),
+			"--id", fmt.Sprintf("%02x", i+1), "--pin", SOFTHSM_PIN).CombinedOutput()
+		if err != nil {
+			cleanup()
+			t.Fatalf("while importing key: %s: %s", err.Error(), output)
+		}
+	}
+
+	pin_path := filepath.Join(dir, "pin")
+	if err := ioutil.WriteFile(pin_path, []byte(SOFTHSM_PIN), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return module, slot, "file:" + pin_path, cleanup
+}
+
+func TestSoftHSM(t *testing.T) {
+	eckey := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, slot, pin_source, cleanup := softhsmToken(t, eckey, rsakey)
+	defer cleanup()
+	digest := sha256.Sum256([]byte("signed through a token"))
+
+	key, err := Open(Config{Module: module, Slot: slot, Label: "key-0", PINSource: pin_source}, eckey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify(eckey.Public(), nil, digest[:], signature) {
+		t.Error("invalid ECDSA signature from token")
+	}
+	if err := key.Close(); err != nil {
+		t.Error(err)
+	}
+	// the module can only be initialized once, with one configuration, so every test of the token is done here
+	other := testkeyutil.GenerateKeyForTests(t, testkeyutil.ECDSA)
+	if _, err := Open(Config{Module: module, Slot: slot, Label: "key-0", PINSource: pin_source}, other.Public()); err == nil {
+		t.Error("a key that doesn't match the public key should be refused")
+	}
+	if _, err := Open(Config{Module: module, Slot: slot, Label: "missing", PINSource: pin_source}, eckey.Public()); err == nil {
+		t.Error("a missing key should be refused")
+	}
+
+	key, err = Open(Config{Module: module, Slot: slot, Label: "key-1", PINSource: pin_source}, rsakey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+	signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&rsakey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Error(err)
+	}
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	signature, err = key.Sign(rand.Reader, digest[:], pss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPSS(&rsakey.PublicKey, crypto.SHA256, digest[:], signature, pss); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+package pkcs11util
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ParseURI parses a PKCS#11 URI, as defined by RFC 7512, into a Config. For example:
+//
+//	pkcs11:slot-id=0;object=farad?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=credential:farad-pin
+//
+// The path must have "slot-id" and "object" attributes, and may have "type=private". The query must have "module-path",
+// and may have "pin-source", in any of the forms accepted by secretutil.ReadPassphrase. Other attributes are rejected
+// rather than ignored, so that a key is never found by fewer attributes than the operator intended.
+func ParseURI(uri string) (Config, error) {
+	if !strings.HasPrefix(uri, "pkcs11:") {
+		return Config{}, errors.New("PKCS#11 URI must start with pkcs11:")
+	}
+	config := Config{}
+	found_slot := false
+	path, query := uri[len("pkcs11:"):], ""
+	if index := strings.IndexByte(path, '?'); index >= 0 {
+		path, query = path[:index], path[index+1:]
+	}
+	attributes, err := splitAttributes(path, ";")
+	if err != nil {
+		return Config{}, err
+	}
+	for _, attribute := range attributes {
+		switch attribute[0] {
+		case "slot-id":
+			slot, err := strconv.ParseUint(attribute[1], 10, 32)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid slot-id %q in PKCS#11 URI", attribute[1])
+			}
+			config.Slot, found_slot = uint(slot), true
+		case "object":
+			config.Label = attribute[1]
+		case "type":
+			if attribute[1] != "private" {
+				return Config{}, fmt.Errorf("PKCS#11 URI must refer to a private key, not %q", attribute[1])
+			}
+		default:
+			return Config{}, fmt.Errorf("unsupported attribute %q in PKCS#11 URI", attribute[0])
+		}
+	}
+	attributes, err = splitAttributes(query, "&")
+	if err != nil {
+		return Config{}, err
+	}
+	for _, attribute := range attributes {
+		switch attribute[0] {
+		case "module-path":
+			config.Module = attribute[1]
+		case "pin-source":
+			config.PINSource = attribute[1]
+		default:
+			return Config{}, fmt.Errorf("unsupported query attribute %q in PKCS#11 URI", attribute[0])
+		}
+	}
+	if !found_slot || config.Label == "" || config.Module == "" {
+		return Config{}, errors.New("PKCS#11 URI must specify slot-id, object, and module-path")
+	}
+	return config, nil
+}
+
+// splitAttributes splits and unescapes name=value pairs, rejecting duplicates.
+func splitAttributes(text string, separator string) ([][2]string, error) {
+	attributes := [][2]string{}
+	if text == "" {
+		return attributes, nil
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(text, separator) {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid attribute %q in PKCS#11 URI", part)
+		}
+		value, err := url.PathUnescape(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribute %q in PKCS#11 URI", part)
+		}
+		if seen[pair[0]] {
+			return nil, fmt.Errorf("duplicate attribute %q in PKCS#11 URI", pair[0])
+		}
+		seen[pair[0]] = true
+		attributes = append(attributes, [2]string{pair[0], value})
+	}
+	return attributes, nil
+}
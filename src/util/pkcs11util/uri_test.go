@@ -0,0 +1,46 @@
+package pkcs11util
+
+import (
+	"testing"
+	"util/testutil"
+)
+
+func TestParseURI(t *testing.T) {
+	config, err := ParseURI("pkcs11:slot-id=3;object=farad%20key;type=private?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=credential:farad-pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{Module: "/usr/lib/softhsm/libsofthsm2.so", Slot: 3, Label: "farad key", PINSource: "credential:farad-pin"}
+	if config != expected {
+		t.Errorf("wrong config: %+v", config)
+	}
+}
+
+func TestParseURI_NoPIN(t *testing.T) {
+	config, err := ParseURI("pkcs11:object=farad;slot-id=0?module-path=softhsm.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != (Config{Module: "softhsm.so", Label: "farad"}) {
+		t.Errorf("wrong config: %+v", config)
+	}
+}
+
+func TestParseURI_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"/etc/farad/key.pem":                                         "must start with pkcs11:",
+		"pkcs11:slot-id=0;object=farad":                              "must specify slot-id, object, and module-path",
+		"pkcs11:object=farad?module-path=softhsm.so":                 "must specify slot-id, object, and module-path",
+		"pkcs11:slot-id=x;object=farad?module-path=softhsm.so":       "invalid slot-id",
+		"pkcs11:slot-id=0;token=t;object=farad?module-path=a.so":     "unsupported attribute \"token\"",
+		"pkcs11:slot-id=0;object=farad?module-path=a.so&pin-value=1": "unsupported query attribute \"pin-value\"",
+		"pkcs11:slot-id=0;object=farad;type=cert?module-path=a.so":   "must refer to a private key",
+		"pkcs11:slot-id=0;object=a;object=b?module-path=a.so":        "duplicate attribute \"object\"",
+		"pkcs11:slot-id=0;object=%zz?module-path=a.so":               "invalid attribute",
+		"pkcs11:slot-id=0;object?module-path=a.so":                   "invalid attribute",
+	}
+	for uri, expected := range cases {
+		_, err := ParseURI(uri)
+		testutil.CheckError(t, err, expected)
+	}
+}
@@ -0,0 +1,76 @@
+package secretutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadPassphrase reads a passphrase from the source described by spec. The options are "file:<path>", "env:<variable>",
+// which is removed from the environment once read, and "credential:<name>", which is a systemd credential found in
+// $CREDENTIALS_DIRECTORY. A single trailing newline is removed, since most ways of writing a passphrase to a file
+// add one.
+func ReadPassphrase(spec string) ([]byte, error) {
+	var passphrase []byte
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		data, err := ioutil.ReadFile(spec[len("file:"):])
+		if err != nil {
+			return nil, fmt.Errorf("while reading passphrase: %s", err.Error())
+		}
+		passphrase = data
+	case strings.HasPrefix(spec, "env:"):
+		name := spec[len("env:"):]
+		value, found := os.LookupEnv(name)
+		if !found {
+			return nil, fmt.Errorf("passphrase variable %s is not set", name)
+		}
+		// so that it isn't inherited by anything that we might run
+		os.Unsetenv(name)
+		passphrase = []byte(value)
+	case strings.HasPrefix(spec, "credential:"):
+		data, err := readCredential(spec[len("credential:"):])
+		if err != nil {
+			return nil, err
+		}
+		passphrase = data
+	default:
+		return nil, fmt.Errorf("unknown passphrase source %q", spec)
+	}
+	if bytes.HasSuffix(passphrase, []byte("\r\n")) {
+		passphrase = passphrase[:len(passphrase)-2]
+	} else if bytes.HasSuffix(passphrase, []byte("\n")) {
+		passphrase = passphrase[:len(passphrase)-1]
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// readCredential reads a credential that systemd has passed to this service with LoadCredential= or SetCredential=.
+func readCredential(name string) ([]byte, error) {
+	directory := os.Getenv("CREDENTIALS_DIRECTORY")
+	if directory == "" {
+		return nil, errors.New("no systemd credentials available: CREDENTIALS_DIRECTORY is not set")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return nil, fmt.Errorf("invalid credential name %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(directory, name))
+	if err != nil {
+		return nil, fmt.Errorf("while reading credential: %s", err.Error())
+	}
+	return data, nil
+}
+
+// Wipe overwrites a secret once it is no longer needed, so that it doesn't linger in memory any longer than necessary.
+func Wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
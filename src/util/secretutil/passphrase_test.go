@@ -0,0 +1,123 @@
+package secretutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"util/testutil"
+)
+
+func writeTemp(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "secretutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestReadPassphrase_File(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, contents := range []string{"hunter2", "hunter2\n", "hunter2\r\n"} {
+		passphrase, err := ReadPassphrase("file:" + writeTemp(t, dir, "passphrase", contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(passphrase) != "hunter2" {
+			t.Errorf("wrong passphrase: %q", passphrase)
+		}
+	}
+}
+
+func TestReadPassphrase_OnlyOneNewline(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	passphrase, err := ReadPassphrase("file:" + writeTemp(t, dir, "passphrase", " hunter2 \n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passphrase) != " hunter2 \n" {
+		t.Errorf("wrong passphrase: %q", passphrase)
+	}
+}
+
+func TestReadPassphrase_MissingFile(t *testing.T) {
+	_, err := ReadPassphrase("file:/nonexistent/passphrase")
+	testutil.CheckError(t, err, "while reading passphrase")
+}
+
+func TestReadPassphrase_Empty(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	_, err := ReadPassphrase("file:" + writeTemp(t, dir, "passphrase", "\n"))
+	testutil.CheckError(t, err, "passphrase is empty")
+}
+
+func TestReadPassphrase_Env(t *testing.T) {
+	os.Setenv("SECRETUTIL_TEST_PASSPHRASE", "hunter2")
+	passphrase, err := ReadPassphrase("env:SECRETUTIL_TEST_PASSPHRASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passphrase) != "hunter2" {
+		t.Errorf("wrong passphrase: %q", passphrase)
+	}
+	if _, found := os.LookupEnv("SECRETUTIL_TEST_PASSPHRASE"); found {
+		t.Error("passphrase should have been removed from the environment")
+	}
+}
+
+func TestReadPassphrase_EnvUnset(t *testing.T) {
+	os.Unsetenv("SECRETUTIL_TEST_PASSPHRASE")
+	_, err := ReadPassphrase("env:SECRETUTIL_TEST_PASSPHRASE")
+	testutil.CheckError(t, err, "passphrase variable SECRETUTIL_TEST_PASSPHRASE is not set")
+}
+
+func TestReadPassphrase_Credential(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	writeTemp(t, dir, "farad-key", "hunter2\n")
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	passphrase, err := ReadPassphrase("credential:farad-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(passphrase) != "hunter2" {
+		t.Errorf("wrong passphrase: %q", passphrase)
+	}
+	_, err = ReadPassphrase("credential:../farad-key")
+	testutil.CheckError(t, err, "invalid credential name")
+	_, err = ReadPassphrase("credential:other-key")
+	testutil.CheckError(t, err, "while reading credential")
+}
+
+func TestReadPassphrase_NoCredentials(t *testing.T) {
+	os.Unsetenv("CREDENTIALS_DIRECTORY")
+	_, err := ReadPassphrase("credential:farad-key")
+	testutil.CheckError(t, err, "CREDENTIALS_DIRECTORY is not set")
+}
+
+func TestReadPassphrase_UnknownSource(t *testing.T) {
+	_, err := ReadPassphrase("hunter2")
+	testutil.CheckError(t, err, "unknown passphrase source")
+}
+
+func TestWipe(t *testing.T) {
+	secret := []byte("hunter2")
+	Wipe(secret)
+	for _, b := range secret {
+		if b != 0 {
+			t.Fatal("secret was not wiped")
+		}
+	}
+}
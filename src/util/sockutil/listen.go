@@ -0,0 +1,81 @@
+// Package sockutil opens the sockets that servers listen on, either by binding addresses directly, or by receiving
+// sockets that were already opened by systemd.
+package sockutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd socket activation, as defined by sd_listen_fds(3).
+const SD_LISTEN_FDS_START = 3
+
+// ListenAll binds a TCP listener to each of the specified addresses. Either all of them are opened, or none are.
+func ListenAll(addrs []string) ([]net.Listener, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to listen on")
+	}
+	listeners := []net.Listener{}
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			CloseAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// CloseAll closes each of the listeners, ignoring any errors.
+func CloseAll(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// SystemdListeners returns the sockets passed to this process by systemd socket activation, in the order that they were
+// listed in the socket unit. If this process was not socket-activated, it returns no listeners and no error. The
+// environment variables used by systemd are cleared, so that they are not inherited by any child processes.
+//
+// Because systemd keeps the listening sockets open while the service restarts, no connections are refused during the
+// restart; they just wait in the accept queue until the new process picks them up.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listenersFromEnv(pid, fds, SD_LISTEN_FDS_START)
+}
+
+func listenersFromEnv(pid string, fds string, start int) ([]net.Listener, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// these were meant for another process, such as our parent
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+	listeners := []net.Listener{}
+	for fd := start; fd < start+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		// FileListener duplicates the descriptor, so the original is no longer needed either way
+		file.Close()
+		if err != nil {
+			CloseAll(listeners)
+			return nil, fmt.Errorf("while accepting socket %d from systemd: %s", fd, err.Error())
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
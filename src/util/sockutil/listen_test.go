@@ -0,0 +1,100 @@
+package sockutil
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"util/testutil"
+)
+
+func TestListenAll(t *testing.T) {
+	listeners, err := ListenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseAll(listeners)
+	if len(listeners) != 2 {
+		t.Fatal("wrong number of listeners")
+	}
+	if listeners[0].Addr().String() == listeners[1].Addr().String() {
+		t.Error("should have been distinct sockets")
+	}
+}
+
+func TestListenAll_Empty(t *testing.T) {
+	_, err := ListenAll(nil)
+	testutil.CheckError(t, err, "no addresses to listen on")
+}
+
+func TestListenAll_ClosesOnFailure(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// pick a free port, and then make the second bind to it fail
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	_, err = ListenAll([]string{addr, first.Addr().String()})
+	testutil.CheckError(t, err, "address already in use")
+	// if the first listener was closed, the port can be bound again
+	again, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+}
+
+func TestListenersFromEnv_NotActivated(t *testing.T) {
+	listeners, err := listenersFromEnv("", "", SD_LISTEN_FDS_START)
+	if err != nil || listeners != nil {
+		t.Error("should have found nothing")
+	}
+}
+
+func TestListenersFromEnv_OtherProcess(t *testing.T) {
+	listeners, err := listenersFromEnv(strconv.Itoa(os.Getpid()+1), "2", SD_LISTEN_FDS_START)
+	if err != nil || listeners != nil {
+		t.Error("should have ignored sockets for another process")
+	}
+}
+
+func TestListenersFromEnv_Invalid(t *testing.T) {
+	_, err := listenersFromEnv(strconv.Itoa(os.Getpid()), "many", SD_LISTEN_FDS_START)
+	testutil.CheckError(t, err, "invalid LISTEN_FDS")
+}
+
+func TestListenersFromEnv_Inherited(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+	// this duplicates the socket onto a new descriptor, much like systemd would have passed it
+	file, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listenersFromEnv(strconv.Itoa(os.Getpid()), "1", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseAll(listeners)
+	if len(listeners) != 1 {
+		t.Fatal("wrong number of listeners")
+	}
+	if listeners[0].Addr().String() != original.Addr().String() {
+		t.Error("should have been the same socket")
+	}
+}
@@ -1,26 +1,94 @@
 package testkeyutil
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"fmt"
 	"math/big"
 	"net"
 	"testing"
 	"time"
 )
 
+// A KeyAlgorithm selects the kind of key generated for a test certificate.
+type KeyAlgorithm int
+
+const (
+	RSA KeyAlgorithm = iota
+	ECDSA
+	Ed25519
+)
+
+// KeyAlgorithms lists every supported KeyAlgorithm, for tests that should be run against each of them.
+var KeyAlgorithms = []KeyAlgorithm{RSA, ECDSA, Ed25519}
+
+func (algorithm KeyAlgorithm) String() string {
+	switch algorithm {
+	case RSA:
+		return "RSA"
+	case ECDSA:
+		return "ECDSA"
+	case Ed25519:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("KeyAlgorithm(%d)", int(algorithm))
+	}
+}
+
+func GenerateKeyForTests(t *testing.T, algorithm KeyAlgorithm) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case RSA:
+		key, err = rsa.GenerateKey(rand.Reader, 512) // NOTE: this is LAUGHABLY SMALL! do not attempt to use this in production.
+	case ECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatal("Unknown key algorithm: " + algorithm.String())
+	}
+	if err != nil {
+		t.Fatal("Could not generate TLS keypair: " + err.Error())
+	}
+	return key
+}
+
 func GenerateTLSKeypairForTests(t *testing.T, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey *rsa.PrivateKey) (*rsa.PrivateKey, *x509.Certificate) {
 	return GenerateTLSKeypairForTests_WithTime(t, commonname, dns, ips, parent, parentkey, time.Now(), time.Hour)
 }
 
 func GenerateTLSKeypairForTests_WithTime(t *testing.T, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey *rsa.PrivateKey, issueat time.Time, duration time.Duration) (*rsa.PrivateKey, *x509.Certificate) {
-	key, err := rsa.GenerateKey(rand.Reader, 512) // NOTE: this is LAUGHABLY SMALL! do not attempt to use this in production.
-	if err != nil {
-		t.Fatal("Could not generate TLS keypair: " + err.Error())
+	return GenerateTLSKeypairForTests_Customized(t, commonname, dns, ips, parent, parentkey, func(certTemplate *x509.Certificate) {
+		certTemplate.NotBefore = issueat
+		certTemplate.NotAfter = issueat.Add(duration)
+	})
+}
+
+// customize is called on the certificate template just before it is signed, and may change any of its fields.
+func GenerateTLSKeypairForTests_Customized(t *testing.T, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey *rsa.PrivateKey, customize func(certTemplate *x509.Certificate)) (*rsa.PrivateKey, *x509.Certificate) {
+	key := GenerateKeyForTests(t, RSA).(*rsa.PrivateKey)
+	var signer crypto.Signer
+	if parentkey != nil {
+		signer = parentkey
 	}
+	return key, signTLSCertForTests(t, key, commonname, dns, ips, parent, signer, customize)
+}
+
+// GenerateTLSKeypairForTests_WithAlgorithm is like GenerateTLSKeypairForTests, except that the key may be of any
+// algorithm, and so may the key of the parent.
+func GenerateTLSKeypairForTests_WithAlgorithm(t *testing.T, algorithm KeyAlgorithm, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey crypto.Signer) (crypto.Signer, *x509.Certificate) {
+	key := GenerateKeyForTests(t, algorithm)
+	return key, signTLSCertForTests(t, key, commonname, dns, ips, parent, parentkey, nil)
+}
 
+func signTLSCertForTests(t *testing.T, key crypto.Signer, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey crypto.Signer, customize func(certTemplate *x509.Certificate)) *x509.Certificate {
 	serialNumber, err := rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
 	if err != nil {
 		t.Fatal("Could not generate TLS keypair: " + err.Error())
@@ -29,7 +97,7 @@ func GenerateTLSKeypairForTests_WithTime(t *testing.T, commonname string, dns []
 	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
 
 	certTemplate := &x509.Certificate{
-		SignatureAlgorithm: x509.SHA256WithRSA,
+		// the signature algorithm is left for x509 to choose, since it depends on the type of the parent's key
 
 		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		ExtKeyUsage: extKeyUsage,
@@ -40,14 +108,18 @@ func GenerateTLSKeypairForTests_WithTime(t *testing.T, commonname string, dns []
 
 		SerialNumber: serialNumber,
 
-		NotBefore: issueat,
-		NotAfter:  issueat.Add(duration),
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
 
 		Subject:     pkix.Name{CommonName: commonname},
 		DNSNames:    dns,
 		IPAddresses: ips,
 	}
 
+	if customize != nil {
+		customize(certTemplate)
+	}
+
 	if parent == nil {
 		parent = certTemplate
 		parentkey = key
@@ -61,5 +133,5 @@ func GenerateTLSKeypairForTests_WithTime(t *testing.T, commonname string, dns []
 	if err != nil {
 		t.Fatal("Could not generate TLS keypair: " + err.Error())
 	}
-	return key, cert
+	return cert
 }
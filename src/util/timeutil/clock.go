@@ -0,0 +1,144 @@
+package timeutil
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the time, and waits for time to pass, so that code that depends on time can be tested with a FakeClock
+// instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	// After delivers the time on the returned channel once 'd' has passed, like time.After.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is like After, except that the timer can be stopped, so that it doesn't linger until it would have fired.
+	NewTimer(d time.Duration) Timer
+}
+
+// A Timer delivers the time on its channel once, like time.Timer, unless it is stopped first.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer had already fired or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// RealClock is the system clock.
+var RealClock Clock = realClock{}
+
+type fakeWaiter struct {
+	until time.Time
+	ch    chan time.Time
+}
+
+// A FakeClock only moves when it is advanced. It is safe to use from multiple goroutines.
+type FakeClock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	clock := &FakeClock{now: start}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// buffered, so that advancing the clock never waits for anyone to receive
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{until: c.now.Add(d), ch: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{c, c.After(d)}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	ch    <-chan time.Time
+}
+
+func (t fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop forgets the waiter of the timer, so that it no longer counts towards BlockUntil.
+func (t fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, waiter := range t.clock.waiters {
+		if waiter.ch == t.ch {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward, and wakes up everything waiting for a time that has now been reached.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	remaining := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.until.After(c.now) {
+			remaining = append(remaining, waiter)
+		} else {
+			waiter.ch <- c.now
+		}
+	}
+	c.waiters = remaining
+}
+
+// BlockUntil waits until at least 'count' callers are waiting on the clock, so that a test can be sure that a goroutine
+// has started waiting before advancing the clock past the time it is waiting for. Timers that have fired or been
+// stopped are not counted.
+func (c *FakeClock) BlockUntil(count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.waiters) < count {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,94 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2017, 8, 6, 3, 38, 38, 0, time.UTC)
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	if !clock.Now().Equal(testStart) {
+		t.Errorf("wrong time: %v", clock.Now())
+	}
+	soon, later := clock.After(time.Second), clock.After(time.Minute)
+	clock.Advance(time.Second - time.Nanosecond)
+	select {
+	case <-soon:
+		t.Fatal("should not have fired yet")
+	default:
+	}
+	clock.Advance(time.Nanosecond)
+	if fired := <-soon; !fired.Equal(testStart.Add(time.Second)) {
+		t.Errorf("fired at the wrong time: %v", fired)
+	}
+	select {
+	case <-later:
+		t.Fatal("should not have fired yet")
+	default:
+	}
+	clock.Advance(time.Hour)
+	<-later
+	if !clock.Now().Equal(testStart.Add(time.Hour + time.Second)) {
+		t.Errorf("wrong time: %v", clock.Now())
+	}
+	// waiting for no time at all doesn't need the clock to move
+	<-clock.After(0)
+}
+
+func TestFakeClock_Timer(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	stopped, running := clock.NewTimer(time.Second), clock.NewTimer(time.Minute)
+	clock.BlockUntil(2)
+	if !stopped.Stop() {
+		t.Error("timer should have been running")
+	}
+	if stopped.Stop() {
+		t.Error("timer should already have been stopped")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer should not fire")
+	default:
+	}
+	if fired := <-running.C(); !fired.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("fired at the wrong time: %v", fired)
+	}
+	if running.Stop() {
+		t.Error("timer should already have fired")
+	}
+	clock.mustHaveWaiters(t, 0)
+}
+
+func (c *FakeClock) mustHaveWaiters(t *testing.T, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.waiters) != count {
+		t.Errorf("expected %d waiters, not %d", count, len(c.waiters))
+	}
+}
+
+func TestTickOn(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	ticks := make(chan time.Time, 10)
+	halt := TickOn(clock, func() { ticks <- clock.Now() }, time.Second)
+	for i := 1; i <= 3; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		if tick := <-ticks; !tick.Equal(testStart.Add(time.Second * time.Duration(i))) {
+			t.Errorf("tick %d at the wrong time: %v", i, tick)
+		}
+	}
+	halt()
+	// a tick that was already waiting may still happen, but no more after it
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 5)
+		clock.Advance(time.Second)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if len(ticks) > 1 {
+		t.Errorf("should have halted, but ticked %d more times", len(ticks))
+	}
+}
@@ -7,6 +7,11 @@ import (
 
 // Calls cb() every (period) amount of time, until halt() (the returned function) is called.
 func Tick(cb func(), period time.Duration) func() {
+	return TickOn(RealClock, cb, period)
+}
+
+// TickOn is like Tick, except that time is measured by 'clock'.
+func TickOn(clock Clock, cb func(), period time.Duration) func() {
 	should_halt := false
 	halt_mutex := sync.Mutex{}
 
@@ -24,7 +29,7 @@ func Tick(cb func(), period time.Duration) func() {
 
 	go func() {
 		for !check_halt() {
-			time.Sleep(period)
+			<-clock.After(period)
 			cb()
 		}
 	}()
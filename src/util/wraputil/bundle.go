@@ -0,0 +1,83 @@
+package wraputil
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var pemBegin = []byte("-----BEGIN ")
+
+// LoadPEMBlocks loads every PEM block in a bundle, in order. Text between the blocks, such as the comments that some
+// tools write above each certificate, is ignored. Unlike pem.Decode, a malformed block is reported rather than skipped.
+func LoadPEMBlocks(data []byte) ([]*pem.Block, error) {
+	blocks := []*pem.Block{}
+	for {
+		start := bytes.Index(data, pemBegin)
+		if start < 0 {
+			return blocks, nil
+		}
+		data = data[start:]
+		block, rest := pem.Decode(data)
+		// pem.Decode silently moves on to the next block when one is malformed, so make sure it didn't
+		next := bytes.Index(data[1:], pemBegin)
+		if block == nil || (next >= 0 && len(data)-len(rest) > next+1) {
+			return nil, fmt.Errorf("Could not parse PEM block %d", len(blocks)+1)
+		}
+		blocks = append(blocks, block)
+		data = rest
+	}
+}
+
+// LoadX509CertsFromPEM loads every certificate in a bundle, in order. Every block in the bundle must be a certificate.
+func LoadX509CertsFromPEM(data []byte) ([]*x509.Certificate, error) {
+	blocks, err := LoadPEMBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("No certificates found in PEM bundle")
+	}
+	certs := []*x509.Certificate{}
+	for i, block := range blocks {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Found PEM block %d of type \"%s\" instead of CERTIFICATE", i+1, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing certificate %d: %s", i+1, err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// LoadX509CertPoolFromPEM loads a bundle of trusted certificates, such as the old and new roots while a CA is rolled.
+func LoadX509CertPoolFromPEM(data []byte) (*x509.CertPool, error) {
+	certs, err := LoadX509CertsFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// LoadX509ChainFromPEM loads a leaf certificate followed by the intermediates that issued it, as found in a fullchain
+// file. Each certificate must have been issued by the one that follows it, so that a misordered file is caught early.
+func LoadX509ChainFromPEM(data []byte) ([]*x509.Certificate, error) {
+	certs, err := LoadX509CertsFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(certs); i++ {
+		if err := certs[i-1].CheckSignatureFrom(certs[i]); err != nil {
+			return nil, fmt.Errorf("certificate %d was not issued by certificate %d: %s", i, i+1, err.Error())
+		}
+	}
+	return certs, nil
+}
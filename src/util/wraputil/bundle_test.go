@@ -0,0 +1,101 @@
+package wraputil
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"util/testutil"
+)
+
+// the way that some distributions format their CA bundles
+const TLS_TEST_BUNDLE = "# test\n# RSA 2048\n" + TLS_TEST_CERT + "\n\n# test\n# ECDSA P-521\n" + TLS_TEST_ECDSA_CERT + "\n\n# p256-test\n" + TLS_TEST_P256_CERT + "\n"
+
+func TestLoadPEMBlocks(t *testing.T) {
+	blocks, err := LoadPEMBlocks([]byte(TLS_TEST_CERT + "\n" + TLS_TEST_P256_KEY + "\ntrailing comment\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Type != "CERTIFICATE" || blocks[1].Type != "EC PRIVATE KEY" {
+		t.Error("wrong blocks loaded")
+	}
+}
+
+func TestLoadPEMBlocks_Empty(t *testing.T) {
+	blocks, err := LoadPEMBlocks([]byte("# nothing here\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Error("should have found no blocks")
+	}
+}
+
+func TestLoadPEMBlocks_Malformed(t *testing.T) {
+	// pem.Decode on its own would skip over the broken second block, and return the third
+	broken := strings.Replace(TLS_TEST_ECDSA_CERT, "-----END CERTIFICATE-----", "-----END CERTIFICAT-----", 1)
+	_, err := LoadPEMBlocks([]byte(TLS_TEST_CERT + "\n" + broken + "\n" + TLS_TEST_P256_CERT))
+	testutil.CheckError(t, err, "Could not parse PEM block 2")
+}
+
+func TestLoadPEMBlocks_MalformedLast(t *testing.T) {
+	_, err := LoadPEMBlocks([]byte(TLS_TEST_CERT + "\n" + TLS_TEST_P256_CERT[:100]))
+	testutil.CheckError(t, err, "Could not parse PEM block 2")
+}
+
+func TestLoadX509CertsFromPEM(t *testing.T) {
+	certs, err := LoadX509CertsFromPEM([]byte(TLS_TEST_BUNDLE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{TLS_TEST_CERT, TLS_TEST_ECDSA_CERT, TLS_TEST_P256_CERT}
+	if len(certs) != len(expected) {
+		t.Fatal("wrong number of certificates loaded")
+	}
+	for i, text := range expected {
+		cert, err := LoadX509CertFromPEM([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Equal(certs[i]) {
+			t.Errorf("certificate %d was not loaded correctly", i+1)
+		}
+	}
+}
+
+func TestLoadX509CertsFromPEM_Empty(t *testing.T) {
+	_, err := LoadX509CertsFromPEM([]byte("# nothing here\n"))
+	testutil.CheckError(t, err, "No certificates found in PEM bundle")
+}
+
+func TestLoadX509CertsFromPEM_WrongType(t *testing.T) {
+	_, err := LoadX509CertsFromPEM([]byte(TLS_TEST_CERT + "\n" + TLS_TEST_P256_KEY))
+	testutil.CheckError(t, err, "Found PEM block 2 of type \"EC PRIVATE KEY\" instead of CERTIFICATE")
+}
+
+func TestLoadX509CertsFromPEM_BadCertificate(t *testing.T) {
+	broken := strings.Replace(TLS_TEST_P256_CERT, "MIIBfzCCASWg", "MIIBfzCCASWZ", 1)
+	_, err := LoadX509CertsFromPEM([]byte(TLS_TEST_CERT + "\n" + broken))
+	testutil.CheckError(t, err, "while parsing certificate 2")
+}
+
+func TestLoadX509CertPoolFromPEM(t *testing.T) {
+	pool, err := LoadX509CertPoolFromPEM([]byte(TLS_TEST_BUNDLE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{TLS_TEST_CERT, TLS_TEST_ECDSA_CERT, TLS_TEST_P256_CERT} {
+		cert, err := LoadX509CertFromPEM([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the roots are all self-signed, so each can only be verified if it is in the pool
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: cert.NotBefore}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLoadX509CertPoolFromPEM_Empty(t *testing.T) {
+	_, err := LoadX509CertPoolFromPEM(nil)
+	testutil.CheckError(t, err, "No certificates found in PEM bundle")
+}
@@ -0,0 +1,193 @@
+package wraputil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+var errIncorrectPassphrase = errors.New("could not decrypt private key: incorrect passphrase")
+
+// LoadEncryptedPrivateKeyFromPEM is like LoadPrivateKeyFromPEM, except that the key must be encrypted with the
+// passphrase, either as an encrypted PKCS#8 block (PBES2 with PBKDF2 and AES-CBC, as written by modern versions of
+// OpenSSL) or as a legacy encrypted PEM block. If the passphrase is nil, the key must not be encrypted.
+func LoadEncryptedPrivateKeyFromPEM(keydata []byte, passphrase []byte) (crypto.Signer, error) {
+	keyblock, err := loadSinglePEM(keydata, []string{"RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", "ENCRYPTED PRIVATE KEY"})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := keyblock.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(keyblock)
+	if passphrase == nil {
+		if encrypted {
+			return nil, errors.New("private key is encrypted, but no passphrase was provided")
+		}
+		return parsePrivateKey(keyblock.Bytes)
+	}
+	// otherwise, a key that was meant to be encrypted on disk might have been left in the clear without anyone noticing
+	if !encrypted {
+		return nil, errors.New("passphrase provided, but private key is not encrypted")
+	}
+
+	var decrypted []byte
+	if keyblock.Type == "ENCRYPTED PRIVATE KEY" {
+		decrypted, err = decryptPKCS8(keyblock.Bytes, passphrase)
+	} else {
+		decrypted, err = x509.DecryptPEMBlock(keyblock, passphrase)
+		if err == x509.IncorrectPasswordError {
+			err = errIncorrectPassphrase
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(decrypted)
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// from RFC 5208 and RFC 8018
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// unmarshalExactly is asn1.Unmarshal, except that trailing data is an error.
+func unmarshalExactly(data []byte, value interface{}) error {
+	rest, err := asn1.Unmarshal(data, value)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo into the PKCS#8 PrivateKeyInfo that it holds.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	info := encryptedPrivateKeyInfo{}
+	if err := unmarshalExactly(der, &info); err != nil {
+		return nil, fmt.Errorf("while parsing encrypted PKCS#8 block: %s", err.Error())
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption scheme %s: only PBES2 is supported", info.EncryptionAlgorithm.Algorithm)
+	}
+	params := pbes2Params{}
+	if err := unmarshalExactly(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("while parsing PBES2 parameters: %s", err.Error())
+	}
+
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s: only AES-CBC is supported", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if err := unmarshalExactly(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC parameters")
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s: only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	kdf := pbkdf2Params{}
+	if err := unmarshalExactly(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("while parsing PBKDF2 parameters: %s", err.Error())
+	}
+	if kdf.IterationCount < 1 || (kdf.KeyLength != 0 && kdf.KeyLength != keyLength) {
+		return nil, errors.New("invalid PBKDF2 parameters")
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 pseudorandom function %s", kdf.PRF.Algorithm)
+	}
+
+	key := pbkdf2(prf, passphrase, kdf.Salt, kdf.IterationCount, keyLength)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted private key has invalid length")
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	// a wrong passphrase almost always shows up as invalid padding
+	padding := int(decrypted[len(decrypted)-1])
+	if padding < 1 || padding > aes.BlockSize || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errIncorrectPassphrase
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// pbkdf2 derives a key from a password, as specified by RFC 8018.
+func pbkdf2(prf func() hash.Hash, password []byte, salt []byte, iterations int, length int) []byte {
+	mac := hmac.New(prf, password)
+	derived := []byte{}
+	for index := uint32(1); len(derived) < length; index++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, index)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:length]
+}
@@ -2,7 +2,11 @@ package wraputil
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -10,6 +14,15 @@ import (
 )
 
 func LoadSinglePEMBlock(data []byte, expected_types []string) ([]byte, error) {
+	pemBlock, err := loadSinglePEM(data, expected_types)
+	if err != nil {
+		return nil, err
+	}
+	return pemBlock.Bytes, nil
+}
+
+// loadSinglePEM is LoadSinglePEMBlock, except that it returns the headers of the block along with its contents.
+func loadSinglePEM(data []byte, expected_types []string) (*pem.Block, error) {
 	if !bytes.HasPrefix(data, []byte("-----BEGIN ")) {
 		return nil, errors.New("Missing expected PEM header")
 	}
@@ -30,7 +43,7 @@ func LoadSinglePEMBlock(data []byte, expected_types []string) ([]byte, error) {
 	if remain != nil && len(remain) > 0 {
 		return nil, errors.New("Trailing data found after PEM data")
 	}
-	return pemBlock.Bytes, nil
+	return pemBlock, nil
 }
 
 func LoadX509CertFromPEM(certdata []byte) (*x509.Certificate, error) {
@@ -78,3 +91,96 @@ func LoadRSAKeyFromPEM(keydata []byte) (*rsa.PrivateKey, error) {
 	}
 	return nil, errors.New("could not load PEM private key as PKCS#1 or PKCS#8")
 }
+
+// LoadPrivateKeyFromPEM loads an RSA, ECDSA, or Ed25519 private key. RSA keys may be in PKCS#1 or PKCS#8 form, ECDSA
+// keys in SEC 1 or PKCS#8 form, and Ed25519 keys in PKCS#8 form, which is the only one defined for them.
+func LoadPrivateKeyFromPEM(keydata []byte) (crypto.Signer, error) {
+	return LoadEncryptedPrivateKeyFromPEM(keydata, nil)
+}
+
+func parsePrivateKey(keyblock []byte) (crypto.Signer, error) {
+	if rsakey, err := x509.ParsePKCS1PrivateKey(keyblock); err == nil {
+		return rsakey, nil
+	}
+	if eckey, err := x509.ParseECPrivateKey(keyblock); err == nil {
+		return eckey, nil
+	}
+	tmpkey, err := x509.ParsePKCS8PrivateKey(keyblock)
+	if err == nil {
+		// RSA, ECDSA, and Ed25519 keys are all signers; X25519 keys, for example, are not
+		privkey, ok := tmpkey.(crypto.Signer)
+		if ok {
+			return privkey, nil
+		} else {
+			return nil, fmt.Errorf("unsupported private key of type %T found in PKCS#8 block", tmpkey)
+		}
+	}
+	return nil, errors.New("could not load PEM private key as PKCS#1, SEC 1, or PKCS#8")
+}
+
+// LoadPublicKeyFromPEM loads an RSA, ECDSA, or Ed25519 public key, either on its own in PKIX form, as written by
+// 'openssl pkey -pubout', or from a certificate.
+func LoadPublicKeyFromPEM(keydata []byte) (crypto.PublicKey, error) {
+	keyblock, err := loadSinglePEM(keydata, []string{"PUBLIC KEY", "CERTIFICATE"})
+	if err != nil {
+		return nil, err
+	}
+	if keyblock.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(keyblock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(keyblock.Bytes)
+}
+
+// CheckKeyMatchesCert makes sure that the private key belongs to the public key in the certificate, so that a
+// mismatched pair is caught when it is loaded, rather than during the first handshake.
+func CheckKeyMatchesCert(key crypto.Signer, cert *x509.Certificate) error {
+	matches := false
+	switch pubkey := key.Public().(type) {
+	case *rsa.PublicKey:
+		certkey, ok := cert.PublicKey.(*rsa.PublicKey)
+		matches = ok && pubkey.N.Cmp(certkey.N) == 0 && pubkey.E == certkey.E
+	case *ecdsa.PublicKey:
+		certkey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		matches = ok && pubkey.Curve == certkey.Curve && pubkey.X.Cmp(certkey.X) == 0 && pubkey.Y.Cmp(certkey.Y) == 0
+	case ed25519.PublicKey:
+		certkey, ok := cert.PublicKey.(ed25519.PublicKey)
+		matches = ok && bytes.Equal(pubkey, certkey)
+	default:
+		return fmt.Errorf("unsupported private key of type %T", key)
+	}
+	if !matches {
+		return errors.New("private key does not match certificate")
+	}
+	return nil
+}
+
+// LoadTLSKeypairFromPEM loads a certificate, along with any intermediate certificates that follow it, and the
+// private key for the certificate, which may be of any type supported by LoadPrivateKeyFromPEM.
+func LoadTLSKeypairFromPEM(certdata []byte, keydata []byte) (tls.Certificate, error) {
+	return LoadEncryptedTLSKeypairFromPEM(certdata, keydata, nil)
+}
+
+// LoadEncryptedTLSKeypairFromPEM is like LoadTLSKeypairFromPEM, except that the private key is loaded with
+// LoadEncryptedPrivateKeyFromPEM.
+func LoadEncryptedTLSKeypairFromPEM(certdata []byte, keydata []byte, passphrase []byte) (tls.Certificate, error) {
+	chain, err := LoadX509ChainFromPEM(certdata)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := LoadEncryptedPrivateKeyFromPEM(keydata, passphrase)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := CheckKeyMatchesCert(key, chain[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	keypair := tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, cert := range chain {
+		keypair.Certificate = append(keypair.Certificate, cert.Raw)
+	}
+	return keypair, nil
+}